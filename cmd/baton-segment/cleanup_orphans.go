@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+func newCleanupOrphansCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cleanup-orphans",
+		Short: "Remove permissions referencing deleted sources, warehouses, functions and spaces",
+		Long: "Find the permissions of users and groups referencing resources that no longer exist, and remove these " +
+			"references after asking for confirmation. Roles left without resources are removed. With --dry-run the " +
+			"changes are logged without being made. Only resource types that are synced are checked.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			yes, _ := cmd.Flags().GetBool("yes")
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			report, err := s.OrphanedPermissions(ctx)
+			if err != nil {
+				return err
+			}
+
+			if err := writeOrphans(os.Stdout, report.Orphans); err != nil {
+				return err
+			}
+			if len(report.Orphans) == 0 {
+				return nil
+			}
+
+			if !yes && !cfg.DryRun {
+				ok, err := confirm(fmt.Sprintf("Remove %d orphaned permissions?", len(report.Orphans)))
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fmt.Errorf("cleanup cancelled")
+				}
+			}
+
+			return s.CleanupOrphans(ctx, report)
+		},
+	}
+
+	cmd.Flags().Bool("yes", false, "Remove the orphaned permissions without asking for confirmation")
+
+	return cmd
+}
+
+func writeOrphans(w io.Writer, orphans []connector.OrphanedPermission) error {
+	if len(orphans) == 0 {
+		_, err := fmt.Fprintln(w, "No orphaned permissions found.")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKSPACE\tPRINCIPAL\tROLE\tRESOURCE TYPE\tRESOURCE ID")
+	for _, orphan := range orphans {
+		fmt.Fprintf(tw, "%s\t%s %s\t%s\t%s\t%s\n",
+			orphan.WorkspaceName,
+			orphan.PrincipalType,
+			orphan.Principal,
+			orphan.RoleName,
+			orphan.ResourceType,
+			orphan.ResourceID,
+		)
+	}
+
+	return tw.Flush()
+}
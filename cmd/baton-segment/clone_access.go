@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+func newCloneAccessCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "clone-access <reference-email> <target-email>",
+		Short: "Give a user the direct permissions and group memberships of a reference user",
+		Long: "Compare the direct permissions and group memberships of the reference user to those of the target " +
+			"user, show the access the target would be given, and give it after confirmation. Access is only added, " +
+			"the target keeps the access they already have. With --dry-run the changes are logged without being made.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			workspace, _ := cmd.Flags().GetString("workspace")
+			resourceTypes, _ := cmd.Flags().GetStringSlice("resource-types")
+			excludePrivileged, _ := cmd.Flags().GetBool("exclude-privileged")
+			excludeRoles, _ := cmd.Flags().GetStringSlice("exclude-roles")
+			yes, _ := cmd.Flags().GetBool("yes")
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			clone, err := s.CloneAccess(ctx, args[0], args[1], connector.CloneAccessOptions{
+				Workspace:         workspace,
+				ResourceTypes:     resourceTypes,
+				ExcludePrivileged: excludePrivileged,
+				ExcludeRoles:      excludeRoles,
+			})
+			if err != nil {
+				return err
+			}
+
+			writeAccessClone(os.Stdout, clone)
+			if len(clone.AddedPermissions) == 0 && len(clone.AddedGroups) == 0 {
+				return nil
+			}
+
+			if !yes && !cfg.DryRun {
+				ok, err := confirm(fmt.Sprintf("Give %s this access?", clone.Target))
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fmt.Errorf("clone cancelled")
+				}
+			}
+
+			return s.ApplyAccessClone(ctx, clone)
+		},
+	}
+
+	cmd.Flags().String("workspace", "", "The ID, name or slug of the workspace, required when several workspaces are configured")
+	cmd.Flags().StringSlice("resource-types", nil, "The resource types to clone: workspace, source, warehouse, function, space and group, all if not set")
+	cmd.Flags().Bool("exclude-privileged", false, "Leave out the Workspace Owner and admin roles, and the groups holding them")
+	cmd.Flags().StringSlice("exclude-roles", nil, "The names or IDs of other roles to leave out, along with the groups holding them")
+	cmd.Flags().Bool("yes", false, "Give the access without asking for confirmation")
+
+	return cmd
+}
+
+// writeAccessClone writes the access a clone adds, and what it leaves out.
+func writeAccessClone(w io.Writer, clone *connector.AccessClone) {
+	fmt.Fprintf(w, "Clone access of %s to %s in workspace %s (%s)\n\n", clone.Reference, clone.Target, clone.WorkspaceName, clone.WorkspaceID)
+	if len(clone.AddedPermissions) == 0 && len(clone.AddedGroups) == 0 {
+		fmt.Fprintf(w, "No changes, %s already has this access.\n", clone.Target)
+	}
+
+	for _, permission := range clone.AddedPermissions {
+		fmt.Fprintf(w, "  + permission %s\n", permission)
+	}
+	for _, group := range clone.AddedGroups {
+		fmt.Fprintf(w, "  + group %s\n", group)
+	}
+	for _, skipped := range clone.Skipped {
+		fmt.Fprintf(w, "  skip %s\n", skipped)
+	}
+}
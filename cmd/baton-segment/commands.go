@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/conductorone/baton-sdk/pkg/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// loadCommandConfig loads the configuration of a subcommand the same way the connector command does, from flags,
+// BATON_ environment variables and the .baton.yaml file, validates it and sets up logging.
+//
+// The loading is a copy of the unexported loadConfig of the SDK's cli package (baton-sdk v0.1.33), which
+// subcommands can't call, and must be kept in line with it when the SDK is upgraded.
+func loadCommandConfig(ctx context.Context, cmd *cobra.Command, cfg *config) (context.Context, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+
+	cfgPath, cfgName, err := getConfigPath(os.Getenv("BATON_CONFIG_PATH"))
+	if err != nil {
+		return nil, err
+	}
+	v.SetConfigName(cfgName)
+	v.AddConfigPath(cfgPath)
+
+	// the SDK runs the connector without the config file when it can't be read, so subcommands do too.
+	_ = v.ReadInConfig()
+
+	v.SetEnvPrefix("baton")
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+	if err := v.BindPFlags(cmd.PersistentFlags()); err != nil {
+		return nil, err
+	}
+	if err := v.BindPFlags(cmd.Flags()); err != nil {
+		return nil, err
+	}
+	if err := v.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+
+	ctx, err = logging.Init(
+		ctx,
+		logging.WithLogFormat(v.GetString("log-format")),
+		logging.WithLogLevel(v.GetString("log-level")),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	return ctx, nil
+}
+
+// getConfigPath returns the directory and the name without extension of the config file, as the SDK's cli package
+// does: the file of BATON_CONFIG_PATH, which must be a YAML file, or .baton.yaml in the working directory.
+func getConfigPath(customPath string) (string, string, error) {
+	if customPath != "" {
+		cfgDir, cfgFile := filepath.Split(filepath.Clean(customPath))
+		if cfgDir == "" {
+			cfgDir = "."
+		}
+
+		ext := filepath.Ext(cfgFile)
+		if ext != ".yaml" && ext != ".yml" {
+			return "", "", errors.New("expected config file to have .yaml or .yml extension")
+		}
+
+		return strings.TrimSuffix(cfgDir, string(filepath.Separator)), strings.TrimSuffix(cfgFile, ext), nil
+	}
+
+	return ".", ".baton", nil
+}
+
+// confirm asks a yes or no question on stderr and reads the answer from stdin. Anything but y or yes is a no.
+func confirm(question string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// openOutput returns the file at path to write a subcommand's output to, or stdout if path is empty.
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+
+	return f, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/conductorone/baton-sdk/pkg/cli"
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/conductorone/baton-segment/pkg/segment"
 	"github.com/spf13/cobra"
 )
 
@@ -12,19 +16,167 @@ import (
 type config struct {
 	cli.BaseConfig `mapstructure:",squash"` // Puts the base config options in the same place as the connector options
 
-	Token string `mapstructure:"token"`
+	Token               string        `mapstructure:"token"`
+	Tokens              []string      `mapstructure:"tokens"`
+	RemoveOldWriteKeys  bool          `mapstructure:"remove-old-write-keys"`
+	WriteKeyGracePeriod time.Duration `mapstructure:"write-key-grace-period"`
+	WriteKeyRemovalFile string        `mapstructure:"write-key-removal-file"`
+	SyncResourceTypes   []string      `mapstructure:"sync-resource-types"`
+	SkipResourceTypes   []string      `mapstructure:"skip-resource-types"`
+	OAuthClientID       string        `mapstructure:"oauth-client-id"`
+	OAuthKeyID          string        `mapstructure:"oauth-key-id"`
+	OAuthPrivateKeyPath string        `mapstructure:"oauth-private-key-path"`
+	OAuthTokenURL       string        `mapstructure:"oauth-token-url"`
+	OAuthScope          string        `mapstructure:"oauth-scope"`
+	PolicyFile          string        `mapstructure:"policy-file"`
+	ProtectedRoles      []string      `mapstructure:"protected-roles"`
+	ProtectedPrincipals []string      `mapstructure:"protected-principals"`
+	MinOwnerCount       int           `mapstructure:"min-owner-count"`
+	DryRun              bool          `mapstructure:"dry-run"`
+	AuditJournal        string        `mapstructure:"audit-journal"`
+	PrefetchConcurrency int           `mapstructure:"user-prefetch-concurrency"`
+	PrefetchRate        float64       `mapstructure:"user-prefetch-rate"`
+	IdPName             string        `mapstructure:"idp-name"`
+	IdPManagedGroups    []string      `mapstructure:"idp-managed-groups"`
+	IdPManagedDomains   []string      `mapstructure:"idp-managed-email-domains"`
+	AllowIdPChanges     bool          `mapstructure:"allow-idp-managed-changes"`
+	SoDRules            string        `mapstructure:"sod-rules"`
+
+	// onDone are called once the command is over, to log the dry run summary of the connectors it created.
+	onDone []func()
 }
 
 // validateConfig is run after the configuration is loaded, and should return an error if it isn't valid.
 func validateConfig(ctx context.Context, cfg *config) error {
-	if cfg.Token == "" {
+	oauthSet := cfg.OAuthClientID != "" || cfg.OAuthKeyID != "" || cfg.OAuthPrivateKeyPath != ""
+	if cfg.Token == "" && len(cfg.Tokens) == 0 && !oauthSet {
 		return fmt.Errorf("access token is missing")
 	}
 
+	if oauthSet && (cfg.OAuthClientID == "" || cfg.OAuthKeyID == "" || cfg.OAuthPrivateKeyPath == "") {
+		return fmt.Errorf("oauth-client-id, oauth-key-id and oauth-private-key-path are all required for OAuth authentication")
+	}
+
+	if cfg.WriteKeyGracePeriod < 0 {
+		return fmt.Errorf("write key grace period must not be negative")
+	}
+
+	if cfg.RemoveOldWriteKeys && cfg.WriteKeyGracePeriod > 0 && cfg.WriteKeyRemovalFile == "" {
+		return fmt.Errorf("write-key-removal-file is required with a write key grace period, previous write keys are removed from it by a later run")
+	}
+
+	if cfg.IdPName != "" && len(cfg.IdPManagedGroups) == 0 && len(cfg.IdPManagedDomains) == 0 {
+		return fmt.Errorf("idp-managed-groups or idp-managed-email-domains is required with idp-name, Segment's API doesn't say which users and groups are managed through SCIM")
+	}
+
+	if cfg.PrefetchConcurrency < 1 {
+		return fmt.Errorf("user prefetch concurrency must be at least 1")
+	}
+
+	if cfg.PrefetchRate < 0 {
+		return fmt.Errorf("user prefetch rate must not be negative")
+	}
+
+	if cfg.MinOwnerCount < 0 {
+		return fmt.Errorf("min owner count must not be negative")
+	}
+
+	if len(cfg.SyncResourceTypes) > 0 && len(cfg.SkipResourceTypes) > 0 {
+		return fmt.Errorf("only one of sync-resource-types and skip-resource-types can be set")
+	}
+
 	return nil
 }
 
 // cmdFlags sets the cmdFlags required for the connector.
 func cmdFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().String("token", "", "The Segment access token used to connect to the Segment API. ($BATON_TOKEN)")
+	cmd.PersistentFlags().StringSlice("tokens", nil, "The Segment access tokens of additional workspaces to sync, one token per workspace. ($BATON_TOKENS)")
+	cmd.PersistentFlags().String("oauth-client-id", "", "The client ID of the Segment OAuth app used to connect to the Segment API. ($BATON_OAUTH_CLIENT_ID)")
+	cmd.PersistentFlags().String("oauth-key-id", "", "The ID of the public key registered with the Segment OAuth app. ($BATON_OAUTH_KEY_ID)")
+	cmd.PersistentFlags().String("oauth-private-key-path", "", "The path to the PEM encoded private key used to sign OAuth token requests. ($BATON_OAUTH_PRIVATE_KEY_PATH)")
+	cmd.PersistentFlags().String("oauth-token-url", segment.OAuthTokenUrl, "The Segment OAuth token endpoint. ($BATON_OAUTH_TOKEN_URL)")
+	cmd.PersistentFlags().String("oauth-scope", segment.OAuthScope, "The scope requested for OAuth access tokens. ($BATON_OAUTH_SCOPE)")
+	cmd.PersistentFlags().String("policy-file", "", "The path to a YAML provisioning policy with protected roles, protected principals and the minimum owner count. ($BATON_POLICY_FILE)")
+	cmd.PersistentFlags().StringSlice("protected-roles", nil, "The names or IDs of roles that can never be granted by the connector. ($BATON_PROTECTED_ROLES)")
+	cmd.PersistentFlags().StringSlice("protected-principals", nil, "The IDs or emails of users and groups that can never be modified by the connector. ($BATON_PROTECTED_PRINCIPALS)")
+	cmd.PersistentFlags().Int("min-owner-count", 0, "The number of Workspace Owners that must remain after a revoke, at least one always remains. ($BATON_MIN_OWNER_COUNT)")
+	cmd.PersistentFlags().String("audit-journal", "", "The path to an append-only JSONL file recording every change made in Segment. ($BATON_AUDIT_JOURNAL)")
+	cmd.PersistentFlags().String("idp-name", "", "The name of the identity provider managing users and groups through SCIM, used in errors. ($BATON_IDP_NAME)")
+	cmd.PersistentFlags().StringSlice("idp-managed-groups", nil, "The IDs or names of groups pushed by the identity provider through SCIM. ($BATON_IDP_MANAGED_GROUPS)")
+	cmd.PersistentFlags().StringSlice("idp-managed-email-domains", nil, "The email domains of users provisioned by the identity provider through SCIM. ($BATON_IDP_MANAGED_EMAIL_DOMAINS)")
+	cmd.PersistentFlags().Bool("allow-idp-managed-changes", false, "Allow group membership changes of users and groups managed by the identity provider. ($BATON_ALLOW_IDP_MANAGED_CHANGES)")
+	cmd.PersistentFlags().String("sod-rules", "", "The path to a YAML file of separation of duties rules, violations are annotated on users during sync. ($BATON_SOD_RULES)")
+	cmd.PersistentFlags().Bool("dry-run", false, "Log the permission and group membership changes of provisioning without making them. ($BATON_DRY_RUN)")
+	cmd.PersistentFlags().Int("user-prefetch-concurrency", 10, "The number of users fetched at the same time during sync. ($BATON_USER_PREFETCH_CONCURRENCY)")
+	cmd.PersistentFlags().Float64("user-prefetch-rate", 0, "The maximum number of requests per second made to fetch users during sync, on top of the rate limit budget of the token. ($BATON_USER_PREFETCH_RATE)")
+	cmd.PersistentFlags().Bool("remove-old-write-keys", false, "Remove the previous write keys of a source after rotating its write key. ($BATON_REMOVE_OLD_WRITE_KEYS)")
+	cmd.PersistentFlags().StringSlice("sync-resource-types", nil, "The resource types to sync, all resource types are synced if not set. ($BATON_SYNC_RESOURCE_TYPES)")
+	cmd.PersistentFlags().StringSlice("skip-resource-types", nil, "The resource types to skip during sync. ($BATON_SKIP_RESOURCE_TYPES)")
+	cmd.PersistentFlags().Duration("write-key-grace-period", 0, "How long previous write keys stay valid after rotation before they are removed. ($BATON_WRITE_KEY_GRACE_PERIOD)")
+	cmd.PersistentFlags().String("write-key-removal-file", "", "The path to a file recording previous write keys until their grace period ends, they're removed by the first rotation or remove-write-keys run after it. ($BATON_WRITE_KEY_REMOVAL_FILE)")
+}
+
+// tokens returns the access tokens of all workspaces to sync.
+func (cfg *config) tokens() []string {
+	var tokens []string
+	if cfg.Token != "" {
+		tokens = append(tokens, cfg.Token)
+	}
+
+	return append(tokens, cfg.Tokens...)
+}
+
+// oauthConfig returns the OAuth app credentials, or nil when OAuth authentication isn't configured.
+func (cfg *config) oauthConfig() (*segment.OAuthConfig, error) {
+	if cfg.OAuthClientID == "" {
+		return nil, nil
+	}
+
+	keyData, err := os.ReadFile(cfg.OAuthPrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OAuth private key: %w", err)
+	}
+
+	privateKey, err := segment.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &segment.OAuthConfig{
+		ClientID:   cfg.OAuthClientID,
+		KeyID:      cfg.OAuthKeyID,
+		PrivateKey: privateKey,
+		TokenURL:   cfg.OAuthTokenURL,
+		Scope:      cfg.OAuthScope,
+	}, nil
+}
+
+// provisioningPolicy returns the provisioning policy from the policy file, extended with the policy flags.
+func (cfg *config) provisioningPolicy() (*connector.ProvisioningPolicy, error) {
+	policy := &connector.ProvisioningPolicy{}
+	if cfg.PolicyFile != "" {
+		var err error
+		policy, err = connector.LoadProvisioningPolicy(cfg.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	policy.Merge(connector.ProvisioningPolicy{
+		ProtectedRoles:      cfg.ProtectedRoles,
+		ProtectedPrincipals: cfg.ProtectedPrincipals,
+		MinOwnerCount:       cfg.MinOwnerCount,
+	})
+
+	return policy, nil
+}
+
+// sodRules returns the separation of duties rules of the rules file, or nil if there is none.
+func (cfg *config) sodRules() (*connector.SoDRules, error) {
+	if cfg.SoDRules == "" {
+		return nil, nil
+	}
+
+	return connector.LoadSoDRules(cfg.SoDRules)
 }
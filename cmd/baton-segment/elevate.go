@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+const defaultElevationStateFile = "baton-segment-elevations.json"
+
+func newElevateCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "elevate",
+		Short: "Grant a role to a user for a limited time",
+		Long: "Grant the role to the user with the given email, on the workspace or on the resources given with " +
+			"--resource, and record the elevation in the state file until it expires. The elevation is recorded " +
+			"before the role is granted, and the state file is locked so concurrent runs don't lose elevations. The " +
+			"expire command restores the permissions the user had before the elevation. With --dry-run the grant " +
+			"is logged without being made and the state file isn't written.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			workspace, _ := cmd.Flags().GetString("workspace")
+			email, _ := cmd.Flags().GetString("email")
+			role, _ := cmd.Flags().GetString("role")
+			resourceFlags, _ := cmd.Flags().GetStringSlice("resource")
+			duration, _ := cmd.Flags().GetDuration("duration")
+			reason, _ := cmd.Flags().GetString("reason")
+			statePath, _ := cmd.Flags().GetString("state-file")
+
+			var resources []connector.DesiredResource
+			for _, r := range resourceFlags {
+				resourceType, id, ok := strings.Cut(r, ":")
+				if !ok || resourceType == "" || id == "" {
+					return fmt.Errorf("invalid resource %q, use TYPE:ID or TYPE:NAME", r)
+				}
+				resources = append(resources, connector.DesiredResource{Type: resourceType, ID: id})
+			}
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			elevation, err := s.Elevate(ctx, statePath, connector.ElevationRequest{
+				Workspace: workspace,
+				Email:     email,
+				Role:      role,
+				Resources: resources,
+				Duration:  duration,
+				Reason:    reason,
+			})
+			if err != nil {
+				return err
+			}
+
+			if cfg.DryRun {
+				return nil
+			}
+
+			fmt.Fprintf(
+				os.Stdout,
+				"Elevated %s to %s in workspace %s until %s (elevation %s)\n",
+				elevation.UserEmail,
+				elevation.RoleName,
+				elevation.WorkspaceName,
+				elevation.ExpiresAt.Format(time.RFC3339),
+				elevation.ID,
+			)
+			return nil
+		},
+	}
+
+	cmd.Flags().String("workspace", "", "The ID, name or slug of the workspace, required when several workspaces are configured")
+	cmd.Flags().String("email", "", "The email of the user to elevate")
+	cmd.Flags().String("role", "", "The name or ID of the role to grant")
+	cmd.Flags().StringSlice("resource", nil, "The resources to grant the role on as TYPE:ID or TYPE:NAME, the workspace if not set")
+	cmd.Flags().Duration("duration", time.Hour, "How long the elevation lasts")
+	cmd.Flags().String("reason", "", "Why the elevation is needed, recorded in the state file")
+	cmd.Flags().String("state-file", defaultElevationStateFile, "The file recording the active elevations")
+	_ = cmd.MarkFlagRequired("email")
+	_ = cmd.MarkFlagRequired("role")
+
+	return cmd
+}
+
+func newExpireCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "expire",
+		Short: "Revert the elevations whose time is up",
+		Long: "Restore the exact permissions users had before their elevations expired, and remove these elevations " +
+			"from the state file. Elevations that fail to revert stay in the state file to be retried, so the " +
+			"command can be run from cron. With --dry-run the changes are logged without being made.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			statePath, _ := cmd.Flags().GetString("state-file")
+			all, _ := cmd.Flags().GetBool("all")
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			state, err := connector.LoadElevationState(statePath)
+			if err != nil {
+				return err
+			}
+			if len(state.Elevations) == 0 {
+				return nil
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			expired, err := s.ExpireElevations(ctx, statePath, time.Now(), all)
+			for _, elevation := range expired {
+				fmt.Fprintf(os.Stdout, "Expired elevation %s of %s to %s in workspace %s\n", elevation.ID, elevation.UserEmail, elevation.RoleName, elevation.WorkspaceName)
+			}
+
+			return err
+		},
+	}
+
+	cmd.Flags().String("state-file", defaultElevationStateFile, "The file recording the active elevations")
+	cmd.Flags().Bool("all", false, "Revert every elevation, expired or not")
+
+	return cmd
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+var accessColumns = []string{
+	"workspace",
+	"user_email",
+	"user_name",
+	"resource_type",
+	"resource_id",
+	"resource_name",
+	"role",
+	"via_group",
+}
+
+func accessRow(access connector.Access) []string {
+	return []string{
+		access.WorkspaceName,
+		access.UserEmail,
+		access.UserName,
+		access.ResourceType,
+		access.ResourceID,
+		access.ResourceName,
+		access.RoleName,
+		access.ViaGroupName,
+	}
+}
+
+func newExportAccessCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export-access",
+		Short: "Export the effective access of every user as a flat table",
+		Long: "Export one row per role a user holds on a resource, directly or through a group. " +
+			"Workspace-wide roles are listed on the workspace.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			output, _ := cmd.Flags().GetString("output")
+			if format != "csv" && format != "json" && format != "xlsx" {
+				return fmt.Errorf("unsupported format %s, use csv, xlsx or json", format)
+			}
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			matrix, err := s.AccessMatrix(ctx)
+			if err != nil {
+				return err
+			}
+
+			w, err := openOutput(output)
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+
+			switch format {
+			case "json":
+				return writeAccessJSON(w, matrix)
+			case "xlsx":
+				return writeAccessXLSX(w, matrix)
+			default:
+				return writeAccessCSV(w, matrix)
+			}
+		},
+	}
+
+	cmd.Flags().String("format", "csv", "The output format: csv, xlsx or json")
+	cmd.Flags().StringP("output", "o", "", "The file to write to, stdout if not set")
+
+	return cmd
+}
+
+func writeAccessCSV(w io.Writer, matrix []connector.Access) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(accessColumns); err != nil {
+		return err
+	}
+	for _, access := range matrix {
+		if err := cw.Write(accessRow(access)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func writeAccessJSON(w io.Writer, matrix []connector.Access) error {
+	if matrix == nil {
+		matrix = []connector.Access{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(matrix)
+}
+
+func writeAccessXLSX(w io.Writer, matrix []connector.Access) error {
+	rows := make([][]string, 0, len(matrix)+1)
+	rows = append(rows, accessColumns)
+	for _, access := range matrix {
+		rows = append(rows, accessRow(access))
+	}
+
+	return writeXLSX(w, "Access", rows)
+}
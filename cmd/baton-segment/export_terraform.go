@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+func newExportTerraformCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export-terraform",
+		Short: "Export the groups, members and permissions of every workspace as Terraform HCL",
+		Long: "Write the users, groups, group members and permissions of every workspace as segment_user and " +
+			"segment_user_group resources of Segment's Terraform provider to segment_iam.tf, and import blocks " +
+			"adopting them to imports.tf. With several workspaces, every workspace is written to a directory named " +
+			"after its slug.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			outputDir, _ := cmd.Flags().GetString("output-dir")
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			configs, err := s.TerraformConfigs(ctx)
+			if err != nil {
+				return err
+			}
+
+			for _, c := range configs {
+				dir := outputDir
+				if len(configs) > 1 {
+					dir = filepath.Join(outputDir, c.WorkspaceSlug)
+				}
+				if err := writeTerraformConfig(dir, c); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "Wrote workspace %s to %s\n", c.WorkspaceName, dir)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().String("output-dir", "terraform", "The directory to write the Terraform files to")
+
+	return cmd
+}
+
+func writeTerraformConfig(dir string, c *connector.TerraformConfig) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	for name, write := range map[string]func(*os.File) error{
+		"segment_iam.tf": func(f *os.File) error { return c.WriteResources(f) },
+		"imports.tf":     func(f *os.File) error { return c.WriteImports(f) },
+	} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", name, err)
+		}
+		err = write(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
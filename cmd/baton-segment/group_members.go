@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+var groupMemberChangeColumns = []string{
+	"workspace",
+	"group",
+	"action",
+	"email",
+}
+
+func newGroupMembersCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "group-members",
+		Short: "Add, remove or replace group members in bulk from a CSV file",
+		Long: "Change the members of groups from a CSV file of group and email pairs. Groups are given by ID or name. " +
+			"Every change is checked against the provisioning policy before any is made, and with --dry-run the " +
+			"changes are listed without being made.",
+	}
+
+	cmd.AddCommand(
+		newGroupMembersOperationCmd(ctx, cfg, "add", "Add the listed users to their groups",
+			func(s *connector.Segment) func(context.Context, []connector.GroupMember) ([]connector.GroupMembersChange, error) {
+				return s.AddGroupMembers
+			},
+		),
+		newGroupMembersOperationCmd(ctx, cfg, "remove", "Remove the listed users from their groups",
+			func(s *connector.Segment) func(context.Context, []connector.GroupMember) ([]connector.GroupMembersChange, error) {
+				return s.RemoveGroupMembers
+			},
+		),
+		newGroupMembersOperationCmd(ctx, cfg, "replace", "Make the listed users the only members of their groups",
+			func(s *connector.Segment) func(context.Context, []connector.GroupMember) ([]connector.GroupMembersChange, error) {
+				return s.ReplaceGroupMembers
+			},
+		),
+	)
+
+	return cmd
+}
+
+func newGroupMembersOperationCmd(
+	ctx context.Context,
+	cfg *config,
+	use string,
+	short string,
+	operation func(s *connector.Segment) func(context.Context, []connector.GroupMember) ([]connector.GroupMembersChange, error),
+) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use + " <members.csv>",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString("output")
+
+			members, err := readGroupMembersCSV(args[0])
+			if err != nil {
+				return err
+			}
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			changes, opErr := operation(s)(ctx, members)
+
+			w, err := openOutput(output)
+			if err != nil {
+				return errors.Join(opErr, err)
+			}
+			defer w.Close()
+
+			if err := writeGroupMemberChangesCSV(w, changes); err != nil {
+				return errors.Join(opErr, err)
+			}
+
+			return opErr
+		},
+	}
+
+	cmd.Flags().StringP("output", "o", "", "The file to write the changes made to, stdout if not set")
+
+	return cmd
+}
+
+// readGroupMembersCSV reads group and email pairs from a CSV file. A header row naming the group and email columns
+// is skipped.
+func readGroupMembersCSV(path string) ([]connector.GroupMember, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open members file: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+
+	var rv []connector.GroupMember
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read members file: %w", err)
+		}
+
+		if line == 1 && strings.EqualFold(record[0], "group") && strings.EqualFold(record[1], "email") {
+			continue
+		}
+
+		rv = append(rv, connector.GroupMember{Group: record[0], Email: record[1]})
+	}
+
+	return rv, nil
+}
+
+func writeGroupMemberChangesCSV(w io.Writer, changes []connector.GroupMembersChange) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(groupMemberChangeColumns); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		for _, email := range change.Added {
+			if err := cw.Write([]string{change.WorkspaceName, change.GroupName, "add", email}); err != nil {
+				return err
+			}
+		}
+		for _, email := range change.Removed {
+			if err := cw.Write([]string{change.WorkspaceName, change.GroupName, "remove", email}); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
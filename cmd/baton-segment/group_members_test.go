@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+)
+
+func TestReadGroupMembersCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []connector.GroupMember
+		wantErr bool
+	}{
+		{
+			name: "with a header",
+			csv:  "Group,Email\nAnalysts, jane@example.com\ng-admins,john@example.com\n",
+			want: []connector.GroupMember{
+				{Group: "Analysts", Email: "jane@example.com"},
+				{Group: "g-admins", Email: "john@example.com"},
+			},
+		},
+		{
+			name: "without a header",
+			csv:  "\"Data, Analytics\",jane@example.com\n",
+			want: []connector.GroupMember{{Group: "Data, Analytics", Email: "jane@example.com"}},
+		},
+		{
+			name: "header only",
+			csv:  "group,email\n",
+		},
+		{
+			name:    "missing column",
+			csv:     "Analysts,jane@example.com\nEngineering\n",
+			wantErr: true,
+		},
+		{
+			name:    "extra column",
+			csv:     "Analysts,jane@example.com,add\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "members.csv")
+			if err := os.WriteFile(path, []byte(tt.csv), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readGroupMembersCSV(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readGroupMembersCSV() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("members = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteGroupMemberChangesCSV(t *testing.T) {
+	changes := []connector.GroupMembersChange{
+		{WorkspaceName: "Prod", GroupName: "Analysts", Added: []string{"jane@example.com"}, Removed: []string{"john@example.com"}},
+		{WorkspaceName: "Prod", GroupName: "Data, Analytics", Added: []string{"ann@example.com"}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeGroupMemberChangesCSV(&buf, changes); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "workspace,group,action,email\n" +
+		"Prod,Analysts,add,jane@example.com\n" +
+		"Prod,Analysts,remove,john@example.com\n" +
+		"Prod,\"Data, Analytics\",add,ann@example.com\n"
+	if buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+}
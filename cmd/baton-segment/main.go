@@ -28,8 +28,24 @@ func main() {
 
 	cmd.Version = version
 	cmdFlags(cmd)
+	cmd.AddCommand(newExportAccessCmd(ctx, cfg))
+	cmd.AddCommand(newExportTerraformCmd(ctx, cfg))
+	cmd.AddCommand(newGroupMembersCmd(ctx, cfg))
+	cmd.AddCommand(newSoDCheckCmd(ctx, cfg))
+	cmd.AddCommand(newPlanCmd(ctx, cfg))
+	cmd.AddCommand(newApplyCmd(ctx, cfg))
+	cmd.AddCommand(newCleanupOrphansCmd(ctx, cfg))
+	cmd.AddCommand(newMigrateToGroupsCmd(ctx, cfg))
+	cmd.AddCommand(newOffboardCmd(ctx, cfg))
+	cmd.AddCommand(newCloneAccessCmd(ctx, cfg))
+	cmd.AddCommand(newElevateCmd(ctx, cfg))
+	cmd.AddCommand(newExpireCmd(ctx, cfg))
+	cmd.AddCommand(newRemoveWriteKeysCmd(ctx, cfg))
 
 	err = cmd.Execute()
+	for _, done := range cfg.onDone {
+		done()
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -39,9 +55,8 @@ func main() {
 func getConnector(ctx context.Context, cfg *config) (types.ConnectorServer, error) {
 	l := ctxzap.Extract(ctx)
 
-	cb, err := connector.New(ctx, cfg.Token)
+	cb, err := newSegment(ctx, cfg)
 	if err != nil {
-		l.Error("error creating connector", zap.Error(err))
 		return nil, err
 	}
 
@@ -51,5 +66,59 @@ func getConnector(ctx context.Context, cfg *config) (types.ConnectorServer, erro
 		return nil, err
 	}
 
-	return c, nil
+	return connector.WithAssetServer(c, cb), nil
+}
+
+// newSegment creates the Segment connector from the configuration.
+func newSegment(ctx context.Context, cfg *config) (*connector.Segment, error) {
+	l := ctxzap.Extract(ctx)
+
+	opts := []connector.Option{
+		connector.WithWriteKeyRotation(cfg.RemoveOldWriteKeys, cfg.WriteKeyGracePeriod),
+		connector.WithWriteKeyRemovalFile(cfg.WriteKeyRemovalFile),
+		connector.WithResourceTypes(cfg.SyncResourceTypes, cfg.SkipResourceTypes),
+		connector.WithDryRun(cfg.DryRun),
+		connector.WithAuditJournal(cfg.AuditJournal),
+		connector.WithUserPrefetch(cfg.PrefetchConcurrency, cfg.PrefetchRate),
+		connector.WithIdPManagement(connector.IdPManagement{
+			Name:         cfg.IdPName,
+			Groups:       cfg.IdPManagedGroups,
+			EmailDomains: cfg.IdPManagedDomains,
+			AllowChanges: cfg.AllowIdPChanges,
+		}),
+	}
+
+	oauthConfig, err := cfg.oauthConfig()
+	if err != nil {
+		l.Error("error loading OAuth credentials", zap.Error(err))
+		return nil, err
+	}
+	if oauthConfig != nil {
+		opts = append(opts, connector.WithOAuthCredentials(*oauthConfig))
+	}
+
+	policy, err := cfg.provisioningPolicy()
+	if err != nil {
+		l.Error("error loading provisioning policy", zap.Error(err))
+		return nil, err
+	}
+	opts = append(opts, connector.WithProvisioningPolicy(*policy))
+
+	sodRules, err := cfg.sodRules()
+	if err != nil {
+		l.Error("error loading SoD rules", zap.Error(err))
+		return nil, err
+	}
+	opts = append(opts, connector.WithSoDRules(sodRules))
+
+	cb, err := connector.New(ctx, cfg.tokens(), opts...)
+	if err != nil {
+		l.Error("error creating connector", zap.Error(err))
+		return nil, err
+	}
+	cfg.onDone = append(cfg.onDone, func() {
+		cb.LogDryRunSummary(ctx)
+	})
+
+	return cb, nil
 }
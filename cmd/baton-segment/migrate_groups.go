@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+func newMigrateToGroupsCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate-to-groups",
+		Short: "Move identical direct permissions of users to groups",
+		Long: "Cluster the users holding identical direct permissions and propose a group for every cluster, an " +
+			"existing group holding exactly these permissions or a new one. After confirmation the new groups are " +
+			"created with the permissions, the users are added to their groups and their direct permissions are " +
+			"removed. With --dry-run the changes are logged without being made.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			yes, _ := cmd.Flags().GetBool("yes")
+			minMembers, _ := cmd.Flags().GetInt("min-members")
+			prefix, _ := cmd.Flags().GetString("group-prefix")
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			migrations, err := s.GroupMigrations(ctx, connector.GroupMigrationOptions{
+				MinMembers:  minMembers,
+				GroupPrefix: prefix,
+			})
+			if err != nil {
+				return err
+			}
+
+			proposals := 0
+			for _, migration := range migrations {
+				writeGroupMigration(os.Stdout, migration)
+				proposals += len(migration.Proposals)
+			}
+			if proposals == 0 {
+				return nil
+			}
+
+			if !yes && !cfg.DryRun {
+				ok, err := confirm(fmt.Sprintf("Apply %d group proposals?", proposals))
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fmt.Errorf("migration cancelled")
+				}
+			}
+
+			for _, migration := range migrations {
+				if err := s.ApplyGroupMigration(ctx, migration); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("yes", false, "Apply the proposals without asking for confirmation")
+	cmd.Flags().Int("min-members", 2, "The number of users that must hold the same direct permissions for a new group to be proposed")
+	cmd.Flags().String("group-prefix", "", "The prefix of the names of the proposed new groups")
+
+	return cmd
+}
+
+func writeGroupMigration(w io.Writer, migration *connector.GroupMigration) {
+	fmt.Fprintf(w, "Workspace %s (%s)\n\n", migration.WorkspaceName, migration.WorkspaceID)
+	if len(migration.Proposals) == 0 {
+		fmt.Fprintln(w, "No groups proposed.")
+	}
+
+	for _, proposal := range migration.Proposals {
+		if proposal.GroupID == "" {
+			fmt.Fprintf(w, "create group %s\n", proposal.Group)
+		} else {
+			fmt.Fprintf(w, "use group %s (%s)\n", proposal.Group, proposal.GroupID)
+		}
+		for _, permission := range proposal.Permissions {
+			fmt.Fprintf(w, "  permission %s\n", permission)
+		}
+		for _, member := range proposal.Members {
+			fmt.Fprintf(w, "  member %s\n", member)
+		}
+	}
+
+	for _, skipped := range migration.Skipped {
+		fmt.Fprintf(w, "skip %s: %s\n", skipped.Email, skipped.Reason)
+	}
+	fmt.Fprintln(w)
+}
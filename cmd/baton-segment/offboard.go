@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+// signedOffboardSummary is an offboarding summary with the signature of its compact JSON encoding.
+type signedOffboardSummary struct {
+	Summary   json.RawMessage  `json:"summary"`
+	Signature summarySignature `json:"signature"`
+}
+
+// summarySignature holds no public key: a key shipped with the signature would verify any summary signed by anyone,
+// so verifiers use the public key of the signing key they already trust.
+type summarySignature struct {
+	Algorithm string `json:"algorithm"`
+	Value     []byte `json:"value"`
+}
+
+func newOffboardCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "offboard",
+		Short: "Remove a user from every group, permission and workspace, and revoke their invites",
+		Long: "Remove the user with the given email from all their groups, clear their direct permissions, remove " +
+			"them from every configured workspace and revoke their pending invites. Offboarding is refused before " +
+			"any change if the user is the last Workspace Owner of a workspace. A summary of the changes, signed " +
+			"with the key of --signing-key, is written to stdout or to the file given with --output.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			email, _ := cmd.Flags().GetString("email")
+			keyPath, _ := cmd.Flags().GetString("signing-key")
+			output, _ := cmd.Flags().GetString("output")
+			yes, _ := cmd.Flags().GetBool("yes")
+
+			signer, err := loadSigningKey(keyPath)
+			if err != nil {
+				return err
+			}
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			if !yes && !cfg.DryRun {
+				ok, err := confirm(fmt.Sprintf("Offboard %s from every workspace?", email))
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fmt.Errorf("offboarding cancelled")
+				}
+			}
+
+			summary, offboardErr := s.Offboard(ctx, email)
+			if summary == nil {
+				return offboardErr
+			}
+
+			signed, err := signOffboardSummary(summary, signer)
+			if err != nil {
+				return errors.Join(offboardErr, err)
+			}
+
+			w, err := openOutput(output)
+			if err != nil {
+				return errors.Join(offboardErr, err)
+			}
+			defer w.Close()
+
+			if _, err := w.Write(append(signed, '\n')); err != nil {
+				return errors.Join(offboardErr, err)
+			}
+
+			return offboardErr
+		},
+	}
+
+	cmd.Flags().String("email", "", "The email of the user to offboard")
+	cmd.Flags().String("signing-key", "", "The path to the PEM encoded Ed25519, ECDSA or RSA private key signing the summary")
+	cmd.Flags().StringP("output", "o", "", "The file to write the signed summary to, stdout if not set")
+	cmd.Flags().Bool("yes", false, "Offboard the user without asking for confirmation")
+	_ = cmd.MarkFlagRequired("email")
+	_ = cmd.MarkFlagRequired("signing-key")
+
+	return cmd
+}
+
+// loadSigningKey reads a PEM encoded PKCS #8, PKCS #1 or SEC 1 private key.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found in %s", path)
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported signing key type %T", key)
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("failed to parse signing key %s", path)
+}
+
+// signOffboardSummary signs the compact JSON encoding of the summary, kept as is in the signed summary.
+func signOffboardSummary(summary *connector.OffboardSummary, signer crypto.Signer) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(summary); err != nil {
+		return nil, err
+	}
+	payload := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	var algorithm string
+	var signature []byte
+	var err error
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		algorithm = "Ed25519"
+		signature, err = signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	case *rsa.PublicKey:
+		algorithm = "RSA-SHA256"
+		digest := sha256.Sum256(payload)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case *ecdsa.PublicKey:
+		algorithm = "ECDSA-SHA256"
+		digest := sha256.Sum256(payload)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", signer.Public())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign summary: %w", err)
+	}
+
+	var out bytes.Buffer
+	enc = json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(signedOffboardSummary{
+		Summary: payload,
+		Signature: summarySignature{
+			Algorithm: algorithm,
+			Value:     signature,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+)
+
+// verifySummary checks the signature of a signed summary with the public key of the signing key.
+func verifySummary(t *testing.T, data []byte, publicKey crypto.PublicKey) bool {
+	t.Helper()
+
+	var signed signedOffboardSummary
+	if err := json.Unmarshal(data, &signed); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(signed.Summary)
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		return signed.Signature.Algorithm == "Ed25519" && ed25519.Verify(key, signed.Summary, signed.Signature.Value)
+	case *rsa.PublicKey:
+		return signed.Signature.Algorithm == "RSA-SHA256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signed.Signature.Value) == nil
+	case *ecdsa.PublicKey:
+		return signed.Signature.Algorithm == "ECDSA-SHA256" && ecdsa.VerifyASN1(key, digest[:], signed.Signature.Value)
+	}
+
+	t.Fatalf("unsupported public key type %T", publicKey)
+	return false
+}
+
+func TestSignOffboardSummary(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaDER, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519DER, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		block *pem.Block
+		key   crypto.Signer
+	}{
+		{name: "Ed25519 PKCS #8", block: &pem.Block{Type: "PRIVATE KEY", Bytes: ed25519DER}, key: ed25519Key},
+		{name: "ECDSA SEC 1", block: &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecdsaDER}, key: ecdsaKey},
+		{name: "RSA PKCS #1", block: &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, key: rsaKey},
+	}
+
+	summary := &connector.OffboardSummary{
+		Email:     "jane@example.com",
+		StartedAt: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Workspaces: []connector.OffboardWorkspace{
+			{WorkspaceID: "ws1", WorkspaceName: "<Prod & Co>", UserID: "u1", GroupsRemoved: []string{"Admins"}, UserRemoved: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key.pem")
+			if err := os.WriteFile(path, pem.EncodeToMemory(tt.block), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			signer, err := loadSigningKey(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signed, err := signOffboardSummary(summary, signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(signed), "public_key") {
+				t.Error("signed summary embeds a public key")
+			}
+			if !verifySummary(t, signed, tt.key.Public()) {
+				t.Fatal("signature doesn't verify")
+			}
+
+			var decoded struct {
+				Summary connector.OffboardSummary `json:"summary"`
+			}
+			if err := json.Unmarshal(signed, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Summary.Workspaces[0].WorkspaceName != "<Prod & Co>" {
+				t.Errorf("workspace name = %q, want it unescaped", decoded.Summary.Workspaces[0].WorkspaceName)
+			}
+
+			tampered := strings.Replace(string(signed), `"user_removed":true`, `"user_removed":false`, 1)
+			if tampered == string(signed) {
+				t.Fatal("summary wasn't tampered with")
+			}
+			if verifySummary(t, []byte(tampered), tt.key.Public()) {
+				t.Error("signature of a tampered summary verifies")
+			}
+		})
+	}
+}
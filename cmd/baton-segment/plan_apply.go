@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+func newPlanCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plan <state.yaml>",
+		Short: "Show the changes bringing a workspace to a declarative desired state",
+		Long: "Compare the groups, group members and permissions of a desired state file to the live configuration of " +
+			"its workspace and list the changes apply would make. Groups and users that aren't in the file are left " +
+			"as they are.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			allowOwnerRemoval, _ := cmd.Flags().GetBool("allow-owner-removal")
+
+			state, err := connector.LoadDesiredState(args[0])
+			if err != nil {
+				return err
+			}
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			plan, err := s.Plan(ctx, state)
+			if err != nil {
+				return err
+			}
+
+			writePlan(os.Stdout, plan)
+			if err := s.CheckPlan(plan, connector.ApplyOptions{AllowOwnerRemoval: allowOwnerRemoval}); err != nil {
+				fmt.Fprintf(os.Stdout, "\nApply would be refused: %s\n", err)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("allow-owner-removal", false, "Check the plan as if the Workspace Owner role may be removed from users")
+
+	return cmd
+}
+
+func newApplyCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "apply <state.yaml>",
+		Short: "Bring a workspace to a declarative desired state",
+		Long: "Make the changes listed by plan. The plan is checked against the provisioning policy and the owner " +
+			"safeguards before any change is made, and with --dry-run the changes are logged without being made.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			yes, _ := cmd.Flags().GetBool("yes")
+			allowOwnerRemoval, _ := cmd.Flags().GetBool("allow-owner-removal")
+			opts := connector.ApplyOptions{AllowOwnerRemoval: allowOwnerRemoval}
+
+			state, err := connector.LoadDesiredState(args[0])
+			if err != nil {
+				return err
+			}
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			plan, err := s.Plan(ctx, state)
+			if err != nil {
+				return err
+			}
+
+			writePlan(os.Stdout, plan)
+			if len(plan.Changes) == 0 {
+				return nil
+			}
+			if err := s.CheckPlan(plan, opts); err != nil {
+				return err
+			}
+
+			if !yes && !cfg.DryRun {
+				ok, err := confirm(fmt.Sprintf("Apply %d changes to workspace %s?", len(plan.Changes), plan.WorkspaceName))
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fmt.Errorf("apply cancelled")
+				}
+			}
+
+			return s.Apply(ctx, plan, opts)
+		},
+	}
+
+	cmd.Flags().Bool("yes", false, "Apply the plan without asking for confirmation")
+	cmd.Flags().Bool("allow-owner-removal", false, "Allow the plan to remove the Workspace Owner role from users")
+
+	return cmd
+}
+
+// writePlan writes the changes of a plan, one principal per line followed by its added and removed permissions or
+// members.
+func writePlan(w io.Writer, plan *connector.Plan) {
+	fmt.Fprintf(w, "Workspace %s (%s)\n\n", plan.WorkspaceName, plan.WorkspaceID)
+	if len(plan.Changes) == 0 {
+		fmt.Fprintln(w, "No changes, the workspace matches the desired state.")
+		return
+	}
+
+	for _, change := range plan.Changes {
+		fmt.Fprintf(w, "%s %s %s\n", strings.ReplaceAll(change.Action, "_", " "), change.PrincipalType, change.Principal)
+		for _, added := range change.Added {
+			fmt.Fprintf(w, "  + %s\n", added)
+		}
+		for _, removed := range change.Removed {
+			fmt.Fprintf(w, "  - %s\n", removed)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d changes, %d Workspace Owners after apply.\n", len(plan.Changes), plan.OwnerCount)
+	if len(plan.OwnersRemoved) > 0 {
+		fmt.Fprintf(w, "Workspace Owner role removed from %s.\n", strings.Join(plan.OwnersRemoved, ", "))
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+)
+
+func newRemoveWriteKeysCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove-write-keys",
+		Short: "Remove the previous write keys of rotated sources whose grace period ended",
+		Long: "Remove the previous write keys recorded in the write key removal file once their grace period ended. " +
+			"Removals that fail stay in the file to be retried, so the command can be run from cron. With --dry-run " +
+			"nothing is removed and the removals stay pending.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			return s.RemoveDueWriteKeys(ctx)
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/conductorone/baton-segment/pkg/connector"
+	"github.com/spf13/cobra"
+)
+
+var sodViolationColumns = []string{
+	"rule",
+	"workspace",
+	"user_email",
+	"user_name",
+	"role",
+	"resource_type",
+	"resource_name",
+	"via_group",
+}
+
+func newSoDCheckCmd(ctx context.Context, cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sod-check",
+		Short: "Report users violating separation of duties rules",
+		Long: "Check the effective access of every user, held directly, through groups or on the whole workspace, " +
+			"against the separation of duties rules of --sod-rules.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			output, _ := cmd.Flags().GetString("output")
+			if format != "csv" && format != "json" {
+				return fmt.Errorf("unsupported format %s, use csv or json", format)
+			}
+
+			ctx, err := loadCommandConfig(ctx, cmd, cfg)
+			if err != nil {
+				return err
+			}
+
+			rules, err := cfg.sodRules()
+			if err != nil {
+				return err
+			}
+			if rules == nil {
+				return fmt.Errorf("sod-rules is required")
+			}
+
+			s, err := newSegment(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			violations, err := s.SoDViolations(ctx, rules)
+			if err != nil {
+				return err
+			}
+
+			w, err := openOutput(output)
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+
+			if format == "json" {
+				return writeSoDViolationsJSON(w, violations)
+			}
+			return writeSoDViolationsCSV(w, violations)
+		},
+	}
+
+	cmd.Flags().String("format", "csv", "The output format: csv or json")
+	cmd.Flags().StringP("output", "o", "", "The file to write to, stdout if not set")
+
+	return cmd
+}
+
+// writeSoDViolationsCSV writes a row for every access of a user matching a conflicting role of a rule.
+func writeSoDViolationsCSV(w io.Writer, violations []connector.SoDViolation) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(sodViolationColumns); err != nil {
+		return err
+	}
+	for _, violation := range violations {
+		for _, access := range violation.Access {
+			row := []string{
+				violation.Rule,
+				violation.WorkspaceName,
+				violation.UserEmail,
+				violation.UserName,
+				access.RoleName,
+				access.ResourceType,
+				access.ResourceName,
+				access.ViaGroupName,
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func writeSoDViolationsJSON(w io.Writer, violations []connector.SoDViolation) error {
+	if violations == nil {
+		violations = []connector.SoDViolation{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(violations)
+}
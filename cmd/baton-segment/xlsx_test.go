@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// xlsxSheet is the part of a worksheet holding the inline strings of its cells.
+type xlsxSheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R    string `xml:"r,attr"`
+			T    string `xml:"t,attr"`
+			Text string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+type xlsxWorkbookSheets struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+func readXLSXPart(t *testing.T, r *zip.Reader, name string, v interface{}) {
+	t.Helper()
+
+	f, err := r.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		t.Fatalf("%s isn't valid XML: %v", name, err)
+	}
+}
+
+func TestWriteXLSX(t *testing.T) {
+	rows := [][]string{
+		{"user", "role", "resource"},
+		{"jane@example.com", "Source Admin", `<Web & "Mobile">`},
+		{"  leading space", "line\nbreak", ""},
+	}
+
+	var buf bytes.Buffer
+	if err := writeXLSX(&buf, "Access & Roles", rows); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("output isn't a zip archive: %v", err)
+	}
+
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	wantNames := []string{
+		"[Content_Types].xml",
+		"_rels/.rels",
+		"xl/_rels/workbook.xml.rels",
+		"xl/workbook.xml",
+		"xl/worksheets/sheet1.xml",
+	}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("parts = %q, want %q", names, wantNames)
+	}
+
+	var workbook xlsxWorkbookSheets
+	readXLSXPart(t, r, "xl/workbook.xml", &workbook)
+	if len(workbook.Sheets) != 1 || workbook.Sheets[0].Name != "Access & Roles" {
+		t.Errorf("sheets = %+v, want the sheet named Access & Roles", workbook.Sheets)
+	}
+
+	var sheet xlsxSheet
+	readXLSXPart(t, r, "xl/worksheets/sheet1.xml", &sheet)
+	var got [][]string
+	for i, row := range sheet.Rows {
+		if row.R != i+1 {
+			t.Errorf("row %d is numbered %d", i+1, row.R)
+		}
+		var cells []string
+		for j, cell := range row.Cells {
+			if want := xlsxColumn(j) + string(rune('0'+row.R)); cell.R != want || cell.T != "inlineStr" {
+				t.Errorf("cell %s of type %s, want %s of type inlineStr", cell.R, cell.T, want)
+			}
+			cells = append(cells, cell.Text)
+		}
+		got = append(got, cells)
+	}
+	if !reflect.DeepEqual(got, rows) {
+		t.Errorf("cells = %q, want %q", got, rows)
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	tests := map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"}
+	for i, want := range tests {
+		if got := xlsxColumn(i); got != want {
+			t.Errorf("xlsxColumn(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package connector
+
+import (
+	"context"
+	"sort"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// Access is a role a workspace user holds on a resource, directly or through a group. Workspace-wide roles are
+// held on the workspace itself.
+type Access struct {
+	WorkspaceID   string `json:"workspace_id"`
+	WorkspaceName string `json:"workspace_name"`
+	UserID        string `json:"user_id"`
+	UserName      string `json:"user_name"`
+	UserEmail     string `json:"user_email"`
+	ResourceType  string `json:"resource_type"`
+	ResourceID    string `json:"resource_id"`
+	ResourceName  string `json:"resource_name"`
+	RoleID        string `json:"role_id"`
+	RoleName      string `json:"role_name"`
+	// ViaGroupID and ViaGroupName are empty for roles granted directly to the user.
+	ViaGroupID   string `json:"via_group_id,omitempty"`
+	ViaGroupName string `json:"via_group_name,omitempty"`
+}
+
+// AccessMatrix returns the effective access of every user in the configured workspaces, one entry per role held on
+// a resource through each of the paths it is granted by. Roles granted to a group are listed for every member.
+func (s *Segment) AccessMatrix(ctx context.Context) ([]Access, error) {
+	snapshots, err := s.snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []Access
+	for _, snapshot := range snapshots {
+		rv = append(rv, snapshot.accessMatrix()...)
+	}
+
+	return rv, nil
+}
+
+func (s *iamSnapshot) accessMatrix() []Access {
+	var rv []Access
+	for _, user := range s.users {
+		rv = append(rv, s.permissionAccess(user, user.Permissions, nil)...)
+
+		for _, group := range s.userGroups(user.ID) {
+			groupCopy := group
+			rv = append(rv, s.permissionAccess(user, group.Permissions, &groupCopy)...)
+		}
+	}
+
+	sort.SliceStable(rv, func(i, j int) bool {
+		if rv[i].UserEmail != rv[j].UserEmail {
+			return rv[i].UserEmail < rv[j].UserEmail
+		}
+		if rv[i].ResourceType != rv[j].ResourceType {
+			return rv[i].ResourceType < rv[j].ResourceType
+		}
+		return rv[i].ResourceName < rv[j].ResourceName
+	})
+
+	return rv
+}
+
+// permissionAccess returns the access the permissions give the user, through the group if it isn't nil.
+func (s *iamSnapshot) permissionAccess(user segment.User, permissions []segment.Permission, group *segment.Group) []Access {
+	var rv []Access
+	for _, permission := range permissions {
+		for _, resource := range permission.Resources {
+			resourceType := resource.Type
+			if resource.Type == workspaceType {
+				resourceType = workspaceResourceType.Id
+			} else if rt, ok := permissionResourceTypes[resource.Type]; ok {
+				resourceType = rt.Id
+			}
+
+			access := Access{
+				WorkspaceID:   s.workspace.ID,
+				WorkspaceName: s.workspace.Name,
+				UserID:        user.ID,
+				UserName:      user.Name,
+				UserEmail:     user.Email,
+				ResourceType:  resourceType,
+				ResourceID:    resource.ID,
+				ResourceName:  s.resourceName(resource),
+				RoleID:        permission.RoleID,
+				RoleName:      permission.RoleName,
+			}
+			if group != nil {
+				access.ViaGroupID = group.ID
+				access.ViaGroupName = group.Name
+			}
+			rv = append(rv, access)
+		}
+	}
+
+	return rv
+}
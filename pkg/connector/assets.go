@@ -0,0 +1,97 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-sdk/pkg/types"
+)
+
+// sourceIconAssetPrefix prefixes the asset ID of the icon of a source, followed by the source resource ID.
+const sourceIconAssetPrefix = "source-icon:"
+
+// assetChunkSize is the size of the data messages an asset is streamed in.
+const assetChunkSize = 1 << 20
+
+func sourceIconAssetID(sourceResourceID string) string {
+	return sourceIconAssetPrefix + sourceResourceID
+}
+
+// GetAsset returns the data and the content type of an asset referenced by a synced resource. Only the icons of
+// sources are assets: the logo of the source integration, looked up from the source rather than taken from the
+// asset ID, so only logos listed by Segment are downloaded.
+func (s *Segment) GetAsset(ctx context.Context, ref *v2.AssetRef) ([]byte, string, error) {
+	sourceResourceID, ok := strings.CutPrefix(ref.GetId(), sourceIconAssetPrefix)
+	if !ok {
+		return nil, "", fmt.Errorf("baton-segment: unknown asset %s", ref.GetId())
+	}
+
+	client, sourceID, err := s.clients.forResource(ctx, &v2.ResourceId{ResourceType: sourceResourceType.Id, Resource: sourceResourceID})
+	if err != nil {
+		return nil, "", err
+	}
+
+	source, err := client.GetSource(ctx, sourceID)
+	if err != nil {
+		return nil, "", fmt.Errorf("baton-segment: failed to get source %s: %w", sourceID, err)
+	}
+	if source.Metadata.Logos.Default == "" {
+		return nil, "", fmt.Errorf("baton-segment: source %s has no logo", sourceID)
+	}
+
+	data, contentType, err := client.GetLogo(ctx, source.Metadata.Logos.Default)
+	if err != nil {
+		return nil, "", fmt.Errorf("baton-segment: failed to get the logo of source %s: %w", sourceID, err)
+	}
+
+	return data, contentType, nil
+}
+
+// assetServer serves the assets of the connector. The connector builder of the SDK doesn't stream assets, so its
+// GetAsset is replaced by one streaming the assets returned by Segment.GetAsset.
+type assetServer struct {
+	types.ConnectorServer
+	segment *Segment
+}
+
+// WithAssetServer returns the connector server built for s, serving the assets of s.
+func WithAssetServer(server types.ConnectorServer, s *Segment) types.ConnectorServer {
+	return &assetServer{ConnectorServer: server, segment: s}
+}
+
+// GetAsset streams the content type of the asset, then its data in chunks.
+func (a *assetServer) GetAsset(request *v2.AssetServiceGetAssetRequest, server v2.AssetService_GetAssetServer) error {
+	data, contentType, err := a.segment.GetAsset(server.Context(), request.GetAsset())
+	if err != nil {
+		return err
+	}
+
+	err = server.Send(&v2.AssetServiceGetAssetResponse{
+		Msg: &v2.AssetServiceGetAssetResponse_Metadata_{
+			Metadata: &v2.AssetServiceGetAssetResponse_Metadata{ContentType: contentType},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > assetChunkSize {
+			n = assetChunkSize
+		}
+		err := server.Send(&v2.AssetServiceGetAssetResponse{
+			Msg: &v2.AssetServiceGetAssetResponse_Data_{
+				Data: &v2.AssetServiceGetAssetResponse_Data{Data: data[:n]},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
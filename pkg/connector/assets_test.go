@@ -0,0 +1,90 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"google.golang.org/grpc"
+)
+
+// fakeAssetStream records the messages an asset is streamed in.
+type fakeAssetStream struct {
+	grpc.ServerStream
+	responses []*v2.AssetServiceGetAssetResponse
+}
+
+func (f *fakeAssetStream) Context() context.Context {
+	return context.Background()
+}
+
+func (f *fakeAssetStream) Send(response *v2.AssetServiceGetAssetResponse) error {
+	f.responses = append(f.responses, response)
+	return nil
+}
+
+func TestSourceIcon(t *testing.T) {
+	logo := bytes.Repeat([]byte("<svg/>"), assetChunkSize/4)
+	web := segment.Source{ID: "s1", Name: "Web"}
+	web.Metadata.Logos.Default = "https://cdn.segment.test/logos/web.svg"
+
+	fake := newFakeSegment(t)
+	fake.handle(http.MethodGet, "/sources/s1", respondData(t, "source", web))
+	fake.handle(http.MethodGet, "/logos/web.svg", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("logo requested with the API token")
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write(logo)
+	})
+	clients := fake.clients()
+
+	parent := &v2.ResourceId{ResourceType: workspaceResourceType.Id, Resource: testWorkspaceID}
+	resource, err := sourceResource(&web, parent, "workspace", clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trait, err := rs.GetAppTrait(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trait.Icon == nil {
+		t.Fatal("source has no icon")
+	}
+
+	stream := &fakeAssetStream{}
+	server := WithAssetServer(nil, &Segment{clients: clients})
+	if err := server.GetAsset(&v2.AssetServiceGetAssetRequest{Asset: trait.Icon}, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stream.responses) < 3 {
+		t.Fatalf("asset streamed in %d messages, want its metadata and several chunks", len(stream.responses))
+	}
+	if contentType := stream.responses[0].GetMetadata().GetContentType(); contentType != "image/svg+xml" {
+		t.Errorf("content type = %q, want image/svg+xml", contentType)
+	}
+	var data []byte
+	for _, response := range stream.responses[1:] {
+		data = append(data, response.GetData().GetData()...)
+	}
+	if !bytes.Equal(data, logo) {
+		t.Errorf("streamed %d bytes, want the %d bytes of the logo", len(data), len(logo))
+	}
+}
+
+func TestGetAssetUnknown(t *testing.T) {
+	fake := newFakeSegment(t)
+	s := &Segment{clients: fake.clients()}
+
+	if _, _, err := s.GetAsset(context.Background(), &v2.AssetRef{Id: "https://cdn.segment.test/logos/web.svg"}); err == nil {
+		t.Error("GetAsset() of an unknown asset succeeded, want an error")
+	}
+	if len(fake.requested()) != 0 {
+		t.Errorf("requests = %q, want none", fake.requested())
+	}
+}
@@ -0,0 +1,300 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// GroupMember is a user, by email, to add to or remove from a group. Group is the ID of the group, its workspace
+// scoped ID as synced by the connector, or its name.
+type GroupMember struct {
+	Group string `json:"group"`
+	Email string `json:"email"`
+}
+
+// GroupMembersChange is the change a bulk operation makes to the members of a group.
+type GroupMembersChange struct {
+	WorkspaceID   string   `json:"workspace_id"`
+	WorkspaceName string   `json:"workspace_name"`
+	GroupID       string   `json:"group_id"`
+	GroupName     string   `json:"group_name"`
+	Added         []string `json:"added,omitempty"`
+	Removed       []string `json:"removed,omitempty"`
+}
+
+type groupMembersOperation string
+
+const (
+	addGroupMembersOperation     groupMembersOperation = "add_group_members"
+	removeGroupMembersOperation  groupMembersOperation = "remove_group_members"
+	replaceGroupMembersOperation groupMembersOperation = "replace_group_members"
+)
+
+// AddGroupMembers adds the users to their groups. Users that are already members are left as they are.
+func (s *Segment) AddGroupMembers(ctx context.Context, members []GroupMember) ([]GroupMembersChange, error) {
+	return s.changeGroupMembers(ctx, members, addGroupMembersOperation)
+}
+
+// RemoveGroupMembers removes the users from their groups. Users that aren't members are ignored.
+func (s *Segment) RemoveGroupMembers(ctx context.Context, members []GroupMember) ([]GroupMembersChange, error) {
+	return s.changeGroupMembers(ctx, members, removeGroupMembersOperation)
+}
+
+// ReplaceGroupMembers makes the users the only members of their groups. Groups that aren't listed are left as they
+// are.
+func (s *Segment) ReplaceGroupMembers(ctx context.Context, members []GroupMember) ([]GroupMembersChange, error) {
+	return s.changeGroupMembers(ctx, members, replaceGroupMembersOperation)
+}
+
+// bulkGroup is a group targeted by a bulk operation, with its current members and the changes to make.
+type bulkGroup struct {
+	workspace *segment.Workspace
+	client    *segment.Client
+	group     segment.Group
+	emails    []string
+	members   []segment.User
+	add       []string
+	remove    []segment.User
+}
+
+// changeGroupMembers checks every change of the operation against the provisioning policy before making any, then
+// adds the new members of each group before removing the old ones, so replaced groups are never left empty.
+func (s *Segment) changeGroupMembers(ctx context.Context, members []GroupMember, op groupMembersOperation) ([]GroupMembersChange, error) {
+	ctx = withProvisioningTask(ctx, &provisioningTask{Action: string(op)})
+
+	groups, err := s.bulkGroups(ctx, members)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups {
+		if err := g.plan(ctx, op); err != nil {
+			return nil, err
+		}
+		if err := s.checkBulkGroup(ctx, g); err != nil {
+			return nil, err
+		}
+	}
+
+	var rv []GroupMembersChange
+	for _, g := range groups {
+		if len(g.add) == 0 && len(g.remove) == 0 {
+			continue
+		}
+
+		change := GroupMembersChange{
+			WorkspaceID:   g.workspace.ID,
+			WorkspaceName: g.workspace.Name,
+			GroupID:       g.group.ID,
+			GroupName:     g.group.Name,
+		}
+
+		if len(g.add) > 0 {
+			if err := s.provisioner.addGroupMembers(ctx, g.client, g.group.ID, g.group.Name, nil, g.add); err != nil {
+				return rv, fmt.Errorf("baton-segment: failed to add members to group %s: %w", g.group.Name, err)
+			}
+			change.Added = g.add
+		}
+
+		if len(g.remove) > 0 {
+			emails := make([]string, 0, len(g.remove))
+			for _, member := range g.remove {
+				emails = append(emails, member.Email)
+			}
+			if err := s.provisioner.removeGroupMembers(ctx, g.client, g.group.ID, g.group.Name, nil, emails); err != nil {
+				rv = append(rv, change)
+				return rv, fmt.Errorf("baton-segment: failed to remove members from group %s: %w", g.group.Name, err)
+			}
+			change.Removed = emails
+		}
+
+		rv = append(rv, change)
+	}
+
+	return rv, nil
+}
+
+// bulkGroups resolves the groups of the members, in the order they are first listed, along with their emails.
+func (s *Segment) bulkGroups(ctx context.Context, members []GroupMember) ([]*bulkGroup, error) {
+	workspaces, err := s.clients.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []*bulkGroup
+	for _, workspace := range workspaces {
+		client, err := s.clients.get(ctx, workspace.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = paginate(ctx, client.ListGroups, func(group segment.Group) error {
+			all = append(all, &bulkGroup{workspace: workspace, client: client, group: group})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("baton-segment: failed to list groups of workspace %s: %w", workspace.Name, err)
+		}
+	}
+
+	var rv []*bulkGroup
+	listed := make(map[*bulkGroup]bool)
+	for _, member := range members {
+		email := strings.TrimSpace(member.Email)
+		if email == "" {
+			return nil, fmt.Errorf("baton-segment: missing email of member of group %s", member.Group)
+		}
+
+		g, err := findBulkGroup(all, strings.TrimSpace(member.Group))
+		if err != nil {
+			return nil, err
+		}
+		if !listed[g] {
+			listed[g] = true
+			rv = append(rv, g)
+		}
+
+		if !containsEmail(g.emails, email) {
+			g.emails = append(g.emails, email)
+		}
+	}
+
+	return rv, nil
+}
+
+// findBulkGroup returns the group with the given ID, workspace scoped ID or name.
+func findBulkGroup(groups []*bulkGroup, ref string) (*bulkGroup, error) {
+	var matches []*bulkGroup
+	for _, g := range groups {
+		if ref == g.group.ID || ref == workspaceScopedID(g.workspace.ID, g.group.ID) || strings.EqualFold(ref, g.group.Name) {
+			matches = append(matches, g)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("baton-segment: group %s not found", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("baton-segment: group %s matches %d groups, use the group ID instead", ref, len(matches))
+	}
+}
+
+// plan lists the members of the group and works out which users the operation adds and removes.
+func (g *bulkGroup) plan(ctx context.Context, op groupMembersOperation) error {
+	err := paginate(
+		ctx,
+		func(ctx context.Context, cursor string) ([]segment.User, string, error) {
+			return g.client.ListGroupMembers(ctx, g.group.ID, cursor)
+		},
+		func(member segment.User) error {
+			g.members = append(g.members, member)
+			return nil
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to list members of group %s: %w", g.group.Name, err)
+	}
+
+	if op == addGroupMembersOperation || op == replaceGroupMembersOperation {
+		for _, email := range g.emails {
+			if g.member(email) == nil {
+				g.add = append(g.add, email)
+			}
+		}
+	}
+
+	switch op {
+	case removeGroupMembersOperation:
+		for _, email := range g.emails {
+			if member := g.member(email); member != nil {
+				g.remove = append(g.remove, *member)
+			}
+		}
+	case replaceGroupMembersOperation:
+		for _, member := range g.members {
+			if !containsEmail(g.emails, member.Email) {
+				g.remove = append(g.remove, member)
+			}
+		}
+	}
+
+	return nil
+}
+
+// member returns the member of the group with the given email, or nil if there is none.
+func (g *bulkGroup) member(email string) *segment.User {
+	for i := range g.members {
+		if strings.EqualFold(g.members[i].Email, email) {
+			return &g.members[i]
+		}
+	}
+
+	return nil
+}
+
+// checkBulkGroup denies the changes to a group the provisioning policy doesn't allow, and membership changes of
+// users and groups managed by the identity provider.
+func (s *Segment) checkBulkGroup(ctx context.Context, g *bulkGroup) error {
+	if len(g.add) == 0 && len(g.remove) == 0 {
+		return nil
+	}
+
+	err := s.policy.checkIdentifiers(groupResourceType.Id, g.group.Name, g.group.ID, workspaceScopedID(g.workspace.ID, g.group.ID))
+	if err != nil {
+		return err
+	}
+
+	for _, email := range g.add {
+		if err := s.idp.checkMembership(g.group.ID, g.group.Name, email); err != nil {
+			return err
+		}
+		if err := s.policy.checkIdentifiers(userResourceType.Id, email, email); err != nil {
+			return err
+		}
+	}
+	if len(g.add) > 0 {
+		if err := s.policy.checkGroupRoles(ctx, g.client, g.group.ID); err != nil {
+			return err
+		}
+	}
+
+	memberIDs := make([]string, 0, len(g.remove))
+	for _, member := range g.remove {
+		if err := s.idp.checkMembership(g.group.ID, g.group.Name, member.Email); err != nil {
+			return err
+		}
+		err := s.policy.checkIdentifiers(
+			userResourceType.Id,
+			member.Email,
+			member.Email,
+			member.ID,
+			s.clients.scopedID(g.workspace.ID, member.ID),
+		)
+		if err != nil {
+			return err
+		}
+		memberIDs = append(memberIDs, member.ID)
+	}
+	if len(memberIDs) > 0 {
+		if err := s.policy.checkOwnerCount(ctx, g.client, g.workspace.ID, s.userCache, ownerChange{groupID: g.group.ID, memberIDs: memberIDs}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func containsEmail(emails []string, email string) bool {
+	for _, e := range emails {
+		if strings.EqualFold(e, email) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,275 @@
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serveBulkIAM serves a workspace where alice owns the workspace, bob is the only member of Analysts and carol
+// the only member of Engineering.
+func serveBulkIAM(fake *fakeSegment) {
+	alice := segment.User{ID: "u-alice", Email: "alice@example.com", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+	bob := segment.User{ID: "u-bob", Email: "bob@example.com"}
+	carol := segment.User{ID: "u-carol", Email: "carol@example.com"}
+	analysts := segment.Group{ID: "g-analysts", Name: "Analysts"}
+	engineering := segment.Group{ID: "g-engineering", Name: "Engineering"}
+
+	fake.serveIAM(
+		[]segment.User{alice, bob, carol},
+		[]segment.Group{analysts, engineering},
+		map[string][]segment.User{analysts.ID: {bob}, engineering.ID: {carol}},
+		[]segment.Role{testOwnerRole, testMemberRole},
+	)
+}
+
+// changeRequests returns the requests changing group members.
+func changeRequests(fake *fakeSegment) []string {
+	var rv []string
+	for _, request := range fake.requested() {
+		if !strings.HasPrefix(request, http.MethodGet) {
+			rv = append(rv, request)
+		}
+	}
+
+	return rv
+}
+
+func TestReplaceGroupMembers(t *testing.T) {
+	tests := []struct {
+		name         string
+		addStatus    int
+		wantRequests []string
+		wantErr      bool
+	}{
+		{
+			name: "members added before the others are removed",
+			wantRequests: []string{
+				"POST /groups/g-analysts/users",
+				"DELETE /groups/g-analysts/users?emails=%5B%22bob%40example.com%22%5D&pagination%5Bcount%5D=200",
+			},
+		},
+		{
+			name:         "failed addition leaves the members in place",
+			addStatus:    http.StatusInternalServerError,
+			wantRequests: []string{"POST /groups/g-analysts/users"},
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			serveBulkIAM(fake)
+			// the members of Analysts are updated by the requests made for them.
+			members := []segment.User{{ID: "u-bob", Email: "bob@example.com"}}
+			fake.handle(http.MethodGet, "/groups/g-analysts/users", func(w http.ResponseWriter, r *http.Request) {
+				respondData(t, "users", members)(w, r)
+			})
+			fake.handle(http.MethodPost, "/groups/g-analysts/users", func(w http.ResponseWriter, r *http.Request) {
+				if tt.addStatus != 0 {
+					w.WriteHeader(tt.addStatus)
+					return
+				}
+				var body segment.Payload
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("invalid members request: %v", err)
+				}
+				for _, email := range body.Emails {
+					members = append(members, segment.User{Email: email})
+				}
+				respondData(t, "userGroup", segment.Group{ID: "g-analysts"})(w, r)
+			})
+			fake.handle(http.MethodDelete, "/groups/g-analysts/users", func(w http.ResponseWriter, r *http.Request) {
+				var emails []string
+				if err := json.Unmarshal([]byte(r.URL.Query().Get("emails")), &emails); err != nil {
+					t.Errorf("invalid members request: %v", err)
+				}
+				var remaining []segment.User
+				for _, member := range members {
+					if !containsEmail(emails, member.Email) {
+						remaining = append(remaining, member)
+					}
+				}
+				members = remaining
+				respondData(t, "status", "SUCCESS")(w, r)
+			})
+			s := newElevationSegment(fake)
+
+			changes, err := s.ReplaceGroupMembers(context.Background(), []GroupMember{
+				{Group: "analysts", Email: "carol@example.com"},
+				{Group: "g-analysts", Email: " alice@example.com "},
+				{Group: "Analysts", Email: "carol@example.com"},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReplaceGroupMembers() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := changeRequests(fake); !reflect.DeepEqual(got, tt.wantRequests) {
+				t.Errorf("requests = %q, want %q", got, tt.wantRequests)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			want := []GroupMembersChange{{
+				WorkspaceID:   testWorkspaceID,
+				WorkspaceName: "Workspace",
+				GroupID:       "g-analysts",
+				GroupName:     "Analysts",
+				Added:         []string{"carol@example.com", "alice@example.com"},
+				Removed:       []string{"bob@example.com"},
+			}}
+			if !reflect.DeepEqual(changes, want) {
+				t.Errorf("changes = %+v, want %+v", changes, want)
+			}
+		})
+	}
+}
+
+func TestChangeGroupMembersPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *ProvisioningPolicy
+		idp      *IdPManagement
+		op       func(s *Segment) func(context.Context, []GroupMember) ([]GroupMembersChange, error)
+		wantCode codes.Code
+	}{
+		{
+			name:   "protected group",
+			policy: &ProvisioningPolicy{ProtectedPrincipals: []string{"g-engineering"}},
+			op: func(s *Segment) func(context.Context, []GroupMember) ([]GroupMembersChange, error) {
+				return s.AddGroupMembers
+			},
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:   "protected user",
+			policy: &ProvisioningPolicy{ProtectedPrincipals: []string{"alice@example.com"}},
+			op: func(s *Segment) func(context.Context, []GroupMember) ([]GroupMembersChange, error) {
+				return s.AddGroupMembers
+			},
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name: "group managed by the identity provider",
+			idp:  &IdPManagement{Groups: []string{"g-engineering"}},
+			op: func(s *Segment) func(context.Context, []GroupMember) ([]GroupMembersChange, error) {
+				return s.RemoveGroupMembers
+			},
+			wantCode: codes.FailedPrecondition,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			serveBulkIAM(fake)
+			s := newElevationSegment(fake)
+			if tt.policy != nil {
+				s.policy = tt.policy
+			}
+			if tt.idp != nil {
+				s.idp = tt.idp
+			}
+
+			// the change to Analysts is allowed, but nothing is made since the one to Engineering isn't.
+			changes, err := tt.op(s)(context.Background(), []GroupMember{
+				{Group: "Analysts", Email: "bob@example.com"},
+				{Group: "Analysts", Email: "alice@example.com"},
+				{Group: "Engineering", Email: "alice@example.com"},
+				{Group: "Engineering", Email: "carol@example.com"},
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("error = %v, want code %s", err, tt.wantCode)
+			}
+			if len(changes) != 0 {
+				t.Errorf("changes = %+v, want none", changes)
+			}
+			if got := changeRequests(fake); len(got) != 0 {
+				t.Errorf("requests = %q, want none", got)
+			}
+		})
+	}
+}
+
+func TestFindBulkGroup(t *testing.T) {
+	workspace := &segment.Workspace{ID: testWorkspaceID}
+	other := &segment.Workspace{ID: "ws2"}
+	groups := []*bulkGroup{
+		{workspace: workspace, group: segment.Group{ID: "g1", Name: "Analysts"}},
+		{workspace: other, group: segment.Group{ID: "g2", Name: "analysts"}},
+		{workspace: workspace, group: segment.Group{ID: "g3", Name: "Engineering"}},
+	}
+
+	tests := []struct {
+		ref     string
+		wantID  string
+		wantErr string
+	}{
+		{ref: "g2", wantID: "g2"},
+		{ref: "ws1/g1", wantID: "g1"},
+		{ref: "ENGINEERING", wantID: "g3"},
+		{ref: "Analysts", wantErr: "matches 2 groups"},
+		{ref: "Sales", wantErr: "not found"},
+		{ref: "ws2/g1", wantErr: "not found"},
+	}
+
+	for _, tt := range tests {
+		g, err := findBulkGroup(groups, tt.ref)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("findBulkGroup(%s) error = %v, want %q", tt.ref, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("findBulkGroup(%s) error = %v", tt.ref, err)
+			continue
+		}
+		if g.group.ID != tt.wantID {
+			t.Errorf("findBulkGroup(%s) = %s, want %s", tt.ref, g.group.ID, tt.wantID)
+		}
+	}
+}
+
+func TestBulkGroupPlan(t *testing.T) {
+	tests := []struct {
+		op         groupMembersOperation
+		wantAdd    []string
+		wantRemove []string
+	}{
+		{op: addGroupMembersOperation, wantAdd: []string{"carol@example.com"}},
+		{op: removeGroupMembersOperation, wantRemove: []string{"bob@example.com"}},
+		{op: replaceGroupMembersOperation, wantAdd: []string{"carol@example.com"}, wantRemove: []string{"alice@example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.op), func(t *testing.T) {
+			fake := newFakeSegment(t)
+			fake.handle(http.MethodGet, "/groups/g1/users", respondData(t, "users", []segment.User{
+				{ID: "u-alice", Email: "alice@example.com"},
+				{ID: "u-bob", Email: "Bob@Example.com"},
+			}))
+			g := &bulkGroup{client: fake.client(), group: segment.Group{ID: "g1"}, emails: []string{"bob@example.com", "carol@example.com"}}
+
+			if err := g.plan(context.Background(), tt.op); err != nil {
+				t.Fatal(err)
+			}
+
+			var removed []string
+			for _, member := range g.remove {
+				removed = append(removed, strings.ToLower(member.Email))
+			}
+			if !reflect.DeepEqual(g.add, tt.wantAdd) || !reflect.DeepEqual(removed, tt.wantRemove) {
+				t.Errorf("add = %q, remove = %q, want %q and %q", g.add, removed, tt.wantAdd, tt.wantRemove)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+)
+
+// syncProbes read a single page of the endpoint each resource type is synced from.
+var syncProbes = map[string]func(ctx context.Context, client *segment.Client) error{
+	userResourceType.Id: func(ctx context.Context, client *segment.Client) error {
+		_, _, err := client.ListUsers(ctx, "")
+		return err
+	},
+	workspaceResourceType.Id: func(ctx context.Context, client *segment.Client) error {
+		_, err := client.GetWorkspace(ctx)
+		return err
+	},
+	groupResourceType.Id: func(ctx context.Context, client *segment.Client) error {
+		_, _, err := client.ListGroups(ctx, "")
+		return err
+	},
+	roleResourceType.Id: func(ctx context.Context, client *segment.Client) error {
+		_, _, err := client.ListRoles(ctx, "")
+		return err
+	},
+	sourceResourceType.Id: func(ctx context.Context, client *segment.Client) error {
+		_, _, err := client.ListSources(ctx, "")
+		return err
+	},
+	warehouseResourceType.Id: func(ctx context.Context, client *segment.Client) error {
+		_, _, err := client.ListWarehouses(ctx, "")
+		return err
+	},
+	functionResourceType.Id: func(ctx context.Context, client *segment.Client) error {
+		_, _, err := client.ListFunctions(ctx, "", "SOURCE")
+		return err
+	},
+	spaceResourceType.Id: func(ctx context.Context, client *segment.Client) error {
+		_, _, err := client.ListSpaces(ctx, "")
+		return err
+	},
+}
+
+// provisionedResourceTypes are the resource types with grants that can be provisioned.
+var provisionedResourceTypes = map[string]bool{
+	groupResourceType.Id:     true,
+	roleResourceType.Id:      true,
+	sourceResourceType.Id:    true,
+	warehouseResourceType.Id: true,
+	functionResourceType.Id:  true,
+	spaceResourceType.Id:     true,
+}
+
+// probePermissionRead reads the permissions of a workspace user, which provisioning needs before updating them.
+func probePermissionRead(ctx context.Context, client *segment.Client) error {
+	users, _, err := client.ListUsers(ctx, "")
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	_, err = client.GetUser(ctx, users[0].ID)
+	return err
+}
+
+// probeCapabilities checks which of the synced resource types the configured tokens can read, and whether they can
+// read permissions for provisioning. It returns the capabilities supported by every workspace, and an error naming
+// the resource types that can't be synced.
+func (s *Segment) probeCapabilities(ctx context.Context) (*v2.ConnectorCapabilities, error) {
+	l := ctxzap.Extract(ctx)
+
+	workspaces, err := s.clients.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	canSync := make(map[string]bool)
+	for id := range s.syncTypes {
+		canSync[id] = true
+	}
+	canProvision := true
+
+	var missing []string
+	for _, workspace := range workspaces {
+		client, err := s.clients.get(ctx, workspace.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		var workspaceMissing []string
+		for _, rt := range allResourceTypes {
+			if !s.syncTypes.has(rt.Id) {
+				continue
+			}
+
+			if err := syncProbes[rt.Id](ctx, client); err != nil {
+				l.Warn(
+					"baton-segment: token can't sync resource type",
+					zap.String("workspace", workspace.Name),
+					zap.String("resource_type", rt.Id),
+					zap.Error(err),
+				)
+				canSync[rt.Id] = false
+				workspaceMissing = append(workspaceMissing, rt.Id)
+			}
+		}
+
+		if err := probePermissionRead(ctx, client); err != nil {
+			l.Warn(
+				"baton-segment: token can't read permissions, provisioning will fail",
+				zap.String("workspace", workspace.Name),
+				zap.Error(err),
+			)
+			canProvision = false
+		}
+
+		if len(workspaceMissing) > 0 {
+			missing = append(missing, fmt.Sprintf("%s (%s)", workspace.Name, strings.Join(workspaceMissing, ", ")))
+		}
+	}
+
+	capabilities := &v2.ConnectorCapabilities{}
+	for _, rt := range allResourceTypes {
+		if !s.syncTypes.has(rt.Id) || !canSync[rt.Id] {
+			continue
+		}
+
+		capability := &v2.ResourceTypeCapability{
+			ResourceType: rt,
+			Capabilities: []v2.ResourceTypeCapability_Capability{v2.ResourceTypeCapability_CAPABILITY_SYNC},
+		}
+		if canProvision && provisionedResourceTypes[rt.Id] {
+			capability.Capabilities = append(capability.Capabilities, v2.ResourceTypeCapability_CAPABILITY_PROVISION)
+		}
+		capabilities.ResourceTypeCapabilities = append(capabilities.ResourceTypeCapabilities, capability)
+	}
+	sort.Slice(capabilities.ResourceTypeCapabilities, func(i, j int) bool {
+		return capabilities.ResourceTypeCapabilities[i].ResourceType.Id < capabilities.ResourceTypeCapabilities[j].ResourceType.Id
+	})
+
+	l.Info(
+		"baton-segment: token capabilities",
+		zap.Int("workspace_count", len(workspaces)),
+		zap.Any("sync", canSync),
+		zap.Bool("provision", canProvision),
+	)
+
+	if len(missing) > 0 {
+		return capabilities, fmt.Errorf(
+			"baton-segment: the token is missing access to resource types in workspaces %s, "+
+				"use a Workspace Owner token or skip these resource types with --skip-resource-types",
+			strings.Join(missing, "; "),
+		)
+	}
+
+	return capabilities, nil
+}
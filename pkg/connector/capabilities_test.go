@@ -0,0 +1,93 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		// forbidden are the paths the token can't read.
+		forbidden      []string
+		wantSync       []string
+		wantProvision  []string
+		wantErrMissing string
+	}{
+		{
+			name:          "every resource type readable",
+			wantSync:      []string{"group", "source", "user", "warehouse", "workspace"},
+			wantProvision: []string{"group", "source", "warehouse"},
+		},
+		{
+			name:           "missing scopes",
+			forbidden:      []string{"/sources", "/warehouses"},
+			wantSync:       []string{"group", "user", "workspace"},
+			wantProvision:  []string{"group"},
+			wantErrMissing: "Workspace (source, warehouse)",
+		},
+		{
+			name:      "permissions unreadable",
+			forbidden: []string{"/users/u-alice"},
+			wantSync:  []string{"group", "source", "user", "warehouse", "workspace"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			fake.serveIAM(
+				[]segment.User{{ID: "u-alice", Email: "alice@example.com"}},
+				[]segment.Group{{ID: "g-admins", Name: "Admins"}},
+				nil,
+				[]segment.Role{testOwnerRole},
+			)
+			fake.handle(http.MethodGet, "/sources", respondData(t, "sources", []segment.Source{}))
+			fake.handle(http.MethodGet, "/warehouses", respondData(t, "warehouses", []segment.Warehouse{}))
+			for _, path := range tt.forbidden {
+				fake.handle(http.MethodGet, path, respondStatus(http.StatusForbidden))
+			}
+			s := newElevationSegment(fake)
+			syncTypes, err := newResourceTypeSet([]string{"user", "workspace", "group", "source", "warehouse"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.syncTypes = syncTypes
+
+			capabilities, err := s.probeCapabilities(context.Background())
+			if tt.wantErrMissing == "" && err != nil {
+				t.Fatalf("probeCapabilities() error = %v", err)
+			}
+			if tt.wantErrMissing != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErrMissing)) {
+				t.Fatalf("probeCapabilities() error = %v, want the missing resource types %s", err, tt.wantErrMissing)
+			}
+			if _, err := s.Validate(context.Background()); (err != nil) != (tt.wantErrMissing != "") {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErrMissing != "")
+			}
+
+			var gotSync, gotProvision []string
+			for _, capability := range capabilities.ResourceTypeCapabilities {
+				for _, c := range capability.Capabilities {
+					switch c {
+					case v2.ResourceTypeCapability_CAPABILITY_SYNC:
+						gotSync = append(gotSync, capability.ResourceType.Id)
+					case v2.ResourceTypeCapability_CAPABILITY_PROVISION:
+						gotProvision = append(gotProvision, capability.ResourceType.Id)
+					}
+				}
+			}
+			if !reflect.DeepEqual(gotSync, tt.wantSync) {
+				t.Errorf("synced = %q, want %q", gotSync, tt.wantSync)
+			}
+			if !reflect.DeepEqual(gotProvision, tt.wantProvision) {
+				t.Errorf("provisioned = %q, want %q", gotProvision, tt.wantProvision)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// workspaceIDSeparator separates the workspace ID from the Segment object ID in resource IDs,
+// so objects with the same ID in different workspaces don't collide.
+const workspaceIDSeparator = "/"
+
+// workspaceScopedID returns the resource ID of a Segment object in the given workspace.
+func workspaceScopedID(workspaceID, objectID string) string {
+	return workspaceID + workspaceIDSeparator + objectID
+}
+
+// splitWorkspaceScopedID returns the workspace ID and the Segment object ID of a resource ID.
+// The workspace ID is empty for IDs that are not scoped to a workspace.
+func splitWorkspaceScopedID(resourceID string) (string, string) {
+	workspaceID, objectID, ok := strings.Cut(resourceID, workspaceIDSeparator)
+	if !ok {
+		return "", resourceID
+	}
+
+	return workspaceID, objectID
+}
+
+// scopedID returns the resource ID of a Segment object in the given workspace. Objects are only scoped to their
+// workspace when several workspaces are configured, so the resource IDs of a single workspace stay the Segment IDs
+// they were before workspaces were part of resource IDs.
+func (w *workspaceClients) scopedID(workspaceID, objectID string) string {
+	if len(w.clients) == 1 {
+		return objectID
+	}
+
+	return workspaceScopedID(workspaceID, objectID)
+}
+
+// workspaceClients holds a Segment client for every configured workspace. Each token belongs to a single
+// workspace, which is looked up the first time the clients are used.
+type workspaceClients struct {
+	mu          sync.Mutex
+	clients     []*segment.Client
+	workspaces  []*segment.Workspace
+	byWorkspace map[string]*segment.Client
+}
+
+func newWorkspaceClients(clients []*segment.Client) *workspaceClients {
+	return &workspaceClients{
+		clients: clients,
+	}
+}
+
+func (w *workspaceClients) load(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.byWorkspace != nil {
+		return nil
+	}
+
+	byWorkspace := make(map[string]*segment.Client, len(w.clients))
+	var workspaces []*segment.Workspace
+	for _, client := range w.clients {
+		workspace, err := client.GetWorkspace(ctx)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := byWorkspace[workspace.ID]; ok {
+			return fmt.Errorf("baton-segment: more than one token configured for workspace %s", workspace.Name)
+		}
+
+		byWorkspace[workspace.ID] = client
+		workspaces = append(workspaces, workspace)
+	}
+
+	w.byWorkspace = byWorkspace
+	w.workspaces = workspaces
+
+	return nil
+}
+
+// list returns the workspaces of all configured tokens.
+func (w *workspaceClients) list(ctx context.Context) ([]*segment.Workspace, error) {
+	if err := w.load(ctx); err != nil {
+		return nil, err
+	}
+
+	return w.workspaces, nil
+}
+
+// workspace returns the workspace with the given ID.
+func (w *workspaceClients) workspace(ctx context.Context, workspaceID string) (*segment.Workspace, error) {
+	workspaces, err := w.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, workspace := range workspaces {
+		if workspace.ID == workspaceID {
+			return workspace, nil
+		}
+	}
+
+	return nil, fmt.Errorf("baton-segment: no token configured for workspace %s", workspaceID)
+}
+
+// get returns the client for the given workspace. Resources synced before workspaces were part of resource IDs
+// have no workspace ID, which is only supported with a single workspace.
+func (w *workspaceClients) get(ctx context.Context, workspaceID string) (*segment.Client, error) {
+	if err := w.load(ctx); err != nil {
+		return nil, err
+	}
+
+	if workspaceID == "" {
+		if len(w.clients) != 1 {
+			return nil, fmt.Errorf("baton-segment: resource is not scoped to a workspace")
+		}
+		return w.clients[0], nil
+	}
+
+	client, ok := w.byWorkspace[workspaceID]
+	if !ok {
+		return nil, fmt.Errorf("baton-segment: no token configured for workspace %s", workspaceID)
+	}
+
+	return client, nil
+}
+
+// workspaceOf returns the ID of the workspace of a resource ID. Resource IDs aren't scoped to a workspace when a
+// single workspace is configured, and belong to it.
+func (w *workspaceClients) workspaceOf(ctx context.Context, resourceID string) (string, error) {
+	workspaceID, _ := splitWorkspaceScopedID(resourceID)
+	if workspaceID != "" {
+		return workspaceID, nil
+	}
+
+	workspaces, err := w.list(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(workspaces) != 1 {
+		return "", fmt.Errorf("baton-segment: resource is not scoped to a workspace")
+	}
+
+	return workspaces[0].ID, nil
+}
+
+// forResource returns the client for the workspace of the resource ID, along with the Segment object ID.
+func (w *workspaceClients) forResource(ctx context.Context, resourceID *v2.ResourceId) (*segment.Client, string, error) {
+	workspaceID, objectID := splitWorkspaceScopedID(resourceID.Resource)
+	client, err := w.get(ctx, workspaceID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return client, objectID, nil
+}
+
+// resolvePrincipal returns the Segment ID of the principal in the given workspace. Users synced from another
+// workspace, or from another connector, are matched by email.
+func resolvePrincipal(ctx context.Context, client *segment.Client, workspaceID string, principal *v2.Resource) (string, error) {
+	principalWorkspaceID, principalID := splitWorkspaceScopedID(principal.Id.Resource)
+	if principalWorkspaceID == workspaceID {
+		return principalID, nil
+	}
+
+	if principal.Id.ResourceType != userResourceType.Id {
+		if principalWorkspaceID == "" {
+			return principalID, nil
+		}
+		return "", fmt.Errorf("baton-segment: %s %s belongs to a different workspace", principal.Id.ResourceType, principal.DisplayName)
+	}
+
+	emails := principalEmails(principal)
+	if len(emails) == 0 {
+		// unscoped IDs without emails are Segment user IDs synced before workspaces were part of resource IDs.
+		if principalWorkspaceID == "" {
+			return principalID, nil
+		}
+		return "", fmt.Errorf("baton-segment: user %s has no email to match in workspace %s", principal.DisplayName, workspaceID)
+	}
+
+	user, err := findUserByEmail(ctx, client, emails...)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return "", fmt.Errorf("baton-segment: user %s is not a member of workspace %s", principal.DisplayName, workspaceID)
+	}
+
+	return user.ID, nil
+}
+
+// principalEmails returns the emails of a user principal, the "login" of users synced by this connector first,
+// then the emails of the user trait with the primary email first.
+func principalEmails(principal *v2.Resource) []string {
+	userTrait, err := rs.GetUserTrait(principal)
+	if err != nil {
+		return nil
+	}
+
+	var emails []string
+	if login, ok := rs.GetProfileStringValue(userTrait.Profile, "login"); ok && login != "" {
+		emails = append(emails, login)
+	}
+	for _, email := range userTrait.Emails {
+		if email.IsPrimary && email.Address != "" {
+			emails = append(emails, email.Address)
+		}
+	}
+	for _, email := range userTrait.Emails {
+		if !email.IsPrimary && email.Address != "" {
+			emails = append(emails, email.Address)
+		}
+	}
+
+	return emails
+}
+
+// resolvePrincipalEmail returns the email group memberships of the user are changed with, in the given workspace.
+// Without an email on the principal, the Segment user is looked up by ID. Principals synced by other connectors
+// are matched by email.
+func resolvePrincipalEmail(ctx context.Context, client *segment.Client, workspaceID string, principal *v2.Resource) (string, error) {
+	if emails := principalEmails(principal); len(emails) > 0 {
+		return emails[0], nil
+	}
+
+	userID, err := resolvePrincipal(ctx, client, workspaceID, principal)
+	if err != nil {
+		return "", fmt.Errorf("baton-segment: no email found for user %s: %w", principal.DisplayName, err)
+	}
+
+	user, err := client.GetUser(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("baton-segment: no email found for user %s, failed to get user %s: %w", principal.DisplayName, userID, err)
+	}
+	if user.Email == "" {
+		return "", fmt.Errorf("baton-segment: no email found for user %s", principal.DisplayName)
+	}
+
+	return user.Email, nil
+}
+
+// findUserByEmail returns the first workspace user with one of the given emails, or nil if there is none.
+func findUserByEmail(ctx context.Context, client *segment.Client, emails ...string) (*segment.User, error) {
+	var cursor string
+	for {
+		users, nextCursor, err := client.ListUsers(ctx, cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, user := range users {
+			for _, email := range emails {
+				if strings.EqualFold(user.Email, email) {
+					userCopy := user
+					return &userCopy, nil
+				}
+			}
+		}
+
+		if nextCursor == "" {
+			return nil, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// forGrant returns the client for the workspace of the resource, along with the Segment IDs of the resource and
+// of the principal in that workspace.
+func (w *workspaceClients) forGrant(
+	ctx context.Context,
+	resourceID *v2.ResourceId,
+	principal *v2.Resource,
+) (*segment.Client, string, string, error) {
+	workspaceID, objectID := splitWorkspaceScopedID(resourceID.Resource)
+	client, err := w.get(ctx, workspaceID)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	principalID, err := resolvePrincipal(ctx, client, workspaceID, principal)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return client, objectID, principalID, nil
+}
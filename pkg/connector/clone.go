@@ -0,0 +1,310 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// cloneGroups selects group memberships in the resource types of CloneAccessOptions.
+const cloneGroups = "group"
+
+// CloneAccessOptions select the access of the reference user that is cloned.
+type CloneAccessOptions struct {
+	// Workspace is the ID, name or slug of the workspace, required when several workspaces are configured.
+	Workspace string
+	// ResourceTypes are the types of resources whose permissions are cloned: workspace, source, warehouse, function
+	// or space, and group for group memberships. Everything is cloned if empty.
+	ResourceTypes []string
+	// ExcludePrivileged leaves out the Workspace Owner role and the admin roles, along with the groups holding them.
+	ExcludePrivileged bool
+	// ExcludeRoles are the names or IDs of other roles left out, along with the groups holding them.
+	ExcludeRoles []string
+}
+
+// AccessClone is the access of a reference user a target user is given. Access is only added: the target keeps
+// the access they already have.
+type AccessClone struct {
+	WorkspaceID   string `json:"workspace_id"`
+	WorkspaceName string `json:"workspace_name"`
+	Reference     string `json:"reference"`
+	Target        string `json:"target"`
+	// AddedPermissions are the direct permissions the target is given, formatted as "role on TYPE resource".
+	AddedPermissions []string `json:"added_permissions,omitempty"`
+	// AddedGroups are the names of the groups the target is added to.
+	AddedGroups []string `json:"added_groups,omitempty"`
+	// Skipped are the access of the reference left out, with the reason.
+	Skipped []string `json:"skipped,omitempty"`
+
+	client *segment.Client
+	target *segment.User
+	added  []segment.Permission
+	groups []segment.Group
+}
+
+// isPrivilegedRole returns whether the role is the Workspace Owner role or an admin role.
+func isPrivilegedRole(roleName string) bool {
+	return roleName == workspaceOwnerRole || strings.HasSuffix(roleName, " Admin")
+}
+
+func (o CloneAccessOptions) includes(resourceType string) bool {
+	if len(o.ResourceTypes) == 0 {
+		return true
+	}
+
+	for _, t := range o.ResourceTypes {
+		if strings.EqualFold(t, resourceType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// excludes returns why the role is left out, or an empty string.
+func (o CloneAccessOptions) excludes(policy *ProvisioningPolicy, roleID, roleName string) string {
+	switch {
+	case policy.isProtectedRole(roleID, roleName):
+		return "protected role"
+	case o.ExcludePrivileged && isPrivilegedRole(roleName):
+		return "privileged role"
+	}
+
+	for _, role := range o.ExcludeRoles {
+		if role == roleID || strings.EqualFold(role, roleName) {
+			return "excluded role"
+		}
+	}
+
+	return ""
+}
+
+func (o CloneAccessOptions) validate() error {
+	for _, t := range o.ResourceTypes {
+		if strings.EqualFold(t, cloneGroups) || strings.EqualFold(t, workspaceType) {
+			continue
+		}
+		if _, ok := permissionResourceTypes[strings.ToUpper(t)]; !ok {
+			return fmt.Errorf("baton-segment: unsupported resource type %s, use workspace, source, warehouse, function, space or group", t)
+		}
+	}
+
+	return nil
+}
+
+// CloneAccess compares the direct permissions and group memberships of the reference user to those of the target
+// user, and returns the access the target would be given. Nothing is changed until the clone is applied.
+func (s *Segment) CloneAccess(ctx context.Context, referenceEmail, targetEmail string, opts CloneAccessOptions) (*AccessClone, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	workspace, client, err := s.desiredWorkspace(ctx, opts.Workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	reference, err := cloneUser(ctx, client, workspace, referenceEmail)
+	if err != nil {
+		return nil, err
+	}
+	target, err := cloneUser(ctx, client, workspace, targetEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	clone := &AccessClone{
+		WorkspaceID:   workspace.ID,
+		WorkspaceName: workspace.Name,
+		Reference:     reference.Email,
+		Target:        target.Email,
+		client:        client,
+		target:        target,
+	}
+
+	for _, permission := range reference.Permissions {
+		var resources []segment.Resource
+		reason := opts.excludes(s.policy, permission.RoleID, permission.RoleName)
+		for _, resource := range permission.Resources {
+			switch {
+			case !opts.includes(resource.Type):
+				continue
+			case reason != "":
+				clone.Skipped = append(clone.Skipped, fmt.Sprintf("%s on %s %s: %s", permission.RoleName, resource.Type, resource.ID, reason))
+			default:
+				resources = append(resources, resource)
+			}
+		}
+		if len(resources) > 0 {
+			clone.added = append(clone.added, segment.Permission{
+				RoleID:    permission.RoleID,
+				RoleName:  permission.RoleName,
+				Resources: resources,
+			})
+		}
+	}
+	clone.AddedPermissions, _ = diffPermissions(target.Permissions, addPermissions(target.Permissions, clone.added))
+
+	if opts.includes(cloneGroups) {
+		err := s.cloneGroups(ctx, clone, reference, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return clone, nil
+}
+
+// cloneGroups adds the groups of the reference the target isn't a member of to the clone.
+func (s *Segment) cloneGroups(ctx context.Context, clone *AccessClone, reference *segment.User, opts CloneAccessOptions) error {
+	return paginate(ctx, clone.client.ListGroups, func(group segment.Group) error {
+		members, err := remainingGroupMembers(ctx, clone.client, group.ID, []string{reference.Email, clone.target.Email})
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to list members of group %s: %w", group.Name, err)
+		}
+		if !containsEmail(members, reference.Email) || containsEmail(members, clone.target.Email) {
+			return nil
+		}
+
+		details, err := clone.client.GetGroup(ctx, group.ID)
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to get group %s: %w", group.ID, err)
+		}
+		for _, permission := range details.Permissions {
+			if reason := opts.excludes(s.policy, permission.RoleID, permission.RoleName); reason != "" {
+				clone.Skipped = append(clone.Skipped, fmt.Sprintf("group %s: holds %s %s", group.Name, reason, permission.RoleName))
+				return nil
+			}
+		}
+		if err := s.idp.checkMembership(group.ID, group.Name, clone.target.Email); err != nil {
+			clone.Skipped = append(clone.Skipped, fmt.Sprintf("group %s: managed by %s", group.Name, s.idp.providerName()))
+			return nil
+		}
+
+		clone.groups = append(clone.groups, *details)
+		clone.AddedGroups = append(clone.AddedGroups, group.Name)
+		sort.Strings(clone.AddedGroups)
+		return nil
+	})
+}
+
+// cloneUser returns the user with the given email, with their permissions.
+func cloneUser(ctx context.Context, client *segment.Client, workspace *segment.Workspace, email string) (*segment.User, error) {
+	user, err := findUserByEmail(ctx, client, email)
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to find user %s: %w", email, err)
+	}
+	if user == nil {
+		return nil, fmt.Errorf("baton-segment: user %s isn't a member of workspace %s", email, workspace.Name)
+	}
+
+	user, err = client.GetUser(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to get user %s: %w", email, err)
+	}
+
+	return user, nil
+}
+
+// holdsRole returns whether the permissions hold the role on the resource.
+func holdsRole(permissions []segment.Permission, roleID string, resource segment.Resource) bool {
+	for _, permission := range permissions {
+		if permission.RoleID != roleID {
+			continue
+		}
+		for _, r := range permission.Resources {
+			if r == resource {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// addPermissions returns the permissions with the roles of added held on the resources they aren't held on yet.
+func addPermissions(permissions, added []segment.Permission) []segment.Permission {
+	after := append([]segment.Permission{}, permissions...)
+	for _, permission := range added {
+		var resources []segment.Resource
+		for _, resource := range permission.Resources {
+			if !holdsRole(permissions, permission.RoleID, resource) {
+				resources = append(resources, resource)
+			}
+		}
+		if len(resources) > 0 {
+			after = append(after, segment.Permission{
+				RoleID:    permission.RoleID,
+				RoleName:  permission.RoleName,
+				Resources: resources,
+			})
+		}
+	}
+
+	return after
+}
+
+// ApplyAccessClone gives the target user the access of the clone, after checking it against the provisioning policy.
+// The permissions of the target are read again and the added ones merged into them, so changes made since the clone
+// was previewed are kept, and the clone is refused if the permissions it adds changed.
+func (s *Segment) ApplyAccessClone(ctx context.Context, clone *AccessClone) error {
+	ctx = withProvisioningTask(ctx, &provisioningTask{Action: "clone_access"})
+
+	principal := &v2.Resource{
+		Id: &v2.ResourceId{
+			ResourceType: userResourceType.Id,
+			Resource:     s.clients.scopedID(clone.WorkspaceID, clone.target.ID),
+		},
+		DisplayName: clone.target.Email,
+	}
+	err := s.policy.checkIdentifiers(
+		userResourceType.Id,
+		clone.target.Email,
+		principal.Id.Resource,
+		clone.target.ID,
+		clone.target.Email,
+	)
+	if err != nil {
+		return err
+	}
+	for _, permission := range clone.added {
+		if !grantsNewResources(clone.target.Permissions, permission) {
+			continue
+		}
+		if err := s.policy.checkRole(permission.RoleID, permission.RoleName); err != nil {
+			return err
+		}
+	}
+
+	if len(clone.AddedPermissions) > 0 {
+		target, err := clone.client.GetUser(ctx, clone.target.ID)
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to get user %s: %w", clone.target.Email, err)
+		}
+
+		after := addPermissions(target.Permissions, clone.added)
+		added, _ := diffPermissions(target.Permissions, after)
+		if !reflect.DeepEqual(added, clone.AddedPermissions) {
+			return fmt.Errorf("baton-segment: permissions of %s changed since the clone was previewed, clone their access again", clone.target.Email)
+		}
+
+		err = s.provisioner.updatePermissions(ctx, clone.client, principal, clone.target.ID, target.Permissions, after)
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to update permissions of %s: %w", clone.target.Email, err)
+		}
+	}
+
+	for _, group := range clone.groups {
+		err := s.provisioner.addGroupMembers(ctx, clone.client, group.ID, group.Name, principal, []string{clone.target.Email})
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to add %s to group %s: %w", clone.target.Email, group.Name, err)
+		}
+	}
+
+	return nil
+}
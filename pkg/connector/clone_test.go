@@ -0,0 +1,193 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+var (
+	testSourceAdminRole = segment.Role{ID: "r-source-admin", Name: "Source Admin"}
+	testSourceReadRole  = segment.Role{ID: "r-source-read", Name: "Source Read-only"}
+)
+
+func testSourcePermission(role segment.Role, sourceIDs ...string) segment.Permission {
+	permission := segment.Permission{RoleID: role.ID, RoleName: role.Name}
+	for _, id := range sourceIDs {
+		permission.Resources = append(permission.Resources, segment.Resource{ID: id, Type: sourceType})
+	}
+
+	return permission
+}
+
+// serveCloneIAM serves a workspace where jane holds direct permissions and is a member of the Admins and Analysts
+// groups, and the new hire already reads the first source.
+func serveCloneIAM(fake *fakeSegment) *fakeUserPermissions {
+	jane := segment.User{ID: "u-jane", Email: "jane@example.com", Permissions: []segment.Permission{
+		testWorkspacePermission(testMemberRole),
+		testSourcePermission(testSourceAdminRole, "s1"),
+		testSourcePermission(testSourceReadRole, "s1", "s2"),
+	}}
+	hire := segment.User{ID: "u-hire", Email: "hire@example.com", Permissions: []segment.Permission{
+		testSourcePermission(testSourceReadRole, "s1"),
+	}}
+	admins := segment.Group{ID: "g-admins", Name: "Admins", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+	analysts := segment.Group{ID: "g-analysts", Name: "Analysts", Permissions: []segment.Permission{testWorkspacePermission(testMemberRole)}}
+
+	fake.serveIAM(
+		[]segment.User{jane, hire},
+		[]segment.Group{admins, analysts},
+		map[string][]segment.User{admins.ID: {jane}, analysts.ID: {jane}},
+		[]segment.Role{testOwnerRole, testMemberRole, testSourceAdminRole, testSourceReadRole},
+	)
+
+	return serveUserPermissions(fake, hire)
+}
+
+func TestCloneAccess(t *testing.T) {
+	tests := []struct {
+		name             string
+		opts             CloneAccessOptions
+		protectedRoles   []string
+		wantPermissions  []string
+		wantGroups       []string
+		wantSkippedCount int
+		wantErr          bool
+	}{
+		{
+			name: "everything",
+			wantPermissions: []string{
+				"Source Admin on SOURCE s1",
+				"Source Read-only on SOURCE s2",
+				"Workspace Member on WORKSPACE ws1",
+			},
+			wantGroups: []string{"Admins", "Analysts"},
+		},
+		{
+			name:            "limited to sources",
+			opts:            CloneAccessOptions{ResourceTypes: []string{"source"}},
+			wantPermissions: []string{"Source Admin on SOURCE s1", "Source Read-only on SOURCE s2"},
+		},
+		{
+			name:             "privileged roles and the groups holding them excluded",
+			opts:             CloneAccessOptions{ExcludePrivileged: true},
+			wantPermissions:  []string{"Source Read-only on SOURCE s2", "Workspace Member on WORKSPACE ws1"},
+			wantGroups:       []string{"Analysts"},
+			wantSkippedCount: 2,
+		},
+		{
+			name:             "role excluded by name",
+			opts:             CloneAccessOptions{ResourceTypes: []string{"workspace", "group"}, ExcludeRoles: []string{"workspace member"}},
+			wantGroups:       []string{"Admins"},
+			wantSkippedCount: 2,
+		},
+		{
+			name:             "protected role excluded",
+			opts:             CloneAccessOptions{ResourceTypes: []string{"source"}},
+			protectedRoles:   []string{testSourceAdminRole.ID},
+			wantPermissions:  []string{"Source Read-only on SOURCE s2"},
+			wantSkippedCount: 1,
+		},
+		{
+			name:    "unsupported resource type",
+			opts:    CloneAccessOptions{ResourceTypes: []string{"destination"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			serveCloneIAM(fake)
+			s := newElevationSegment(fake)
+			s.policy = &ProvisioningPolicy{ProtectedRoles: tt.protectedRoles}
+
+			clone, err := s.CloneAccess(context.Background(), "jane@example.com", "hire@example.com", tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("CloneAccess() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(clone.AddedPermissions, tt.wantPermissions) {
+				t.Errorf("added permissions = %q, want %q", clone.AddedPermissions, tt.wantPermissions)
+			}
+			if !reflect.DeepEqual(clone.AddedGroups, tt.wantGroups) {
+				t.Errorf("added groups = %q, want %q", clone.AddedGroups, tt.wantGroups)
+			}
+			if len(clone.Skipped) != tt.wantSkippedCount {
+				t.Errorf("skipped = %q, want %d entries", clone.Skipped, tt.wantSkippedCount)
+			}
+		})
+	}
+}
+
+func TestApplyAccessClone(t *testing.T) {
+	fake := newFakeSegment(t)
+	hire := serveCloneIAM(fake)
+	var added []string
+	fake.handle(http.MethodPost, "/groups/g-analysts/users", func(w http.ResponseWriter, r *http.Request) {
+		added = append(added, "g-analysts")
+		respondData(t, "userGroup", segment.Group{ID: "g-analysts"})(w, r)
+	})
+	s := newElevationSegment(fake)
+
+	clone, err := s.CloneAccess(context.Background(), "jane@example.com", "hire@example.com", CloneAccessOptions{ExcludePrivileged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new hire is given another role after the preview, which the clone keeps.
+	hire.mu.Lock()
+	hire.permissions = append(hire.permissions, testSourcePermission(testSourceReadRole, "s3"))
+	hire.mu.Unlock()
+
+	if err := s.ApplyAccessClone(context.Background(), clone); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []segment.Permission{
+		testSourcePermission(testSourceReadRole, "s1"),
+		testSourcePermission(testSourceReadRole, "s3"),
+		testWorkspacePermission(testMemberRole),
+		testSourcePermission(testSourceReadRole, "s2"),
+	}
+	if !reflect.DeepEqual(hire.current(), want) {
+		t.Errorf("permissions = %+v, want %+v", hire.current(), want)
+	}
+	if !reflect.DeepEqual(added, []string{"g-analysts"}) {
+		t.Errorf("groups joined = %q, want only g-analysts", added)
+	}
+}
+
+func TestApplyAccessCloneChanged(t *testing.T) {
+	fake := newFakeSegment(t)
+	hire := serveCloneIAM(fake)
+	s := newElevationSegment(fake)
+
+	clone, err := s.CloneAccess(context.Background(), "jane@example.com", "hire@example.com", CloneAccessOptions{ResourceTypes: []string{"source"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new hire is given one of the cloned roles after the preview, so the clone no longer adds it.
+	hire.mu.Lock()
+	hire.permissions = append(hire.permissions, testSourcePermission(testSourceReadRole, "s2"))
+	hire.mu.Unlock()
+
+	err = s.ApplyAccessClone(context.Background(), clone)
+	if err == nil || !strings.Contains(err.Error(), "changed since the clone was previewed") {
+		t.Fatalf("ApplyAccessClone() error = %v, want the clone refused", err)
+	}
+	if len(hire.puts) != 0 {
+		t.Errorf("got %d permission updates, want none", len(hire.puts))
+	}
+}
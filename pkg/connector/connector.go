@@ -3,6 +3,7 @@ package connector
 import (
 	"context"
 	"fmt"
+	"time"
 
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 	"github.com/conductorone/baton-sdk/pkg/annotations"
@@ -13,21 +14,135 @@ import (
 )
 
 type Segment struct {
-	client *segment.Client
+	clients             *workspaceClients
+	removeOldWriteKeys  bool
+	writeKeyGracePeriod time.Duration
+	writeKeyRemovalPath string
+	writeKeyRemovals    *writeKeyRemovals
+	syncResourceTypes   []string
+	skipResourceTypes   []string
+	syncTypes           resourceTypeSet
+	oauthConfigs        []segment.OAuthConfig
+	policy              *ProvisioningPolicy
+	dryRun              bool
+	journalPath         string
+	provisioner         *provisioner
+	prefetchConcurrency int
+	prefetchRate        float64
+	userCache           *userCache
+	idp                 *IdPManagement
+	sod                 *sodSync
+	orphans             *orphanSync
+}
+
+// Option configures optional connector behaviour.
+type Option func(*Segment)
+
+// WithWriteKeyRotation sets whether the previous write keys of a source are removed after rotation,
+// and how long they stay valid before being removed.
+func WithWriteKeyRotation(removeOld bool, gracePeriod time.Duration) Option {
+	return func(s *Segment) {
+		s.removeOldWriteKeys = removeOld
+		s.writeKeyGracePeriod = gracePeriod
+	}
+}
+
+// WithWriteKeyRemovalFile records the previous write keys of rotated sources in the file at path until their grace
+// period ends, so they're removed by a later run.
+func WithWriteKeyRemovalFile(path string) Option {
+	return func(s *Segment) {
+		s.writeKeyRemovalPath = path
+	}
+}
+
+// WithResourceTypes limits the synced resource types to syncTypes, if any are given, minus skipTypes.
+func WithResourceTypes(syncTypes, skipTypes []string) Option {
+	return func(s *Segment) {
+		s.syncResourceTypes = syncTypes
+		s.skipResourceTypes = skipTypes
+	}
+}
+
+// WithOAuthCredentials syncs the workspace of a Segment OAuth app, authenticating with short-lived access tokens
+// instead of a static token.
+func WithOAuthCredentials(config segment.OAuthConfig) Option {
+	return func(s *Segment) {
+		s.oauthConfigs = append(s.oauthConfigs, config)
+	}
+}
+
+// WithProvisioningPolicy guards provisioning with the given policy.
+func WithProvisioningPolicy(policy ProvisioningPolicy) Option {
+	return func(s *Segment) {
+		s.policy = &policy
+	}
+}
+
+// WithDryRun logs the changes Grant and Revoke would make instead of making them.
+func WithDryRun(dryRun bool) Option {
+	return func(s *Segment) {
+		s.dryRun = dryRun
+	}
+}
+
+// WithAuditJournal records every change made in Segment in a hash-chained JSONL file at path.
+func WithAuditJournal(path string) Option {
+	return func(s *Segment) {
+		s.journalPath = path
+	}
+}
+
+// WithIdPManagement marks the users and groups managed by an identity provider through SCIM, and refuses to change
+// their group memberships unless allowed.
+func WithIdPManagement(idp IdPManagement) Option {
+	return func(s *Segment) {
+		s.idp = &idp
+	}
+}
+
+// WithSoDRules annotates the users violating separation of duties rules during sync.
+func WithSoDRules(rules *SoDRules) Option {
+	return func(s *Segment) {
+		s.sod = newSoDSync(rules)
+	}
+}
+
+// WithUserPrefetch sets how many users are fetched at the same time during sync, and the maximum number of
+// requests per second made to fetch them, unlimited when zero.
+func WithUserPrefetch(concurrency int, requestsPerSecond float64) Option {
+	return func(s *Segment) {
+		s.prefetchConcurrency = concurrency
+		s.prefetchRate = requestsPerSecond
+	}
 }
 
 // ResourceSyncers returns a ResourceSyncer for each resource type that should be synced from the upstream service.
 func (s *Segment) ResourceSyncers(ctx context.Context) []connectorbuilder.ResourceSyncer {
-	return []connectorbuilder.ResourceSyncer{
-		newUserBuilder(s.client),
-		newWorkspaceBuilder(s.client),
-		newGroupBuilder(s.client),
-		newRoleBuilder(s.client),
-		newSourceBuilder(s.client),
-		newWarehouseBuilder(s.client),
-		newFunctionBuilder(s.client),
-		newSpaceBuilder(s.client),
+	builders := []connectorbuilder.ResourceSyncer{
+		newUserBuilder(s.clients, s.syncTypes, s.userCache, s.idp, s.sod, s.orphans),
+		newWorkspaceBuilder(s.clients, s.syncTypes, s.userCache, s.idp),
+	}
+
+	if s.syncTypes.has(groupResourceType.Id) {
+		builders = append(builders, newGroupBuilder(s.clients, s.syncTypes, s.policy, s.provisioner, s.idp, s.orphans, s.userCache))
+	}
+	if s.syncTypes.has(roleResourceType.Id) {
+		builders = append(builders, newRoleBuilder(s.clients, s.policy, s.provisioner, s.userCache))
+	}
+	if s.syncTypes.has(sourceResourceType.Id) {
+		builders = append(builders, newSourceBuilder(s.clients, s.policy, s.provisioner, s.removeOldWriteKeys, s.writeKeyGracePeriod, s.writeKeyRemovals))
 	}
+	if s.syncTypes.has(warehouseResourceType.Id) {
+		builders = append(builders, newWarehouseBuilder(s.clients, s.policy, s.provisioner))
+	}
+	if s.syncTypes.has(functionResourceType.Id) {
+		builders = append(builders, newFunctionBuilder(s.clients, s.policy, s.provisioner, s.userCache))
+	}
+	if s.syncTypes.has(spaceResourceType.Id) {
+		builders = append(builders, newSpaceBuilder(s.clients, s.policy, s.provisioner))
+	}
+
+	return builders
 }
 
 // Metadata returns metadata about the connector.
@@ -40,24 +155,66 @@ func (s *Segment) Metadata(ctx context.Context) (*v2.ConnectorMetadata, error) {
 
 // Validate is called to ensure that the connector is properly configured. It should exercise any API credentials
 // to be sure that they are valid.
+// Every endpoint the synced resource types need is probed, and the capabilities of the tokens are returned as an annotation.
 func (s *Segment) Validate(ctx context.Context) (annotations.Annotations, error) {
-	_, err := s.client.GetWorkspace(ctx)
+	capabilities, err := s.probeCapabilities(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error validating Segment connector: %w", err)
 	}
-	return nil, nil
+
+	return annotations.New(capabilities), nil
+}
+
+// LogDryRunSummary logs the summary of every change skipped in dry run mode. It is called once the connector or
+// a subcommand is done provisioning.
+func (s *Segment) LogDryRunSummary(ctx context.Context) {
+	s.provisioner.logSummary(ctx)
 }
 
 // New returns a new instance of the connector.
-func New(ctx context.Context, token string) (*Segment, error) {
+// Every token, and every OAuth app, is used to sync the workspace it belongs to.
+func New(ctx context.Context, tokens []string, opts ...Option) (*Segment, error) {
 	httpClient, err := uhttp.NewClient(ctx, uhttp.WithLogger(true, ctxzap.Extract(ctx)))
 	if err != nil {
 		return nil, err
 	}
 
-	client := segment.NewClient(httpClient, token)
+	s := &Segment{
+		policy: &ProvisioningPolicy{},
+		idp:    &IdPManagement{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
 
-	return &Segment{
-		client: client,
-	}, nil
+	clients := make([]*segment.Client, 0, len(tokens)+len(s.oauthConfigs))
+	for _, token := range tokens {
+		clients = append(clients, segment.NewClient(httpClient, token))
+	}
+	for _, oauthConfig := range s.oauthConfigs {
+		clients = append(clients, segment.NewOAuthClient(httpClient, oauthConfig))
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("baton-segment: at least one token or OAuth app is required")
+	}
+	s.clients = newWorkspaceClients(clients)
+
+	s.syncTypes, err = newResourceTypeSet(s.syncResourceTypes, s.skipResourceTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	var j *journal
+	if s.journalPath != "" {
+		j, err = newJournal(s.journalPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.provisioner = newProvisioner(s.dryRun, j)
+	s.writeKeyRemovals = newWriteKeyRemovals(s.writeKeyRemovalPath, s.clients, s.provisioner)
+	s.userCache = newUserCache(s.prefetchConcurrency, s.prefetchRate)
+	s.orphans = newOrphanSync(s.clients, s.syncTypes)
+
+	return s, nil
 }
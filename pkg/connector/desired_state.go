@@ -0,0 +1,609 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// DesiredState is the IAM configuration a workspace should have. Only the groups and users it lists are managed:
+// the members and permissions of a listed group, and the permissions of a listed user, are exactly the ones given.
+// Groups and users that aren't listed are left as they are.
+type DesiredState struct {
+	// Workspace is the ID, name or slug of the workspace, required when several workspaces are configured.
+	Workspace string         `yaml:"workspace"`
+	Groups    []DesiredGroup `yaml:"groups"`
+	Users     []DesiredUser  `yaml:"users"`
+}
+
+// DesiredGroup is a group with its members, by email, and its permissions. Missing groups are created.
+type DesiredGroup struct {
+	Name        string              `yaml:"name"`
+	Members     []string            `yaml:"members"`
+	Permissions []DesiredPermission `yaml:"permissions"`
+}
+
+// DesiredUser is an existing workspace user, by email, with their permissions.
+type DesiredUser struct {
+	Email       string              `yaml:"email"`
+	Permissions []DesiredPermission `yaml:"permissions"`
+}
+
+// DesiredPermission is a role, by name or ID, held on resources. A role without resources is held on the
+// workspace.
+type DesiredPermission struct {
+	Role      string            `yaml:"role"`
+	Resources []DesiredResource `yaml:"resources"`
+}
+
+// DesiredResource selects resources of a type, source, warehouse, function, space or workspace, by ID or name, or
+// sources by a key:value label.
+type DesiredResource struct {
+	Type  string `yaml:"type"`
+	ID    string `yaml:"id"`
+	Label string `yaml:"label"`
+}
+
+// LoadDesiredState reads a desired state from a YAML file.
+func LoadDesiredState(path string) (*DesiredState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to read desired state: %w", err)
+	}
+
+	var state DesiredState
+	if err := yaml.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to parse desired state: %w", err)
+	}
+
+	groups := make(map[string]bool)
+	for _, group := range state.Groups {
+		if group.Name == "" {
+			return nil, fmt.Errorf("baton-segment: desired state has a group without a name")
+		}
+		if groups[strings.ToLower(group.Name)] {
+			return nil, fmt.Errorf("baton-segment: group %s is listed twice in the desired state", group.Name)
+		}
+		groups[strings.ToLower(group.Name)] = true
+	}
+
+	users := make(map[string]bool)
+	for _, user := range state.Users {
+		if user.Email == "" {
+			return nil, fmt.Errorf("baton-segment: desired state has a user without an email")
+		}
+		if users[strings.ToLower(user.Email)] {
+			return nil, fmt.Errorf("baton-segment: user %s is listed twice in the desired state", user.Email)
+		}
+		users[strings.ToLower(user.Email)] = true
+	}
+
+	return &state, nil
+}
+
+// Plan changes made in order.
+const (
+	PlanCreateGroup       = "create_group"
+	PlanUpdatePermissions = "update_permissions"
+	PlanAddMembers        = "add_members"
+	PlanRemoveMembers     = "remove_members"
+)
+
+// PlanChange is a change of a plan. Added and Removed are the members of a group, or the permissions of a user or
+// group formatted as "role on TYPE resource".
+type PlanChange struct {
+	Action        string   `json:"action"`
+	PrincipalType string   `json:"principal_type"`
+	Principal     string   `json:"principal"`
+	Added         []string `json:"added,omitempty"`
+	Removed       []string `json:"removed,omitempty"`
+
+	principalID string
+	before      []segment.Permission
+	after       []segment.Permission
+}
+
+// Plan is the list of changes bringing a workspace to its desired state, in the order they are applied: groups
+// are created and given their permissions before members are added, and members are removed last.
+type Plan struct {
+	WorkspaceID   string       `json:"workspace_id"`
+	WorkspaceName string       `json:"workspace_name"`
+	Changes       []PlanChange `json:"changes"`
+	// OwnersRemoved are the emails of the Workspace Owners that lose the role.
+	OwnersRemoved []string `json:"owners_removed,omitempty"`
+	// OwnerCount is the number of Workspace Owners once the plan is applied.
+	OwnerCount int `json:"owner_count"`
+
+	client *segment.Client
+	// finalGroupPermissions are the permissions of the desired groups once the plan is applied, keyed by name.
+	finalGroupPermissions map[string][]segment.Permission
+}
+
+// ApplyOptions are the safeguards of Apply.
+type ApplyOptions struct {
+	// AllowOwnerRemoval allows plans that remove the Workspace Owner role from users.
+	AllowOwnerRemoval bool
+}
+
+// planStage is the position of the changes of an action in a plan.
+func planStage(change PlanChange) int {
+	switch {
+	case change.Action == PlanCreateGroup:
+		return 0
+	case change.Action == PlanUpdatePermissions && change.PrincipalType == groupResourceType.Id:
+		return 1
+	case change.Action == PlanAddMembers:
+		return 2
+	case change.Action == PlanUpdatePermissions:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Plan compares the desired state to the live configuration of its workspace.
+func (s *Segment) Plan(ctx context.Context, state *DesiredState) (*Plan, error) {
+	workspace, client, err := s.desiredWorkspace(ctx, state.Workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := loadIAMSnapshot(ctx, client, workspace, s.syncTypes, client.GetUser)
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to read workspace %s: %w", workspace.Name, err)
+	}
+
+	var roles []segment.Role
+	err = paginate(ctx, client.ListRoles, func(role segment.Role) error {
+		roles = append(roles, role)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to list roles: %w", err)
+	}
+
+	plan := &Plan{
+		WorkspaceID:           workspace.ID,
+		WorkspaceName:         workspace.Name,
+		client:                client,
+		finalGroupPermissions: make(map[string][]segment.Permission),
+	}
+
+	userEmails := make(map[string]bool, len(snapshot.users))
+	for _, user := range snapshot.users {
+		userEmails[strings.ToLower(user.Email)] = true
+	}
+
+	finalGroupPermissions := make(map[string][]segment.Permission)
+	finalMembers := make(map[string][]string)
+	for _, group := range snapshot.groups {
+		finalGroupPermissions[group.ID] = group.Permissions
+		for _, member := range snapshot.members[group.ID] {
+			finalMembers[group.ID] = append(finalMembers[group.ID], member.Email)
+		}
+	}
+
+	for _, desired := range state.Groups {
+		after, err := resolveDesiredPermissions(snapshot, roles, desired.Permissions)
+		if err != nil {
+			return nil, fmt.Errorf("baton-segment: group %s: %w", desired.Name, err)
+		}
+
+		// members must be users of the workspace, so that the owners the plan leaves are users who can sign in.
+		for _, email := range desired.Members {
+			if !userEmails[strings.ToLower(email)] {
+				return nil, fmt.Errorf("baton-segment: group %s: member %s isn't a user of workspace %s", desired.Name, email, workspace.Name)
+			}
+		}
+
+		var current *segment.Group
+		for i := range snapshot.groups {
+			if strings.EqualFold(snapshot.groups[i].Name, desired.Name) {
+				current = &snapshot.groups[i]
+				break
+			}
+		}
+
+		var before []segment.Permission
+		var members []string
+		key := "new:" + strings.ToLower(desired.Name)
+		change := PlanChange{PrincipalType: groupResourceType.Id, Principal: desired.Name}
+		if current == nil {
+			create := change
+			create.Action = PlanCreateGroup
+			plan.Changes = append(plan.Changes, create)
+		} else {
+			key = current.ID
+			change.Principal = current.Name
+			change.principalID = current.ID
+			before = current.Permissions
+			members = finalMembers[current.ID]
+		}
+
+		if added, removed := diffPermissions(before, after); len(added) > 0 || len(removed) > 0 {
+			update := change
+			update.Action = PlanUpdatePermissions
+			update.Added, update.Removed = added, removed
+			update.before, update.after = before, after
+			plan.Changes = append(plan.Changes, update)
+		}
+		finalGroupPermissions[key] = after
+		plan.finalGroupPermissions[change.Principal] = after
+
+		var added, removed []string
+		for _, email := range desired.Members {
+			if !containsEmail(members, email) && !containsEmail(added, email) {
+				added = append(added, email)
+			}
+		}
+		for _, email := range members {
+			if !containsEmail(desired.Members, email) {
+				removed = append(removed, email)
+			}
+		}
+		if len(added) > 0 {
+			add := change
+			add.Action = PlanAddMembers
+			add.Added = added
+			plan.Changes = append(plan.Changes, add)
+		}
+		if len(removed) > 0 {
+			remove := change
+			remove.Action = PlanRemoveMembers
+			remove.Removed = removed
+			plan.Changes = append(plan.Changes, remove)
+		}
+		finalMembers[key] = desired.Members
+	}
+
+	finalUserPermissions := make(map[string][]segment.Permission)
+	for _, user := range snapshot.users {
+		finalUserPermissions[strings.ToLower(user.Email)] = user.Permissions
+	}
+
+	for _, desired := range state.Users {
+		var current *segment.User
+		for i := range snapshot.users {
+			if strings.EqualFold(snapshot.users[i].Email, desired.Email) {
+				current = &snapshot.users[i]
+				break
+			}
+		}
+		if current == nil {
+			return nil, fmt.Errorf("baton-segment: user %s isn't a member of workspace %s", desired.Email, workspace.Name)
+		}
+
+		after, err := resolveDesiredPermissions(snapshot, roles, desired.Permissions)
+		if err != nil {
+			return nil, fmt.Errorf("baton-segment: user %s: %w", desired.Email, err)
+		}
+
+		if added, removed := diffPermissions(current.Permissions, after); len(added) > 0 || len(removed) > 0 {
+			plan.Changes = append(plan.Changes, PlanChange{
+				Action:        PlanUpdatePermissions,
+				PrincipalType: userResourceType.Id,
+				Principal:     current.Email,
+				Added:         added,
+				Removed:       removed,
+				principalID:   current.ID,
+				before:        current.Permissions,
+				after:         after,
+			})
+		}
+		finalUserPermissions[strings.ToLower(current.Email)] = after
+	}
+
+	sort.SliceStable(plan.Changes, func(i, j int) bool {
+		return planStage(plan.Changes[i]) < planStage(plan.Changes[j])
+	})
+
+	ownerRole := ownerRoleID(roles)
+	currentOwners := snapshotOwners(snapshot, ownerRole)
+	finalOwners := make(map[string]bool)
+	for email, permissions := range finalUserPermissions {
+		if hasRole(permissions, ownerRole) {
+			finalOwners[email] = true
+		}
+	}
+	for key, permissions := range finalGroupPermissions {
+		if hasRole(permissions, ownerRole) {
+			for _, email := range finalMembers[key] {
+				finalOwners[strings.ToLower(email)] = true
+			}
+		}
+	}
+	for email := range currentOwners {
+		if !finalOwners[email] {
+			plan.OwnersRemoved = append(plan.OwnersRemoved, email)
+		}
+	}
+	sort.Strings(plan.OwnersRemoved)
+	plan.OwnerCount = len(finalOwners)
+
+	return plan, nil
+}
+
+// desiredWorkspace returns the workspace of a desired state and its client.
+func (s *Segment) desiredWorkspace(ctx context.Context, ref string) (*segment.Workspace, *segment.Client, error) {
+	workspaces, err := s.clients.list(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var workspace *segment.Workspace
+	switch {
+	case ref != "":
+		for _, w := range workspaces {
+			if w.ID == ref || strings.EqualFold(w.Name, ref) || strings.EqualFold(w.Slug, ref) {
+				workspace = w
+			}
+		}
+		if workspace == nil {
+			return nil, nil, fmt.Errorf("baton-segment: workspace %s isn't configured", ref)
+		}
+	case len(workspaces) == 1:
+		workspace = workspaces[0]
+	default:
+		return nil, nil, fmt.Errorf("baton-segment: several workspaces are configured, set the workspace of the desired state")
+	}
+
+	client, err := s.clients.get(ctx, workspace.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return workspace, client, nil
+}
+
+// resolveDesiredPermissions returns the Segment permissions of desired permissions, one per role.
+func resolveDesiredPermissions(snapshot *iamSnapshot, roles []segment.Role, desired []DesiredPermission) ([]segment.Permission, error) {
+	var rv []segment.Permission
+	for _, permission := range desired {
+		var role *segment.Role
+		for i := range roles {
+			if roles[i].ID == permission.Role || strings.EqualFold(roles[i].Name, permission.Role) {
+				role = &roles[i]
+				break
+			}
+		}
+		if role == nil {
+			return nil, fmt.Errorf("role %s not found", permission.Role)
+		}
+
+		var resources []segment.Resource
+		if len(permission.Resources) == 0 {
+			resources = append(resources, segment.Resource{ID: snapshot.workspace.ID, Type: workspaceType})
+		}
+		for _, desiredResource := range permission.Resources {
+			matched, err := resolveDesiredResource(snapshot, desiredResource)
+			if err != nil {
+				return nil, err
+			}
+			resources = append(resources, matched...)
+		}
+
+		merged := false
+		for i := range rv {
+			if rv[i].RoleID == role.ID {
+				rv[i].Resources = append(rv[i].Resources, resources...)
+				merged = true
+			}
+		}
+		if !merged {
+			rv = append(rv, segment.Permission{RoleID: role.ID, RoleName: role.Name, Resources: resources})
+		}
+	}
+
+	return rv, nil
+}
+
+// resolveDesiredResource returns the resources selected by a desired resource. Resources of types that aren't
+// synced can't be looked up, and are taken by ID as they are.
+func resolveDesiredResource(snapshot *iamSnapshot, desired DesiredResource) ([]segment.Resource, error) {
+	resourceType := strings.ToUpper(desired.Type)
+	if resourceType == workspaceType {
+		return []segment.Resource{{ID: snapshot.workspace.ID, Type: workspaceType}}, nil
+	}
+	if _, ok := permissionResourceTypes[resourceType]; !ok {
+		return nil, fmt.Errorf("unsupported resource type %s", desired.Type)
+	}
+
+	if desired.Label != "" {
+		if resourceType != sourceType {
+			return nil, fmt.Errorf("only sources can be selected by label")
+		}
+
+		var rv []segment.Resource
+		for id, labels := range snapshot.resourceLabels[sourceResourceType.Id] {
+			for _, label := range labels {
+				if strings.EqualFold(label, desired.Label) {
+					rv = append(rv, segment.Resource{ID: id, Type: sourceType})
+					break
+				}
+			}
+		}
+		sort.Slice(rv, func(i, j int) bool {
+			return rv[i].ID < rv[j].ID
+		})
+		return rv, nil
+	}
+
+	if desired.ID == "" {
+		return nil, fmt.Errorf("resource of type %s needs an id or a label", desired.Type)
+	}
+
+	names, listed := snapshot.resourceNames[resourceType]
+	if !listed {
+		return []segment.Resource{{ID: desired.ID, Type: resourceType}}, nil
+	}
+	if _, ok := names[desired.ID]; ok {
+		return []segment.Resource{{ID: desired.ID, Type: resourceType}}, nil
+	}
+	for id, name := range names {
+		if strings.EqualFold(name, desired.ID) {
+			return []segment.Resource{{ID: id, Type: resourceType}}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s %s not found", strings.ToLower(resourceType), desired.ID)
+}
+
+// snapshotOwners returns the emails of the Workspace Owners of the snapshot, direct or through groups.
+func snapshotOwners(snapshot *iamSnapshot, ownerRoleID string) map[string]bool {
+	rv := make(map[string]bool)
+	for _, user := range snapshot.users {
+		if hasRole(user.Permissions, ownerRoleID) {
+			rv[strings.ToLower(user.Email)] = true
+		}
+	}
+	for _, group := range snapshot.groups {
+		if hasRole(group.Permissions, ownerRoleID) {
+			for _, member := range snapshot.members[group.ID] {
+				rv[strings.ToLower(member.Email)] = true
+			}
+		}
+	}
+
+	return rv
+}
+
+// CheckPlan returns why Apply would refuse the plan, or nil if it can be applied.
+func (s *Segment) CheckPlan(plan *Plan, opts ApplyOptions) error {
+	minOwners := s.policy.minOwners()
+	if plan.OwnerCount < minOwners {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"baton-segment: plan would leave %d Workspace Owners, at least %d are required",
+			plan.OwnerCount,
+			minOwners,
+		)
+	}
+	if len(plan.OwnersRemoved) > 0 && !opts.AllowOwnerRemoval {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"baton-segment: plan removes the Workspace Owner role from %s, owner removal must be allowed",
+			strings.Join(plan.OwnersRemoved, ", "),
+		)
+	}
+
+	for _, change := range plan.Changes {
+		err := s.policy.checkIdentifiers(
+			change.PrincipalType,
+			change.Principal,
+			change.Principal,
+			change.principalID,
+			s.clients.scopedID(plan.WorkspaceID, change.principalID),
+		)
+		if err != nil && change.Action != PlanCreateGroup {
+			return err
+		}
+
+		switch change.Action {
+		case PlanUpdatePermissions:
+			for _, permission := range change.after {
+				if grantsNewResources(change.before, permission) {
+					if err := s.policy.checkRole(permission.RoleID, permission.RoleName); err != nil {
+						return err
+					}
+				}
+			}
+		case PlanAddMembers:
+			for _, permission := range plan.finalGroupPermissions[change.Principal] {
+				if s.policy.isProtectedRole(permission.RoleID, permission.RoleName) {
+					return status.Errorf(
+						codes.PermissionDenied,
+						"baton-segment: group %s holds protected role %s, members can't be added by the connector",
+						change.Principal,
+						permission.RoleName,
+					)
+				}
+			}
+			fallthrough
+		case PlanRemoveMembers:
+			for _, email := range append(append([]string{}, change.Added...), change.Removed...) {
+				if err := s.idp.checkMembership(change.principalID, change.Principal, email); err != nil {
+					return err
+				}
+				if err := s.policy.checkIdentifiers(userResourceType.Id, email, email); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// grantsNewResources returns whether the permission holds its role on a resource the role isn't held on before.
+func grantsNewResources(before []segment.Permission, permission segment.Permission) bool {
+	for _, resource := range permission.Resources {
+		held := false
+		for _, p := range before {
+			if p.RoleID != permission.RoleID {
+				continue
+			}
+			for _, r := range p.Resources {
+				held = held || (r.ID == resource.ID && r.Type == resource.Type)
+			}
+		}
+		if !held {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply makes the changes of a plan, after checking it against the safeguards and the provisioning policy. Changes
+// made before a failing change are kept.
+func (s *Segment) Apply(ctx context.Context, plan *Plan, opts ApplyOptions) error {
+	ctx = withProvisioningTask(ctx, &provisioningTask{Action: "apply"})
+
+	if err := s.CheckPlan(plan, opts); err != nil {
+		return err
+	}
+
+	created := make(map[string]string)
+	for _, change := range plan.Changes {
+		principalID := change.principalID
+		if principalID == "" {
+			principalID = created[change.Principal]
+		}
+
+		var err error
+		switch change.Action {
+		case PlanCreateGroup:
+			var group *segment.Group
+			group, err = s.provisioner.createGroup(ctx, plan.client, change.Principal)
+			if err == nil {
+				created[change.Principal] = group.ID
+			}
+		case PlanUpdatePermissions:
+			principal := &v2.Resource{
+				Id: &v2.ResourceId{
+					ResourceType: change.PrincipalType,
+					Resource:     s.clients.scopedID(plan.WorkspaceID, principalID),
+				},
+				DisplayName: change.Principal,
+			}
+			err = s.provisioner.updatePermissions(ctx, plan.client, principal, principalID, change.before, change.after)
+		case PlanAddMembers:
+			err = s.provisioner.addGroupMembers(ctx, plan.client, principalID, change.Principal, nil, change.Added)
+		case PlanRemoveMembers:
+			err = s.provisioner.removeGroupMembers(ctx, plan.client, principalID, change.Principal, nil, change.Removed)
+		}
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to %s of %s %s: %w", strings.ReplaceAll(change.Action, "_", " "), change.PrincipalType, change.Principal, err)
+		}
+	}
+
+	return nil
+}
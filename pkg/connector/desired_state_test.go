@@ -0,0 +1,316 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+var (
+	testOwnerRole  = segment.Role{ID: "r-owner", Name: workspaceOwnerRole}
+	testMemberRole = segment.Role{ID: "r-member", Name: "Workspace Member"}
+)
+
+func testWorkspacePermission(role segment.Role) segment.Permission {
+	return segment.Permission{
+		RoleID:    role.ID,
+		RoleName:  role.Name,
+		Resources: []segment.Resource{{ID: testWorkspaceID, Type: workspaceType}},
+	}
+}
+
+// serveTestIAM serves a workspace where alice is a Workspace Owner, carol is one through the Admins group, and bob
+// holds no permission.
+func serveTestIAM(fake *fakeSegment) {
+	alice := segment.User{ID: "u-alice", Name: "Alice", Email: "alice@example.com", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+	bob := segment.User{ID: "u-bob", Name: "Bob", Email: "bob@example.com"}
+	carol := segment.User{ID: "u-carol", Name: "Carol", Email: "carol@example.com"}
+	admins := segment.Group{ID: "g-admins", Name: "Admins", MemberCount: 1, Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+
+	fake.serveIAM(
+		[]segment.User{alice, bob, carol},
+		[]segment.Group{admins},
+		map[string][]segment.User{admins.ID: {carol}},
+		[]segment.Role{testOwnerRole, testMemberRole},
+	)
+}
+
+// planActions returns the changes of a plan as their action and principal.
+func planActions(plan *Plan) []string {
+	var rv []string
+	for _, change := range plan.Changes {
+		rv = append(rv, change.Action+" "+change.Principal)
+	}
+
+	return rv
+}
+
+func TestPlan(t *testing.T) {
+	// resources aren't served, so only users, groups and roles are synced.
+	resourceTypes := []string{sourceResourceType.Id, warehouseResourceType.Id, functionResourceType.Id, spaceResourceType.Id}
+	allTypes, err := newResourceTypeSet(nil, resourceTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutGroups, err := newResourceTypeSet(nil, append(resourceTypes, groupResourceType.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		syncTypes         resourceTypeSet
+		state             DesiredState
+		wantActions       []string
+		wantOwnersRemoved []string
+		wantOwnerCount    int
+		wantErr           string
+	}{
+		{
+			name:      "new group is created and given permissions before members are added",
+			syncTypes: allTypes,
+			state: DesiredState{
+				Groups: []DesiredGroup{{
+					Name:        "Analysts",
+					Members:     []string{"bob@example.com"},
+					Permissions: []DesiredPermission{{Role: "Workspace Member"}},
+				}},
+				Users: []DesiredUser{{
+					Email:       "alice@example.com",
+					Permissions: []DesiredPermission{{Role: "Workspace Member"}},
+				}},
+			},
+			wantActions: []string{
+				"create_group Analysts",
+				"update_permissions Analysts",
+				"add_members Analysts",
+				"update_permissions alice@example.com",
+			},
+			wantOwnersRemoved: []string{"alice@example.com"},
+			wantOwnerCount:    1,
+		},
+		{
+			name:      "members are removed last",
+			syncTypes: allTypes,
+			state: DesiredState{
+				Groups: []DesiredGroup{{
+					Name:        "Admins",
+					Permissions: []DesiredPermission{{Role: workspaceOwnerRole}},
+				}},
+				Users: []DesiredUser{{
+					Email:       "bob@example.com",
+					Permissions: []DesiredPermission{{Role: "r-member"}},
+				}},
+			},
+			wantActions: []string{
+				"update_permissions bob@example.com",
+				"remove_members Admins",
+			},
+			wantOwnersRemoved: []string{"carol@example.com"},
+			wantOwnerCount:    1,
+		},
+		{
+			name:      "existing group is reused when groups aren't synced",
+			syncTypes: withoutGroups,
+			state: DesiredState{
+				Groups: []DesiredGroup{{
+					Name:        "admins",
+					Members:     []string{"carol@example.com", "bob@example.com"},
+					Permissions: []DesiredPermission{{Role: workspaceOwnerRole}},
+				}},
+			},
+			wantActions:    []string{"add_members Admins"},
+			wantOwnerCount: 3,
+		},
+		{
+			name:      "owners through groups count when groups aren't synced",
+			syncTypes: withoutGroups,
+			state: DesiredState{
+				Users: []DesiredUser{{
+					Email: "alice@example.com",
+				}},
+			},
+			wantActions:       []string{"update_permissions alice@example.com"},
+			wantOwnersRemoved: []string{"alice@example.com"},
+			wantOwnerCount:    1,
+		},
+		{
+			name:      "member who isn't a workspace user refused",
+			syncTypes: allTypes,
+			state: DesiredState{
+				Groups: []DesiredGroup{{
+					Name:        "Admins",
+					Members:     []string{"carol@example.com", "invited@example.com"},
+					Permissions: []DesiredPermission{{Role: workspaceOwnerRole}},
+				}},
+				Users: []DesiredUser{{
+					Email: "alice@example.com",
+				}},
+			},
+			wantErr: "member invited@example.com isn't a user of workspace Workspace",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			serveTestIAM(fake)
+			s := &Segment{clients: fake.clients(), syncTypes: tt.syncTypes}
+
+			plan, err := s.Plan(context.Background(), &tt.state)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Plan() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := planActions(plan); !reflect.DeepEqual(got, tt.wantActions) {
+				t.Errorf("changes = %q, want %q", got, tt.wantActions)
+			}
+			if !reflect.DeepEqual(plan.OwnersRemoved, tt.wantOwnersRemoved) {
+				t.Errorf("owners removed = %q, want %q", plan.OwnersRemoved, tt.wantOwnersRemoved)
+			}
+			if plan.OwnerCount != tt.wantOwnerCount {
+				t.Errorf("owner count = %d, want %d", plan.OwnerCount, tt.wantOwnerCount)
+			}
+		})
+	}
+}
+
+func TestPlanStage(t *testing.T) {
+	tests := []struct {
+		change PlanChange
+		want   int
+	}{
+		{change: PlanChange{Action: PlanCreateGroup, PrincipalType: groupResourceType.Id}, want: 0},
+		{change: PlanChange{Action: PlanUpdatePermissions, PrincipalType: groupResourceType.Id}, want: 1},
+		{change: PlanChange{Action: PlanAddMembers, PrincipalType: groupResourceType.Id}, want: 2},
+		{change: PlanChange{Action: PlanUpdatePermissions, PrincipalType: userResourceType.Id}, want: 3},
+		{change: PlanChange{Action: PlanRemoveMembers, PrincipalType: groupResourceType.Id}, want: 4},
+	}
+
+	for _, tt := range tests {
+		if got := planStage(tt.change); got != tt.want {
+			t.Errorf("planStage(%s %s) = %d, want %d", tt.change.Action, tt.change.PrincipalType, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPlanOwners(t *testing.T) {
+	tests := []struct {
+		name          string
+		minOwnerCount int
+		plan          Plan
+		opts          ApplyOptions
+		wantErr       string
+	}{
+		{
+			name: "owners left",
+			plan: Plan{OwnerCount: 2},
+		},
+		{
+			name:    "no owner left",
+			plan:    Plan{OwnerCount: 0},
+			wantErr: "would leave 0 Workspace Owners, at least 1 are required",
+		},
+		{
+			name:          "fewer owners than the minimum",
+			minOwnerCount: 3,
+			plan:          Plan{OwnerCount: 2},
+			wantErr:       "would leave 2 Workspace Owners, at least 3 are required",
+		},
+		{
+			name:    "owner removal not allowed",
+			plan:    Plan{OwnerCount: 2, OwnersRemoved: []string{"alice@example.com"}},
+			wantErr: "removes the Workspace Owner role from alice@example.com",
+		},
+		{
+			name: "owner removal allowed",
+			plan: Plan{OwnerCount: 2, OwnersRemoved: []string{"alice@example.com"}},
+			opts: ApplyOptions{AllowOwnerRemoval: true},
+		},
+		{
+			name:          "owner removal allowed below the minimum",
+			minOwnerCount: 2,
+			plan:          Plan{OwnerCount: 1, OwnersRemoved: []string{"alice@example.com"}},
+			opts:          ApplyOptions{AllowOwnerRemoval: true},
+			wantErr:       "would leave 1 Workspace Owners, at least 2 are required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Segment{
+				policy: &ProvisioningPolicy{MinOwnerCount: tt.minOwnerCount},
+				idp:    &IdPManagement{},
+			}
+
+			err := s.CheckPlan(&tt.plan, tt.opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("CheckPlan() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	fake := newFakeSegment(t)
+	serveTestIAM(fake)
+	fake.handle(http.MethodPost, "/groups", respondData(t, "userGroup", segment.Group{ID: "g-analysts", Name: "Analysts"}))
+	fake.handle(http.MethodPut, "/groups/g-analysts/permissions", respondData(t, "permissions", []segment.Permission{}))
+	fake.handle(http.MethodPost, "/groups/g-analysts/users", respondData(t, "userGroup", segment.Group{ID: "g-analysts", Name: "Analysts"}))
+	fake.handle(http.MethodPut, "/users/u-bob/permissions", respondData(t, "permissions", []segment.Permission{}))
+
+	s := &Segment{
+		clients:     fake.clients(),
+		syncTypes:   resourceTypeSet{},
+		policy:      &ProvisioningPolicy{},
+		idp:         &IdPManagement{},
+		provisioner: newProvisioner(false, nil),
+	}
+	state := &DesiredState{
+		Groups: []DesiredGroup{{
+			Name:        "Analysts",
+			Members:     []string{"bob@example.com"},
+			Permissions: []DesiredPermission{{Role: "Workspace Member"}},
+		}},
+		Users: []DesiredUser{{
+			Email:       "bob@example.com",
+			Permissions: []DesiredPermission{{Role: "Workspace Member"}},
+		}},
+	}
+
+	ctx := context.Background()
+	plan, err := s.Plan(ctx, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(fake.requested())
+	if err := s.Apply(ctx, plan, ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"POST /groups",
+		"PUT /groups/g-analysts/permissions",
+		"POST /groups/g-analysts/users",
+		"PUT /users/u-bob/permissions",
+	}
+	if got := fake.requested()[before:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,362 @@
+package connector
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+)
+
+// ElevationRequest asks for a role to be granted to a user for a limited time.
+type ElevationRequest struct {
+	// Workspace is the ID, name or slug of the workspace, required when several workspaces are configured.
+	Workspace string
+	Email     string
+	// Role is the name or ID of the role.
+	Role string
+	// Resources are the resources the role is granted on, the workspace if empty.
+	Resources []DesiredResource
+	Duration  time.Duration
+	Reason    string
+}
+
+// Elevation is a role granted to a user until it expires. Before is the permission set of the user when the role
+// was granted, which is restored when the elevation expires.
+type Elevation struct {
+	ID            string               `json:"id"`
+	WorkspaceID   string               `json:"workspace_id"`
+	WorkspaceName string               `json:"workspace_name"`
+	UserID        string               `json:"user_id"`
+	UserEmail     string               `json:"user_email"`
+	RoleID        string               `json:"role_id"`
+	RoleName      string               `json:"role_name"`
+	Resources     []segment.Resource   `json:"resources"`
+	Reason        string               `json:"reason,omitempty"`
+	GrantedAt     time.Time            `json:"granted_at"`
+	ExpiresAt     time.Time            `json:"expires_at"`
+	Before        []segment.Permission `json:"before"`
+	After         []segment.Permission `json:"after"`
+	// Pending is set while the role is being granted. An elevation left pending may or may not have been granted,
+	// expiring it restores the permissions from before it either way.
+	Pending bool `json:"pending,omitempty"`
+}
+
+// ElevationState is the list of active elevations, kept in a local file between runs.
+type ElevationState struct {
+	Elevations []Elevation `json:"elevations"`
+}
+
+// LoadElevationState reads the elevation state file. A missing file is an empty state.
+func LoadElevationState(path string) (*ElevationState, error) {
+	state := &ElevationState{}
+	if err := readStateFile(path, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// active returns the elevation of the user in the workspace, or nil.
+func (e *ElevationState) active(workspaceID, userID string) *Elevation {
+	for i := range e.Elevations {
+		if e.Elevations[i].WorkspaceID == workspaceID && e.Elevations[i].UserID == userID {
+			return &e.Elevations[i]
+		}
+	}
+
+	return nil
+}
+
+// remove removes the elevation with the ID from the state.
+func (e *ElevationState) remove(id string) {
+	var rv []Elevation
+	for _, elevation := range e.Elevations {
+		if elevation.ID != id {
+			rv = append(rv, elevation)
+		}
+	}
+	e.Elevations = rv
+}
+
+// Elevate grants the role of the request to the user until the elevation expires, and adds the elevation to the
+// state file at statePath. A user can only have one elevation per workspace at a time, so that expiring it restores
+// the permissions they had before any elevation.
+//
+// The state file is locked until the elevation is recorded, and the elevation is written to it as pending before
+// the role is granted, so a run that fails halfway never leaves a grant that expire doesn't know about.
+func (s *Segment) Elevate(ctx context.Context, statePath string, req ElevationRequest) (*Elevation, error) {
+	ctx = withProvisioningTask(ctx, &provisioningTask{Action: "elevate"})
+
+	if req.Duration <= 0 {
+		return nil, fmt.Errorf("baton-segment: elevation duration must be positive")
+	}
+
+	workspace, client, err := s.desiredWorkspace(ctx, req.Workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := findUserByEmail(ctx, client, req.Email)
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to find user %s: %w", req.Email, err)
+	}
+	if user == nil {
+		return nil, fmt.Errorf("baton-segment: user %s isn't a member of workspace %s", req.Email, workspace.Name)
+	}
+
+	principal := &v2.Resource{
+		Id: &v2.ResourceId{
+			ResourceType: userResourceType.Id,
+			Resource:     s.clients.scopedID(workspace.ID, user.ID),
+		},
+		DisplayName: user.Email,
+	}
+	err = s.policy.checkIdentifiers(userResourceType.Id, user.Email, principal.Id.Resource, user.ID, user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	var role *segment.Role
+	err = paginate(ctx, client.ListRoles, func(r segment.Role) error {
+		if role == nil && (r.ID == req.Role || strings.EqualFold(r.Name, req.Role)) {
+			roleCopy := r
+			role = &roleCopy
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to list roles: %w", err)
+	}
+	if role == nil {
+		return nil, fmt.Errorf("baton-segment: role %s not found", req.Role)
+	}
+	if err := s.policy.checkRole(role.ID, role.Name); err != nil {
+		return nil, err
+	}
+
+	resources, err := s.elevationResources(ctx, client, workspace, req.Resources)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockStateFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	state, err := LoadElevationState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	if current := state.active(workspace.ID, user.ID); current != nil {
+		return nil, fmt.Errorf(
+			"baton-segment: user %s already has elevation %s to %s until %s",
+			user.Email,
+			current.ID,
+			current.RoleName,
+			current.ExpiresAt.Format(time.RFC3339),
+		)
+	}
+
+	before, after, err := grantPermissions(ctx, client, principal, user.ID, role.ID, resources[0].Type, resources[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	after[len(after)-1].Resources = resources
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	elevation := Elevation{
+		ID:            hex.EncodeToString(id),
+		WorkspaceID:   workspace.ID,
+		WorkspaceName: workspace.Name,
+		UserID:        user.ID,
+		UserEmail:     user.Email,
+		RoleID:        role.ID,
+		RoleName:      role.Name,
+		Resources:     resources,
+		Reason:        req.Reason,
+		GrantedAt:     now,
+		ExpiresAt:     now.Add(req.Duration),
+		Before:        before,
+		After:         after,
+	}
+	if elevation.Before == nil {
+		elevation.Before = []segment.Permission{}
+	}
+
+	if s.dryRun {
+		if err := s.provisioner.updatePermissions(ctx, client, principal, user.ID, before, after); err != nil {
+			return nil, err
+		}
+		return &elevation, nil
+	}
+
+	elevation.Pending = true
+	state.Elevations = append(state.Elevations, elevation)
+	if err := writeStateFile(statePath, state); err != nil {
+		return nil, err
+	}
+
+	if err := s.provisioner.updatePermissions(ctx, client, principal, user.ID, before, after); err != nil {
+		// the request may have been applied even though it failed, the elevation is only dropped once the user's
+		// permissions are known to be unchanged.
+		current, getErr := getPermissions(ctx, client, principal, user.ID)
+		if getErr != nil {
+			return nil, fmt.Errorf("baton-segment: elevation %s stays pending until it expires: %w", elevation.ID, err)
+		}
+		if added, removed := diffPermissions(before, current); len(added) > 0 || len(removed) > 0 {
+			return nil, fmt.Errorf("baton-segment: elevation %s stays pending until it expires: %w", elevation.ID, err)
+		}
+
+		state.remove(elevation.ID)
+		return nil, errors.Join(err, writeStateFile(statePath, state))
+	}
+
+	elevation.Pending = false
+	state.Elevations[len(state.Elevations)-1] = elevation
+	if err := writeStateFile(statePath, state); err != nil {
+		return nil, fmt.Errorf("baton-segment: elevation %s is granted but stays pending until it expires: %w", elevation.ID, err)
+	}
+
+	return &elevation, nil
+}
+
+// elevationResources returns the resources of the request, by ID or name, or the workspace.
+func (s *Segment) elevationResources(
+	ctx context.Context,
+	client *segment.Client,
+	workspace *segment.Workspace,
+	requested []DesiredResource,
+) ([]segment.Resource, error) {
+	if len(requested) == 0 {
+		return []segment.Resource{{ID: workspace.ID, Type: workspaceType}}, nil
+	}
+
+	snapshot := &iamSnapshot{
+		workspace:      workspace,
+		client:         client,
+		resourceNames:  make(map[string]map[string]string),
+		resourceLabels: make(map[string]map[string][]string),
+	}
+	if err := snapshot.loadResources(ctx, s.syncTypes); err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to list resources: %w", err)
+	}
+
+	var rv []segment.Resource
+	for _, r := range requested {
+		resources, err := resolveDesiredResource(snapshot, r)
+		if err != nil {
+			return nil, fmt.Errorf("baton-segment: %w", err)
+		}
+		rv = append(rv, resources...)
+	}
+	if len(rv) == 0 {
+		return nil, fmt.Errorf("baton-segment: no resources match the elevation")
+	}
+
+	return rv, nil
+}
+
+// ExpireElevations reverts the elevations of the state file at statePath that expired by now, or all of them,
+// restoring the exact permission set each user had before their elevation. Reverted elevations are removed from the
+// state file; the ones that fail stay in it to be retried, and their errors are returned. The state file is locked
+// throughout, so elevations recorded by a concurrent run aren't lost.
+func (s *Segment) ExpireElevations(ctx context.Context, statePath string, now time.Time, all bool) ([]Elevation, error) {
+	ctx = withProvisioningTask(ctx, &provisioningTask{Action: "expire"})
+
+	unlock, err := lockStateFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	state, err := LoadElevationState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired, remaining []Elevation
+	var errs []error
+	for _, elevation := range state.Elevations {
+		if !all && now.Before(elevation.ExpiresAt) {
+			remaining = append(remaining, elevation)
+			continue
+		}
+
+		if err := s.expire(ctx, elevation); err != nil {
+			errs = append(errs, fmt.Errorf("baton-segment: failed to expire elevation %s of %s: %w", elevation.ID, elevation.UserEmail, err))
+			remaining = append(remaining, elevation)
+			continue
+		}
+		expired = append(expired, elevation)
+	}
+
+	if !s.dryRun && len(expired) > 0 {
+		state.Elevations = remaining
+		if err := writeStateFile(statePath, state); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return expired, errors.Join(errs...)
+}
+
+func (s *Segment) expire(ctx context.Context, elevation Elevation) error {
+	client, err := s.clients.get(ctx, elevation.WorkspaceID)
+	if err != nil {
+		return err
+	}
+
+	principal := &v2.Resource{
+		Id: &v2.ResourceId{
+			ResourceType: userResourceType.Id,
+			Resource:     s.clients.scopedID(elevation.WorkspaceID, elevation.UserID),
+		},
+		DisplayName: elevation.UserEmail,
+	}
+
+	// a user deleted since the elevation was granted has no permissions left to restore.
+	status := &segment.ResponseStatus{}
+	current, err := getPermissions(segment.WithResponseStatus(ctx, status), client, principal, elevation.UserID)
+	if err != nil {
+		if status.Code == http.StatusNotFound {
+			ctxzap.Extract(ctx).Warn(
+				"baton-segment: user of the elevation no longer exists, dropping the elevation",
+				zap.String("elevation_id", elevation.ID),
+				zap.String("user_email", elevation.UserEmail),
+				zap.Error(err),
+			)
+			return nil
+		}
+		return err
+	}
+
+	// changes made to the user's permissions during the elevation are reverted too, log them so they aren't lost
+	// silently. A pending elevation may never have been granted, so its permissions aren't expected to match.
+	if added, removed := diffPermissions(elevation.After, current); !elevation.Pending && (len(added) > 0 || len(removed) > 0) {
+		ctxzap.Extract(ctx).Warn(
+			"baton-segment: permissions changed during elevation, restoring the permissions from before it",
+			zap.String("elevation_id", elevation.ID),
+			zap.String("user_email", elevation.UserEmail),
+			zap.Strings("added", added),
+			zap.Strings("removed", removed),
+		)
+	}
+
+	return s.provisioner.updatePermissions(ctx, client, principal, elevation.UserID, current, elevation.Before)
+}
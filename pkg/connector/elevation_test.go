@@ -0,0 +1,400 @@
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// fakeUserPermissions serves the permissions of a user, updated by the permission requests made for them. Permission
+// requests fail with failStatus when it's set, after being applied if applyFailed is set.
+type fakeUserPermissions struct {
+	t    *testing.T
+	user segment.User
+
+	mu          sync.Mutex
+	permissions []segment.Permission
+	puts        [][]segment.Permission
+	failStatus  int
+	applyFailed bool
+	onPut       func()
+}
+
+func serveUserPermissions(fake *fakeSegment, user segment.User) *fakeUserPermissions {
+	f := &fakeUserPermissions{t: fake.t, user: user, permissions: user.Permissions}
+	fake.handle(http.MethodGet, "/users/"+user.ID, func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		user := f.user
+		user.Permissions = f.permissions
+		f.mu.Unlock()
+		respondData(f.t, "user", user)(w, r)
+	})
+	fake.handle(http.MethodPut, "/users/"+user.ID+"/permissions", func(w http.ResponseWriter, r *http.Request) {
+		var body segment.PermissionsPayload
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			f.t.Errorf("invalid permissions request: %v", err)
+		}
+		if f.onPut != nil {
+			f.onPut()
+		}
+
+		f.mu.Lock()
+		f.puts = append(f.puts, body.Permissions)
+		if f.failStatus == 0 || f.applyFailed {
+			f.permissions = body.Permissions
+		}
+		failStatus := f.failStatus
+		f.mu.Unlock()
+
+		if failStatus != 0 {
+			w.WriteHeader(failStatus)
+			return
+		}
+		respondData(f.t, "permissions", body.Permissions)(w, r)
+	})
+
+	return f
+}
+
+func (f *fakeUserPermissions) current() []segment.Permission {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.permissions
+}
+
+func newElevationSegment(fake *fakeSegment) *Segment {
+	return &Segment{
+		clients:     fake.clients(),
+		syncTypes:   resourceTypeSet{},
+		policy:      &ProvisioningPolicy{},
+		idp:         &IdPManagement{},
+		provisioner: newProvisioner(false, nil),
+	}
+}
+
+func loadTestElevations(t *testing.T, path string) []Elevation {
+	t.Helper()
+
+	state, err := LoadElevationState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return state.Elevations
+}
+
+func TestElevate(t *testing.T) {
+	fake := newFakeSegment(t)
+	serveTestIAM(fake)
+	bob := serveUserPermissions(fake, segment.User{
+		ID:          "u-bob",
+		Email:       "bob@example.com",
+		Permissions: []segment.Permission{testWorkspacePermission(testMemberRole)},
+	})
+	statePath := filepath.Join(t.TempDir(), "elevations.json")
+
+	bob.onPut = func() {
+		elevations := loadTestElevations(t, statePath)
+		if len(elevations) != 1 || !elevations[0].Pending {
+			t.Errorf("state file holds %+v before the grant, want one pending elevation", elevations)
+		}
+	}
+
+	s := newElevationSegment(fake)
+	elevation, err := s.Elevate(context.Background(), statePath, ElevationRequest{
+		Email:    "bob@example.com",
+		Role:     workspaceOwnerRole,
+		Duration: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantAfter := []segment.Permission{
+		testWorkspacePermission(testMemberRole),
+		{RoleID: testOwnerRole.ID, Resources: []segment.Resource{{ID: testWorkspaceID, Type: workspaceType}}},
+	}
+	if !reflect.DeepEqual(bob.current(), wantAfter) {
+		t.Errorf("permissions = %+v, want %+v", bob.current(), wantAfter)
+	}
+
+	elevations := loadTestElevations(t, statePath)
+	if len(elevations) != 1 || elevations[0].ID != elevation.ID || elevations[0].Pending {
+		t.Fatalf("state file holds %+v, want elevation %s granted", elevations, elevation.ID)
+	}
+	if want := []segment.Permission{testWorkspacePermission(testMemberRole)}; !reflect.DeepEqual(elevations[0].Before, want) {
+		t.Errorf("before = %+v, want %+v", elevations[0].Before, want)
+	}
+
+	bob.onPut = nil
+	_, err = s.Elevate(context.Background(), statePath, ElevationRequest{
+		Email:    "bob@example.com",
+		Role:     "Workspace Member",
+		Duration: time.Hour,
+	})
+	if err == nil {
+		t.Error("second elevation of the user succeeded, want an error")
+	}
+	if len(bob.puts) != 1 {
+		t.Errorf("got %d permission updates, want 1", len(bob.puts))
+	}
+}
+
+func TestElevateFailedGrant(t *testing.T) {
+	tests := []struct {
+		name        string
+		applyFailed bool
+		wantPending bool
+	}{
+		{
+			name: "grant not applied",
+		},
+		{
+			name:        "grant applied despite the error",
+			applyFailed: true,
+			wantPending: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			serveTestIAM(fake)
+			bob := serveUserPermissions(fake, segment.User{ID: "u-bob", Email: "bob@example.com"})
+			bob.failStatus = http.StatusInternalServerError
+			bob.applyFailed = tt.applyFailed
+			statePath := filepath.Join(t.TempDir(), "elevations.json")
+
+			s := newElevationSegment(fake)
+			_, err := s.Elevate(context.Background(), statePath, ElevationRequest{
+				Email:    "bob@example.com",
+				Role:     workspaceOwnerRole,
+				Duration: time.Hour,
+			})
+			if err == nil {
+				t.Fatal("Elevate() succeeded, want an error")
+			}
+
+			elevations := loadTestElevations(t, statePath)
+			if !tt.wantPending {
+				if len(elevations) != 0 {
+					t.Errorf("state file holds %+v, want no elevation", elevations)
+				}
+				return
+			}
+			if len(elevations) != 1 || !elevations[0].Pending {
+				t.Errorf("state file holds %+v, want one pending elevation", elevations)
+			}
+		})
+	}
+}
+
+func TestElevateConcurrently(t *testing.T) {
+	fake := newFakeSegment(t)
+	serveTestIAM(fake)
+	serveUserPermissions(fake, segment.User{ID: "u-bob", Email: "bob@example.com"})
+	serveUserPermissions(fake, segment.User{ID: "u-carol", Email: "carol@example.com"})
+	statePath := filepath.Join(t.TempDir(), "elevations.json")
+	s := newElevationSegment(fake)
+
+	var wg sync.WaitGroup
+	for _, email := range []string{"bob@example.com", "carol@example.com"} {
+		wg.Add(1)
+		go func(email string) {
+			defer wg.Done()
+			_, err := s.Elevate(context.Background(), statePath, ElevationRequest{
+				Email:    email,
+				Role:     "Workspace Member",
+				Duration: time.Hour,
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(email)
+	}
+	wg.Wait()
+
+	var emails []string
+	for _, elevation := range loadTestElevations(t, statePath) {
+		emails = append(emails, elevation.UserEmail)
+	}
+	sort.Strings(emails)
+	if want := []string{"bob@example.com", "carol@example.com"}; !reflect.DeepEqual(emails, want) {
+		t.Errorf("elevated users = %q, want %q", emails, want)
+	}
+}
+
+func TestExpireElevations(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sourcePermission := segment.Permission{RoleID: "r-source", RoleName: "Source Admin", Resources: []segment.Resource{{ID: "s1", Type: sourceType}}}
+	before := []segment.Permission{testWorkspacePermission(testMemberRole), sourcePermission}
+	after := append(append([]segment.Permission{}, before...), testWorkspacePermission(testOwnerRole))
+
+	elevation := func(id string, expiresAt time.Time, pending bool) Elevation {
+		return Elevation{
+			ID:          id,
+			WorkspaceID: testWorkspaceID,
+			UserID:      "u-bob",
+			UserEmail:   "bob@example.com",
+			RoleID:      testOwnerRole.ID,
+			RoleName:    testOwnerRole.Name,
+			ExpiresAt:   expiresAt,
+			Before:      before,
+			After:       after,
+			Pending:     pending,
+		}
+	}
+
+	tests := []struct {
+		name          string
+		elevation     Elevation
+		current       []segment.Permission
+		all           bool
+		failStatus    int
+		wantRestored  bool
+		wantRemaining bool
+		wantErr       bool
+	}{
+		{
+			name:         "expired elevation restored",
+			elevation:    elevation("e1", now.Add(-time.Minute), false),
+			current:      after,
+			wantRestored: true,
+		},
+		{
+			name:         "changes made during the elevation reverted",
+			elevation:    elevation("e1", now.Add(-time.Minute), false),
+			current:      []segment.Permission{testWorkspacePermission(testOwnerRole)},
+			wantRestored: true,
+		},
+		{
+			name:          "elevation not expired yet kept",
+			elevation:     elevation("e1", now.Add(time.Minute), false),
+			current:       after,
+			wantRemaining: true,
+		},
+		{
+			name:         "every elevation reverted",
+			elevation:    elevation("e1", now.Add(time.Minute), false),
+			current:      after,
+			all:          true,
+			wantRestored: true,
+		},
+		{
+			name:         "pending elevation never granted",
+			elevation:    elevation("e1", now.Add(-time.Minute), true),
+			current:      before,
+			wantRestored: true,
+		},
+		{
+			name:          "failed restore kept to be retried",
+			elevation:     elevation("e1", now.Add(-time.Minute), false),
+			current:       after,
+			failStatus:    http.StatusInternalServerError,
+			wantRemaining: true,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			bob := serveUserPermissions(fake, segment.User{ID: "u-bob", Email: "bob@example.com", Permissions: tt.current})
+			bob.failStatus = tt.failStatus
+			statePath := filepath.Join(t.TempDir(), "elevations.json")
+			if err := writeStateFile(statePath, &ElevationState{Elevations: []Elevation{tt.elevation}}); err != nil {
+				t.Fatal(err)
+			}
+
+			s := newElevationSegment(fake)
+			expired, err := s.ExpireElevations(context.Background(), statePath, now, tt.all)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExpireElevations() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if tt.wantRestored {
+				if len(expired) != 1 {
+					t.Errorf("expired %d elevations, want 1", len(expired))
+				}
+				if len(bob.puts) != 1 || !reflect.DeepEqual(bob.puts[0], before) {
+					t.Errorf("permission updates = %+v, want exactly %+v", bob.puts, before)
+				}
+			} else if len(expired) != 0 {
+				t.Errorf("expired %d elevations, want none", len(expired))
+			}
+
+			remaining := loadTestElevations(t, statePath)
+			if tt.wantRemaining != (len(remaining) == 1) {
+				t.Errorf("state file holds %+v, want the elevation kept %v", remaining, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestExpireElevationsDeletedUser(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		wantRemaining bool
+		wantErr       bool
+	}{
+		{
+			name:   "deleted user dropped",
+			status: http.StatusNotFound,
+		},
+		{
+			name:          "unreadable user kept to be retried",
+			status:        http.StatusInternalServerError,
+			wantRemaining: true,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			fake.handle(http.MethodGet, "/users/u-bob", respondStatus(tt.status))
+			statePath := filepath.Join(t.TempDir(), "elevations.json")
+			elevation := Elevation{
+				ID:          "e1",
+				WorkspaceID: testWorkspaceID,
+				UserID:      "u-bob",
+				UserEmail:   "bob@example.com",
+				RoleID:      testOwnerRole.ID,
+				ExpiresAt:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				Before:      []segment.Permission{testWorkspacePermission(testMemberRole)},
+				After:       []segment.Permission{testWorkspacePermission(testOwnerRole)},
+			}
+			if err := writeStateFile(statePath, &ElevationState{Elevations: []Elevation{elevation}}); err != nil {
+				t.Fatal(err)
+			}
+
+			s := newElevationSegment(fake)
+			expired, err := s.ExpireElevations(context.Background(), statePath, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExpireElevations() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantRemaining == (len(expired) == 1) {
+				t.Errorf("expired %d elevations, want the elevation expired %v", len(expired), !tt.wantRemaining)
+			}
+			if remaining := loadTestElevations(t, statePath); tt.wantRemaining != (len(remaining) == 1) {
+				t.Errorf("state file holds %+v, want the elevation kept %v", remaining, tt.wantRemaining)
+			}
+			for _, request := range fake.requested() {
+				if strings.HasPrefix(request, http.MethodPut) {
+					t.Errorf("unexpected permission update %s", request)
+				}
+			}
+		})
+	}
+}
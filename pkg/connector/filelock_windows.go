@@ -0,0 +1,32 @@
+//go:build windows
+
+package connector
+
+import (
+	"math"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile takes an exclusive lock on the file at path, creating it if needed, and waits for other holders to
+// release it. The lock is released by the returned function, or when the process exits.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := windows.Handle(f.Fd())
+	overlapped := &windows.Overlapped{}
+	err = windows.LockFileEx(handle, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, math.MaxUint32, math.MaxUint32, overlapped)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		_ = windows.UnlockFileEx(handle, 0, math.MaxUint32, math.MaxUint32, overlapped)
+		f.Close()
+	}, nil
+}
@@ -3,31 +3,73 @@ package connector
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 	"github.com/conductorone/baton-sdk/pkg/annotations"
 	"github.com/conductorone/baton-sdk/pkg/pagination"
+	ent "github.com/conductorone/baton-sdk/pkg/types/entitlement"
+	grant "github.com/conductorone/baton-sdk/pkg/types/grant"
 	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
 	"github.com/conductorone/baton-segment/pkg/segment"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
 )
 
 type functionResourceBuilder struct {
 	resourceType *v2.ResourceType
-	client       *segment.Client
+	clients      *workspaceClients
+	policy       *ProvisioningPolicy
+	provisioner  *provisioner
+	users        *userCache
 }
 
 func (f *functionResourceBuilder) ResourceType(_ context.Context) *v2.ResourceType {
 	return f.resourceType
 }
 
-// Create a new connector resource for an Segment Function.
-func functionResource(function *segment.Function, parentResourceID *v2.ResourceId) (*v2.Resource, error) {
-	resource, err := rs.NewResource(
+// functionOwnership is the entitlement held by the user who created a function.
+const functionOwnership = "owner"
+
+// outboundURLPattern matches the absolute URLs referenced in function code.
+var outboundURLPattern = regexp.MustCompile(`https?://[^\s'"` + "`" + `<>()\\]+`)
+
+// Create a new connector resource for an Segment Function. The code of the function is never stored, only the hosts
+// of the URLs it references.
+func functionResource(function *segment.Function, parentResourceID *v2.ResourceId, clients *workspaceClients) (*v2.Resource, error) {
+	sensitiveSettings := 0
+	for _, setting := range function.Settings {
+		if setting.Sensitive {
+			sensitiveSettings++
+		}
+	}
+
+	hosts := functionOutboundHosts(function.Code)
+	outboundHosts := make([]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		outboundHosts = append(outboundHosts, host)
+	}
+
+	profile := map[string]interface{}{
+		"function_id":             function.ID,
+		"function_type":           function.ResourceType,
+		"created_at":              function.CreatedAt,
+		"created_by":              function.CreatedBy,
+		"buildpack":               function.Buildpack,
+		"sensitive_setting_count": sensitiveSettings,
+		"outbound_hosts":          outboundHosts,
+	}
+
+	resource, err := rs.NewAppResource(
 		function.DisplayName,
 		functionResourceType,
-		function.ID,
+		clients.scopedID(parentResourceID.Resource, function.ID),
+		[]rs.AppTraitOption{rs.WithAppProfile(profile)},
 		rs.WithParentResourceID(parentResourceID),
+		rs.WithDescription(function.Description),
 	)
 	if err != nil {
 		return nil, err
@@ -36,13 +78,38 @@ func functionResource(function *segment.Function, parentResourceID *v2.ResourceI
 	return resource, nil
 }
 
+// functionOutboundHosts returns the hosts of the URLs referenced in function code, sorted.
+func functionOutboundHosts(code string) []string {
+	seen := make(map[string]bool)
+	var rv []string
+	for _, match := range outboundURLPattern.FindAllString(code, -1) {
+		u, err := url.Parse(match)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+
+		host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+		if !seen[host] {
+			seen[host] = true
+			rv = append(rv, host)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv
+}
+
 func (f *functionResourceBuilder) List(ctx context.Context, parentResourceID *v2.ResourceId, pToken *pagination.Token) ([]*v2.Resource, string, annotations.Annotations, error) {
 	if parentResourceID == nil {
 		return nil, "", nil, nil
 	}
 
+	client, err := f.clients.get(ctx, parentResourceID.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
 	// There are 3 types of functions, we need to fetch all of them
-	functionTypes := []string{"DESTINATION", "INSERT_DESTINATION", "SOURCE"}
 	var cursor string
 	var allFunctions []segment.Function
 
@@ -50,7 +117,7 @@ func (f *functionResourceBuilder) List(ctx context.Context, parentResourceID *v2
 		cursor = ""
 		for {
 			// Fetch data for the current type
-			functions, nextCursor, err := f.client.ListFunctions(ctx, cursor, t)
+			functions, nextCursor, err := client.ListFunctions(ctx, cursor, t)
 			if err != nil {
 				return nil, "", nil, fmt.Errorf("error fetching data for type %s: %w", t, err)
 			}
@@ -68,7 +135,7 @@ func (f *functionResourceBuilder) List(ctx context.Context, parentResourceID *v2
 	var rv []*v2.Resource
 	for _, fn := range allFunctions {
 		fnCopy := fn
-		fr, err := functionResource(&fnCopy, parentResourceID)
+		fr, err := functionResource(&fnCopy, parentResourceID, f.clients)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -85,7 +152,12 @@ func (f *functionResourceBuilder) Entitlements(ctx context.Context, resource *v2
 		return nil, "", nil, err
 	}
 
-	roles, nextCursor, err := f.client.ListRoles(ctx, page)
+	client, err := f.clients.get(ctx, resource.ParentResourceId.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	roles, nextCursor, err := client.ListRoles(ctx, page)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -96,6 +168,15 @@ func (f *functionResourceBuilder) Entitlements(ctx context.Context, resource *v2
 	}
 
 	var rv []*v2.Entitlement
+	if page == "" {
+		rv = append(rv, ent.NewAssignmentEntitlement(
+			resource,
+			functionOwnership,
+			ent.WithGrantableTo(userResourceType),
+			ent.WithDisplayName(fmt.Sprintf("%s function %s", resource.DisplayName, functionOwnership)),
+			ent.WithDescription(fmt.Sprintf("Creator of %s Segment function", resource.DisplayName)),
+		))
+	}
 	for _, role := range roles {
 		if strings.Contains(role.Name, "Function") {
 			entitlement := createEntitlement(role, resource)
@@ -106,19 +187,80 @@ func (f *functionResourceBuilder) Entitlements(ctx context.Context, resource *v2
 	return rv, pageToken, nil, nil
 }
 
+// Grants emits the ownership of the user who created the function. Permissions on functions are granted on user
+// level.
 func (f *functionResourceBuilder) Grants(ctx context.Context, resource *v2.Resource, pToken *pagination.Token) ([]*v2.Grant, string, annotations.Annotations, error) {
-	return nil, "", nil, nil
+	appTrait, err := rs.GetAppTrait(resource)
+	if err != nil {
+		return nil, "", nil, nil
+	}
+
+	createdBy, ok := rs.GetProfileStringValue(appTrait.Profile, "created_by")
+	if !ok || createdBy == "" {
+		return nil, "", nil, nil
+	}
+
+	workspaceID := resource.ParentResourceId.Resource
+	userID := createdBy
+	if strings.Contains(createdBy, "@") {
+		client, err := f.clients.get(ctx, workspaceID)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		user, err := f.users.findByEmail(ctx, client, workspaceID, createdBy)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if user == nil {
+			ctxzap.Extract(ctx).Debug(
+				"baton-segment: creator of function isn't a workspace user",
+				zap.String("function_id", resource.Id.Resource),
+			)
+			return nil, "", nil, nil
+		}
+		userID = user.ID
+	}
+
+	owner := &v2.ResourceId{
+		ResourceType: userResourceType.Id,
+		Resource:     f.clients.scopedID(workspaceID, userID),
+	}
+
+	return []*v2.Grant{grant.NewGrant(resource, functionOwnership, owner)}, "", nil, nil
+}
+
+// isFunctionOwnership returns whether the entitlement is the ownership of a function, which can't be provisioned.
+func isFunctionOwnership(entitlement *v2.Entitlement) bool {
+	return entitlement.Slug == functionOwnership || strings.HasSuffix(entitlement.Id, ":"+functionOwnership)
 }
 
 func (f *functionResourceBuilder) Grant(ctx context.Context, principal *v2.Resource, entitlement *v2.Entitlement) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, grantTask(entitlement))
+
+	if isFunctionOwnership(entitlement) {
+		return nil, fmt.Errorf("baton-segment: function ownership can't be granted")
+	}
+
 	roleID, resourceType := getRoleIdAndResourceType(entitlement)
-	resourceID := entitlement.Resource.Id.Resource
-	permissions, err := grantPermissions(ctx, f.client, principal, roleID, resourceType, resourceID)
+	if err := f.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+	if err := f.policy.checkRole(roleID, getRoleName(entitlement)); err != nil {
+		return nil, err
+	}
+
+	client, resourceID, principalID, err := f.clients.forGrant(ctx, entitlement.Resource.Id, principal)
 	if err != nil {
 		return nil, err
 	}
 
-	err = f.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, permissions)
+	current, permissions, err := grantPermissions(ctx, client, principal, principalID, roleID, resourceType, resourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.provisioner.updatePermissions(ctx, client, principal, principalID, current, permissions)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"baton-segment: failed to add permission to %s %s for function resource %s: %w",
@@ -133,16 +275,30 @@ func (f *functionResourceBuilder) Grant(ctx context.Context, principal *v2.Resou
 }
 
 func (f *functionResourceBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, revokeTask(grant))
+
 	entitlement := grant.Entitlement
 	principal := grant.Principal
-	roleID, _ := getRoleIdAndResourceType(entitlement)
+	if isFunctionOwnership(entitlement) {
+		return nil, fmt.Errorf("baton-segment: function ownership can't be revoked")
+	}
 
-	newPermissions, err := revokePermissions(ctx, f.client, principal, roleID)
+	if err := f.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+
+	client, _, principalID, err := f.clients.forGrant(ctx, entitlement.Resource.Id, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	roleID, _ := getRoleIdAndResourceType(entitlement)
+	current, newPermissions, err := revokePermissions(ctx, client, principal, principalID, roleID)
 	if err != nil {
 		return nil, err
 	}
 
-	err = f.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, newPermissions)
+	err = f.provisioner.updatePermissions(ctx, client, principal, principalID, current, newPermissions)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"baton-segment: failed to remove permission from %s %s for function resource %s: %w",
@@ -156,9 +312,12 @@ func (f *functionResourceBuilder) Revoke(ctx context.Context, grant *v2.Grant) (
 	return nil, nil
 }
 
-func newFunctionBuilder(client *segment.Client) *functionResourceBuilder {
+func newFunctionBuilder(clients *workspaceClients, policy *ProvisioningPolicy, provisioner *provisioner, users *userCache) *functionResourceBuilder {
 	return &functionResourceBuilder{
 		resourceType: functionResourceType,
-		client:       client,
+		clients:      clients,
+		policy:       policy,
+		provisioner:  provisioner,
+		users:        users,
 	}
 }
@@ -2,7 +2,9 @@ package connector
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 	"github.com/conductorone/baton-sdk/pkg/annotations"
@@ -12,13 +14,19 @@ import (
 	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
 	"github.com/conductorone/baton-segment/pkg/segment"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
-	"github.com/iancoleman/strcase"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type groupBuilder struct {
 	resourceType *v2.ResourceType
-	client       *segment.Client
+	clients      *workspaceClients
+	syncTypes    resourceTypeSet
+	policy       *ProvisioningPolicy
+	provisioner  *provisioner
+	idp          *IdPManagement
+	orphans      *orphanSync
+	users        *userCache
 }
 
 const groupMembership = "member"
@@ -28,10 +36,11 @@ func (g *groupBuilder) ResourceType(ctx context.Context) *v2.ResourceType {
 }
 
 // Create a new connector resource for a Segment user group.
-func groupResource(group *segment.Group, parentResourceID *v2.ResourceId) (*v2.Resource, error) {
+func groupResource(group *segment.Group, parentResourceID *v2.ResourceId, idp *IdPManagement, clients *workspaceClients) (*v2.Resource, error) {
 	profile := map[string]interface{}{
-		"group_name": group.Name,
-		"group_id":   group.ID,
+		"group_name":  group.Name,
+		"group_id":    group.ID,
+		"idp_managed": idp.managesGroup(group.ID, group.Name),
 	}
 
 	groupTraitOptions := []rs.GroupTraitOption{
@@ -41,7 +50,7 @@ func groupResource(group *segment.Group, parentResourceID *v2.ResourceId) (*v2.R
 	ret, err := rs.NewGroupResource(
 		group.Name,
 		groupResourceType,
-		group.ID,
+		clients.scopedID(parentResourceID.Resource, group.ID),
 		groupTraitOptions,
 		rs.WithParentResourceID(parentResourceID),
 	)
@@ -64,7 +73,12 @@ func (g *groupBuilder) List(ctx context.Context, parentResourceID *v2.ResourceId
 		return nil, "", nil, err
 	}
 
-	groups, nextCursor, err := g.client.ListGroups(ctx, page)
+	client, err := g.clients.get(ctx, parentResourceID.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	groups, nextCursor, err := client.ListGroups(ctx, page)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -77,7 +91,7 @@ func (g *groupBuilder) List(ctx context.Context, parentResourceID *v2.ResourceId
 	var rv []*v2.Resource
 	for _, group := range groups {
 		groupCopy := group
-		gr, err := groupResource(&groupCopy, parentResourceID)
+		gr, err := groupResource(&groupCopy, parentResourceID, g.idp, g.clients)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -104,36 +118,83 @@ func (g *groupBuilder) Entitlements(_ context.Context, resource *v2.Resource, _
 	return rv, "", nil, nil
 }
 
-func (g *groupBuilder) Grants(ctx context.Context, resource *v2.Resource, pToken *pagination.Token) ([]*v2.Grant, string, annotations.Annotations, error) {
-	bag, page, err := parsePageToken(pToken.Token, &v2.ResourceId{ResourceType: userResourceType.Id})
+const (
+	// groupMembersPhase and groupPermissionsPhase are the phases of the grants of a group: its members are listed
+	// page by page, then its permissions are emitted once.
+	groupMembersPhase     = "group_members"
+	groupPermissionsPhase = "group_permissions"
+)
+
+// groupGrantsPage is the page token of the grants of a group. Listed is the number of members listed so far, checked
+// against the member count of the group once all pages are listed.
+type groupGrantsPage struct {
+	Phase  string `json:"phase"`
+	Cursor string `json:"cursor,omitempty"`
+	Listed int64  `json:"listed,omitempty"`
+}
+
+func parseGroupGrantsPage(token string) (*groupGrantsPage, error) {
+	if token == "" {
+		return &groupGrantsPage{Phase: groupMembersPhase}, nil
+	}
+
+	page := &groupGrantsPage{}
+	if err := json.Unmarshal([]byte(token), page); err != nil {
+		return nil, fmt.Errorf("baton-segment: invalid group grants page token: %w", err)
+	}
+
+	return page, nil
+}
+
+func (p *groupGrantsPage) marshal() (string, error) {
+	data, err := json.Marshal(p)
 	if err != nil {
-		return nil, "", nil, err
+		return "", err
 	}
 
-	group, err := g.client.GetGroup(ctx, resource.Id.Resource)
+	return string(data), nil
+}
+
+// Grants emits the members of the group page by page, then the permissions of the group in a separate phase.
+func (g *groupBuilder) Grants(ctx context.Context, resource *v2.Resource, pToken *pagination.Token) ([]*v2.Grant, string, annotations.Annotations, error) {
+	page, err := parseGroupGrantsPage(pToken.Token)
 	if err != nil {
 		return nil, "", nil, err
 	}
 
-	gr, err := groupResource(group, resource.ParentResourceId)
+	client, groupID, err := g.clients.forResource(ctx, resource.Id)
 	if err != nil {
-		return nil, "", nil, fmt.Errorf("error creating group resource for group %s: %w", resource.Id.Resource, err)
+		return nil, "", nil, err
 	}
 
-	users, nextToken, err := g.client.ListGroupMembers(ctx, resource.Id.Resource, page)
-	if err != nil {
-		return nil, "", nil, fmt.Errorf("failed to list group members: %w", err)
+	switch page.Phase {
+	case groupMembersPhase:
+		return g.memberGrants(ctx, client, resource, groupID, page)
+	case groupPermissionsPhase:
+		return g.groupPermissionGrants(ctx, client, resource, groupID, page.Listed)
+	default:
+		return nil, "", nil, fmt.Errorf("baton-segment: unexpected phase %s for group grants", page.Phase)
 	}
+}
 
-	pageToken, err := bag.NextToken(nextToken)
+// memberGrants emits a page of group members. After the last page, the number of members listed is passed on to
+// the permissions phase.
+func (g *groupBuilder) memberGrants(
+	ctx context.Context,
+	client *segment.Client,
+	resource *v2.Resource,
+	groupID string,
+	page *groupGrantsPage,
+) ([]*v2.Grant, string, annotations.Annotations, error) {
+	users, nextToken, err := client.ListGroupMembers(ctx, groupID, page.Cursor)
 	if err != nil {
-		return nil, "", nil, err
+		return nil, "", nil, fmt.Errorf("failed to list group members: %w", err)
 	}
 
 	var rv []*v2.Grant
 	for _, user := range users {
 		userCopy := user
-		ur, err := userResource(&userCopy, resource.Id)
+		ur, err := userResource(&userCopy, resource.ParentResourceId, g.idp, g.clients)
 		if err != nil {
 			return nil, "", nil, fmt.Errorf("error creating user resource for group %s: %w", resource.Id.Resource, err)
 		}
@@ -142,39 +203,83 @@ func (g *groupBuilder) Grants(ctx context.Context, resource *v2.Resource, pToken
 		rv = append(rv, gr)
 	}
 
-	for _, permission := range group.Permissions {
-		var role segment.Role
-		role.ID = permission.RoleID
-		role.Name = permission.RoleName
-		rr, err := roleResource(&role, resource.ParentResourceId)
-		if err != nil {
-			return nil, "", nil, fmt.Errorf("error creating role resource for group permissions")
-		}
+	next := &groupGrantsPage{Phase: groupMembersPhase, Cursor: nextToken, Listed: page.Listed + int64(len(users))}
+	if nextToken == "" {
+		next.Phase = groupPermissionsPhase
+	}
 
-		for _, r := range permission.Resources {
-			var roleResource segment.Resource
-			roleResource.ID = r.ID
-			roleResource.Type = r.Type
-			roleEntitlement := strcase.ToSnake(role.Name)
+	pageToken, err := next.marshal()
+	if err != nil {
+		return nil, "", nil, err
+	}
 
-			if r.Type == workspaceType {
-				rv = append(rv, grant.NewGrant(rr, roleMembership, gr.Id))
-				continue
-			}
+	return rv, pageToken, nil, nil
+}
 
-			resource, err := baseResource(roleResource, resource.ParentResourceId)
-			if err != nil {
-				return nil, "", nil, fmt.Errorf("error creating %s resource", r.Type)
-			}
+// groupPermissionGrants emits the permissions of the group, and checks the number of members listed against the member
+// count of the group. A warning annotation is added when Segment returned fewer members than the group has.
+func (g *groupBuilder) groupPermissionGrants(
+	ctx context.Context,
+	client *segment.Client,
+	resource *v2.Resource,
+	groupID string,
+	listed int64,
+) ([]*v2.Grant, string, annotations.Annotations, error) {
+	l := ctxzap.Extract(ctx)
 
-			rv = append(rv, grant.NewGrant(resource, roleEntitlement, gr.Id))
-		}
+	group, err := client.GetGroup(ctx, groupID)
+	if err != nil {
+		return nil, "", nil, err
 	}
 
-	return rv, pageToken, nil, nil
+	gr, err := groupResource(group, resource.ParentResourceId, g.idp, g.clients)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error creating group resource for group %s: %w", resource.Id.Resource, err)
+	}
+
+	permissions, orphaned, err := g.orphans.check(ctx, resource.ParentResourceId.Resource, gr.Id, group.Permissions)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	rv, err := permissionGrants(ctx, permissions, gr.Id, resource.ParentResourceId, g.syncTypes, g.clients)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	var annos annotations.Annotations
+	annos.Append(orphaned...)
+	switch {
+	case listed < group.MemberCount:
+		l.Warn(
+			"baton-segment: group membership list is truncated",
+			zap.String("group_id", groupID),
+			zap.Int64("member_count", group.MemberCount),
+			zap.Int64("listed_member_count", listed),
+		)
+		annos.Append(&structpb.Struct{
+			Fields: map[string]*structpb.Value{
+				"warning":             structpb.NewStringValue("group membership list is truncated"),
+				"group_id":            structpb.NewStringValue(groupID),
+				"member_count":        structpb.NewNumberValue(float64(group.MemberCount)),
+				"listed_member_count": structpb.NewNumberValue(float64(listed)),
+			},
+		})
+	case listed > group.MemberCount:
+		l.Debug(
+			"baton-segment: listed more group members than the member count of the group",
+			zap.String("group_id", groupID),
+			zap.Int64("member_count", group.MemberCount),
+			zap.Int64("listed_member_count", listed),
+		)
+	}
+
+	return rv, "", annos, nil
 }
 
 func (g *groupBuilder) Grant(ctx context.Context, principal *v2.Resource, entitlement *v2.Entitlement) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, grantTask(entitlement))
+
 	l := ctxzap.Extract(ctx)
 
 	if principal.Id.ResourceType != userResourceType.Id {
@@ -186,17 +291,32 @@ func (g *groupBuilder) Grant(ctx context.Context, principal *v2.Resource, entitl
 		return nil, fmt.Errorf("baton-segment: only users can be granted group membership")
 	}
 
-	userTrait, err := rs.GetUserTrait(principal)
+	if err := g.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+	if err := g.policy.checkPrincipal(entitlement.Resource); err != nil {
+		return nil, err
+	}
+
+	client, groupID, err := g.clients.forResource(ctx, entitlement.Resource.Id)
 	if err != nil {
 		return nil, err
 	}
 
-	userEmail, ok := rs.GetProfileStringValue(userTrait.Profile, "login")
-	if !ok {
+	if err := g.policy.checkGroupRoles(ctx, client, groupID); err != nil {
+		return nil, err
+	}
+
+	workspaceID, _ := splitWorkspaceScopedID(entitlement.Resource.Id.Resource)
+	userEmail, err := resolvePrincipalEmail(ctx, client, workspaceID, principal)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.idp.checkMembership(groupID, entitlement.Resource.DisplayName, userEmail); err != nil {
 		return nil, err
 	}
 
-	err = g.client.AddGroupMembers(ctx, entitlement.Resource.Id.Resource, userEmail)
+	err = g.provisioner.addGroupMembers(ctx, client, groupID, entitlement.Resource.DisplayName, principal, []string{userEmail})
 	if err != nil {
 		return nil, fmt.Errorf("baton-segment: failed to add user to group: %w", err)
 	}
@@ -205,6 +325,8 @@ func (g *groupBuilder) Grant(ctx context.Context, principal *v2.Resource, entitl
 }
 
 func (g *groupBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, revokeTask(grant))
+
 	l := ctxzap.Extract(ctx)
 
 	entitlement := grant.Entitlement
@@ -219,17 +341,35 @@ func (g *groupBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations
 		return nil, fmt.Errorf("baton-segment: only users can have group membership revoked")
 	}
 
-	userTrait, err := rs.GetUserTrait(principal)
+	if err := g.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+	if err := g.policy.checkPrincipal(entitlement.Resource); err != nil {
+		return nil, err
+	}
+
+	client, groupID, userID, err := g.clients.forGrant(ctx, entitlement.Resource.Id, principal)
 	if err != nil {
 		return nil, err
 	}
 
-	userEmail, ok := rs.GetProfileStringValue(userTrait.Profile, "login")
-	if !ok {
+	workspaceID, err := g.clients.workspaceOf(ctx, entitlement.Resource.Id.Resource)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.policy.checkOwnerCount(ctx, client, workspaceID, g.users, ownerChange{groupID: groupID, memberIDs: []string{userID}}); err != nil {
 		return nil, err
 	}
 
-	err = g.client.RemoveGroupMember(ctx, entitlement.Resource.Id.Resource, userEmail)
+	userEmail, err := resolvePrincipalEmail(ctx, client, workspaceID, principal)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.idp.checkMembership(groupID, entitlement.Resource.DisplayName, userEmail); err != nil {
+		return nil, err
+	}
+
+	err = g.provisioner.removeGroupMembers(ctx, client, groupID, entitlement.Resource.DisplayName, principal, []string{userEmail})
 	if err != nil {
 		return nil, fmt.Errorf("baton-segment: failed to revoke group membership for user: %s: %w", principal.Id, err)
 	}
@@ -237,9 +377,47 @@ func (g *groupBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations
 	return nil, nil
 }
 
-func newGroupBuilder(client *segment.Client) *groupBuilder {
+// remainingGroupMembers returns the emails that still belong to members of the group.
+func remainingGroupMembers(ctx context.Context, client *segment.Client, groupID string, emails []string) ([]string, error) {
+	var rv []string
+	err := paginate(
+		ctx,
+		func(ctx context.Context, cursor string) ([]segment.User, string, error) {
+			return client.ListGroupMembers(ctx, groupID, cursor)
+		},
+		func(member segment.User) error {
+			for _, email := range emails {
+				if strings.EqualFold(member.Email, email) {
+					rv = append(rv, email)
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+func newGroupBuilder(
+	clients *workspaceClients,
+	syncTypes resourceTypeSet,
+	policy *ProvisioningPolicy,
+	provisioner *provisioner,
+	idp *IdPManagement,
+	orphans *orphanSync,
+	users *userCache,
+) *groupBuilder {
 	return &groupBuilder{
 		resourceType: groupResourceType,
-		client:       client,
+		clients:      clients,
+		syncTypes:    syncTypes,
+		policy:       policy,
+		provisioner:  provisioner,
+		idp:          idp,
+		orphans:      orphans,
+		users:        users,
 	}
 }
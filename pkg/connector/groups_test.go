@@ -0,0 +1,167 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-sdk/pkg/annotations"
+	"github.com/conductorone/baton-sdk/pkg/pagination"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// groupMembersPage is a page of members of the test group, listed at cursor.
+type groupMembersPage struct {
+	cursor  string
+	userIDs []string
+	next    string
+}
+
+func (p groupMembersPage) response() string {
+	users := make([]string, 0, len(p.userIDs))
+	for _, id := range p.userIDs {
+		users = append(users, fmt.Sprintf(`{"id":%q,"name":%q,"email":"%s@example.com"}`, id, id, id))
+	}
+
+	return fmt.Sprintf(`{"data":{"users":[%s],"pagination":{"current":%q,"next":%q}}}`, strings.Join(users, ","), p.cursor, p.next)
+}
+
+func TestGroupGrantsPagination(t *testing.T) {
+	type page struct {
+		grants    int
+		truncated bool
+	}
+
+	tests := []struct {
+		name        string
+		memberPages []groupMembersPage
+		memberCount int64
+		// pages are the grants expected from each call, the member pages followed by the permissions.
+		pages []page
+	}{
+		{
+			name: "members on several pages",
+			memberPages: []groupMembersPage{
+				{userIDs: []string{"u1", "u2"}, next: "c2"},
+				{cursor: "c2", userIDs: []string{"u3"}},
+			},
+			memberCount: 3,
+			pages:       []page{{grants: 2}, {grants: 1}, {grants: 1}},
+		},
+		{
+			name:        "no members",
+			memberPages: []groupMembersPage{{}},
+			pages:       []page{{grants: 0}, {grants: 1}},
+		},
+		{
+			name:        "truncated member list",
+			memberPages: []groupMembersPage{{userIDs: []string{"u1"}}},
+			memberCount: 2,
+			pages:       []page{{grants: 1}, {grants: 1, truncated: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			fake.handle(http.MethodGet, "/groups/g1/users", func(w http.ResponseWriter, r *http.Request) {
+				cursor := r.URL.Query().Get("pagination[cursor]")
+				for _, p := range tt.memberPages {
+					if p.cursor == cursor {
+						respondJSON(p.response())(w, r)
+						return
+					}
+				}
+				t.Errorf("unexpected group members cursor %q", cursor)
+			})
+			fake.handle(http.MethodGet, "/groups/g1", respondJSON(fmt.Sprintf(
+				`{"data":{"group":{"id":"g1","name":"Group","memberCount":%d,"permissions":[{"roleId":"r1","roleName":"Workspace Owner","resources":[{"id":%q,"type":"WORKSPACE"}]}]}}}`,
+				tt.memberCount,
+				testWorkspaceID,
+			)))
+
+			clients := fake.clients()
+			syncTypes := resourceTypeSet{
+				userResourceType.Id:      true,
+				groupResourceType.Id:     true,
+				roleResourceType.Id:      true,
+				workspaceResourceType.Id: true,
+			}
+			builder := newGroupBuilder(clients, syncTypes, nil, nil, &IdPManagement{}, newOrphanSync(clients, syncTypes), nil)
+			resource := &v2.Resource{
+				Id:               &v2.ResourceId{ResourceType: groupResourceType.Id, Resource: "g1"},
+				ParentResourceId: &v2.ResourceId{ResourceType: workspaceResourceType.Id, Resource: testWorkspaceID},
+				DisplayName:      "Group",
+			}
+
+			ctx := context.Background()
+			token := &pagination.Token{}
+			for i, want := range tt.pages {
+				grants, nextToken, annos, err := builder.Grants(ctx, resource, token)
+				if err != nil {
+					t.Fatalf("page %d: %v", i+1, err)
+				}
+				if len(grants) != want.grants {
+					t.Errorf("page %d has %d grants, want %d", i+1, len(grants), want.grants)
+				}
+				if truncated := hasTruncationWarning(t, annos); truncated != want.truncated {
+					t.Errorf("page %d truncation warning = %v, want %v", i+1, truncated, want.truncated)
+				}
+
+				last := i == len(tt.pages)-1
+				if last != (nextToken == "") {
+					t.Fatalf("page %d next token = %q, want an empty token only after the permissions", i+1, nextToken)
+				}
+				token = &pagination.Token{Token: nextToken}
+			}
+
+			var memberRequests int
+			for _, request := range fake.requested() {
+				if strings.HasPrefix(request, "GET /groups/g1/users") {
+					memberRequests++
+				}
+			}
+			if memberRequests != len(tt.memberPages) {
+				t.Errorf("listed %d member pages, want %d", memberRequests, len(tt.memberPages))
+			}
+		})
+	}
+}
+
+func TestGroupGrantsInvalidToken(t *testing.T) {
+	fake := newFakeSegment(t)
+	clients := fake.clients()
+	builder := newGroupBuilder(clients, resourceTypeSet{}, nil, nil, &IdPManagement{}, newOrphanSync(clients, resourceTypeSet{}), nil)
+	resource := &v2.Resource{
+		Id:               &v2.ResourceId{ResourceType: groupResourceType.Id, Resource: "g1"},
+		ParentResourceId: &v2.ResourceId{ResourceType: workspaceResourceType.Id, Resource: testWorkspaceID},
+	}
+
+	for _, token := range []string{`{"phase":"unknown"}`, "not json"} {
+		if _, _, _, err := builder.Grants(context.Background(), resource, &pagination.Token{Token: token}); err == nil {
+			t.Errorf("Grants() accepted the page token %s", token)
+		}
+	}
+}
+
+func hasTruncationWarning(t *testing.T, annos annotations.Annotations) bool {
+	t.Helper()
+
+	for _, a := range annos {
+		warning := &structpb.Struct{}
+		if !a.MessageIs(warning) {
+			continue
+		}
+		if err := a.UnmarshalTo(warning); err != nil {
+			t.Fatal(err)
+		}
+		if warning.Fields["warning"].GetStringValue() == "group membership list is truncated" {
+			return true
+		}
+	}
+
+	return false
+}
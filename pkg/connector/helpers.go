@@ -8,6 +8,7 @@ import (
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 	"github.com/conductorone/baton-sdk/pkg/pagination"
 	ent "github.com/conductorone/baton-sdk/pkg/types/entitlement"
+	grant "github.com/conductorone/baton-sdk/pkg/types/grant"
 	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
 	"github.com/conductorone/baton-segment/pkg/segment"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
@@ -32,32 +33,47 @@ func parsePageToken(i string, resourceID *v2.ResourceId) (*pagination.Bag, strin
 	return b, b.PageToken(), nil
 }
 
-func grantPermissions(ctx context.Context, client *segment.Client, principal *v2.Resource, roleID, resourceType, resourceID string) ([]segment.Permission, error) {
+// getPermissions returns the current permissions of a user or a group.
+func getPermissions(ctx context.Context, client *segment.Client, principal *v2.Resource, principalID string) ([]segment.Permission, error) {
 	l := ctxzap.Extract(ctx)
-	var permissions []segment.Permission
 
 	switch principal.Id.ResourceType {
 	case userResourceType.Id:
-		user, err := client.GetUser(ctx, principal.Id.Resource)
+		user, err := client.GetUser(ctx, principalID)
 		if err != nil {
-			return nil, fmt.Errorf("baton-segment: failed to get user info while granting permission: %w", err)
+			return nil, fmt.Errorf("baton-segment: failed to get user info: %w", err)
 		}
-		permissions = user.Permissions
+		return user.Permissions, nil
 	case groupResourceType.Id:
-		group, err := client.GetGroup(ctx, principal.Id.Resource)
+		group, err := client.GetGroup(ctx, principalID)
 		if err != nil {
-			return nil, fmt.Errorf("baton-segment: failed to get group info while granting permission: %w", err)
+			return nil, fmt.Errorf("baton-segment: failed to get group info: %w", err)
 		}
-		permissions = group.Permissions
+		return group.Permissions, nil
 	default:
 		l.Warn(
-			"baton-segment: only users and groups can be granted permissions",
+			"baton-segment: only users and groups can have permissions",
 			zap.String("principal_type", principal.Id.ResourceType),
 			zap.String("principal_id", principal.Id.Resource),
 		)
-		return nil, fmt.Errorf("baton-segment: only users and groups can be granted permissions")
+		return nil, fmt.Errorf("baton-segment: only users and groups can have permissions")
+	}
+}
+
+// grantPermissions returns the current permissions of the principal, and the permissions with the role granted on the resource.
+func grantPermissions(
+	ctx context.Context,
+	client *segment.Client,
+	principal *v2.Resource,
+	principalID, roleID, resourceType, resourceID string,
+) ([]segment.Permission, []segment.Permission, error) {
+	current, err := getPermissions(ctx, client, principal, principalID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("baton-segment: failed to get permissions while granting permission: %w", err)
 	}
 
+	permissions := make([]segment.Permission, 0, len(current)+1)
+	permissions = append(permissions, current...)
 	permissions = append(permissions, segment.Permission{
 		RoleID: roleID,
 		Resources: []segment.Resource{
@@ -65,44 +81,29 @@ func grantPermissions(ctx context.Context, client *segment.Client, principal *v2
 		},
 	})
 
-	return permissions, nil
+	return current, permissions, nil
 }
 
-func revokePermissions(ctx context.Context, client *segment.Client, principal *v2.Resource, roleID string) ([]segment.Permission, error) {
-	var newPermissions []segment.Permission
-	l := ctxzap.Extract(ctx)
+// revokePermissions returns the current permissions of the principal, and the permissions without the role.
+func revokePermissions(
+	ctx context.Context,
+	client *segment.Client,
+	principal *v2.Resource,
+	principalID, roleID string,
+) ([]segment.Permission, []segment.Permission, error) {
+	current, err := getPermissions(ctx, client, principal, principalID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("baton-segment: failed to get permissions while revoking role: %w", err)
+	}
 
-	switch principal.Id.ResourceType {
-	case userResourceType.Id:
-		user, err := client.GetUser(ctx, principal.Id.Resource)
-		if err != nil {
-			return nil, fmt.Errorf("baton-segment: failed to get user info while revoking role: %w", err)
-		}
-		for _, permission := range user.Permissions {
-			if permission.RoleID != roleID {
-				newPermissions = append(newPermissions, permission)
-			}
-		}
-	case groupResourceType.Id:
-		group, err := client.GetGroup(ctx, principal.Id.Resource)
-		if err != nil {
-			return nil, fmt.Errorf("baton-segment: failed to get group info while revoking role: %w", err)
-		}
-		for _, permission := range group.Permissions {
-			if permission.RoleID != roleID {
-				newPermissions = append(newPermissions, permission)
-			}
+	var newPermissions []segment.Permission
+	for _, permission := range current {
+		if permission.RoleID != roleID {
+			newPermissions = append(newPermissions, permission)
 		}
-	default:
-		l.Warn(
-			"baton-segment: only users and groups can have permissions revoked",
-			zap.String("principal_type", principal.Id.ResourceType),
-			zap.String("principal_id", principal.Id.Resource),
-		)
-		return nil, fmt.Errorf("baton-segment: only users and groups can have permissions revoked")
 	}
 
-	return newPermissions, nil
+	return current, newPermissions, nil
 }
 
 func createEntitlement(role segment.Role, resource *v2.Resource) *v2.Entitlement {
@@ -130,12 +131,32 @@ func getRoleIdAndResourceType(entitlement *v2.Entitlement) (string, string) {
 	return roleID, resourceType
 }
 
+// permissionResourceTypes maps the Segment resource types used in permissions to connector resource types.
+// Workspace-wide permissions are granted on the role itself.
+var permissionResourceTypes = map[string]*v2.ResourceType{
+	workspaceType: roleResourceType,
+	sourceType:    sourceResourceType,
+	warehouseType: warehouseResourceType,
+	functionType:  functionResourceType,
+	spaceType:     spaceResourceType,
+}
+
+// getRoleName returns the name of the role stored in the entitlement description.
+func getRoleName(entitlement *v2.Entitlement) string {
+	return strings.Split(entitlement.Description, ":")[0]
+}
+
 // baseResource used to create resource associated with a role.
-func baseResource(resource segment.Resource, parentResourceID *v2.ResourceId) (*v2.Resource, error) {
+func baseResource(resource segment.Resource, parentResourceID *v2.ResourceId, clients *workspaceClients) (*v2.Resource, error) {
+	resourceType, ok := permissionResourceTypes[resource.Type]
+	if !ok {
+		return nil, fmt.Errorf("baton-segment: unsupported permission resource type %s", resource.Type)
+	}
+
 	ret, err := rs.NewResource(
 		resource.Type,
-		functionResourceType,
-		resource.ID,
+		resourceType,
+		clients.scopedID(parentResourceID.Resource, resource.ID),
 		rs.WithParentResourceID(parentResourceID),
 	)
 	if err != nil {
@@ -144,3 +165,56 @@ func baseResource(resource segment.Resource, parentResourceID *v2.ResourceId) (*
 
 	return ret, nil
 }
+
+// permissionGrants creates the grants for the permissions of a user or a group. Permissions on resources of
+// types that aren't synced are skipped, since the grants would point to resources missing from the sync.
+func permissionGrants(
+	ctx context.Context,
+	permissions []segment.Permission,
+	principalID *v2.ResourceId,
+	workspaceID *v2.ResourceId,
+	syncTypes resourceTypeSet,
+	clients *workspaceClients,
+) ([]*v2.Grant, error) {
+	l := ctxzap.Extract(ctx)
+
+	var rv []*v2.Grant
+	for _, p := range permissions {
+		var role segment.Role
+		role.ID = p.RoleID
+		role.Name = p.RoleName
+		rr, err := roleResource(&role, workspaceID, clients)
+		if err != nil {
+			return nil, fmt.Errorf("error creating role resource for %s permissions", principalID.ResourceType)
+		}
+
+		roleEntitlement := strcase.ToSnake(role.Name)
+		for _, r := range p.Resources {
+			resourceType, ok := permissionResourceTypes[r.Type]
+			if !ok || !syncTypes.has(resourceType.Id) {
+				l.Debug(
+					"baton-segment: skipping permission on resource type that is not synced",
+					zap.String("principal_id", principalID.Resource),
+					zap.String("role_id", p.RoleID),
+					zap.String("resource_type", r.Type),
+					zap.String("resource_id", r.ID),
+				)
+				continue
+			}
+
+			if r.Type == workspaceType {
+				rv = append(rv, grant.NewGrant(rr, roleMembership, principalID))
+				continue
+			}
+
+			resource, err := baseResource(r, workspaceID, clients)
+			if err != nil {
+				return nil, fmt.Errorf("error creating %s resource", r.Type)
+			}
+
+			rv = append(rv, grant.NewGrant(resource, roleEntitlement, principalID))
+		}
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,89 @@
+package connector
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// IdPManagement identifies the users and groups an identity provider manages in Segment through SCIM. Changes made
+// to their group memberships outside the identity provider are reverted on its next push. The users and groups of
+// Segment's Public API have no field telling whether they were provisioned through SCIM, so the configured groups and
+// email domains are how managed users and groups are identified: nothing else is checked, and nothing is managed when
+// both are empty.
+type IdPManagement struct {
+	// Name is the name of the identity provider, used in errors.
+	Name string
+	// Groups are the IDs or names of the groups pushed by the identity provider.
+	Groups []string
+	// EmailDomains are the email domains of the users provisioned by the identity provider.
+	EmailDomains []string
+	// AllowChanges allows changing the group memberships of managed users and groups anyway.
+	AllowChanges bool
+}
+
+func (m *IdPManagement) providerName() string {
+	if m.Name == "" {
+		return "the identity provider"
+	}
+
+	return m.Name
+}
+
+// managesGroup returns whether the group with the given ID and name is pushed by the identity provider.
+func (m *IdPManagement) managesGroup(groupID, groupName string) bool {
+	for _, group := range m.Groups {
+		if group == groupID || strings.EqualFold(group, groupName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// managesUser returns whether the user with the given email is provisioned by the identity provider.
+func (m *IdPManagement) managesUser(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	for _, domain := range m.EmailDomains {
+		if strings.EqualFold(strings.TrimPrefix(domain, "@"), email[at+1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkMembership denies changing the membership of a user in a group when either is managed by the identity
+// provider, unless changes are allowed.
+func (m *IdPManagement) checkMembership(groupID, groupName, email string) error {
+	if m.AllowChanges {
+		return nil
+	}
+
+	if m.managesGroup(groupID, groupName) {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"baton-segment: group %s is managed by %s through SCIM, change its members in %s instead",
+			groupName,
+			m.providerName(),
+			m.providerName(),
+		)
+	}
+
+	if m.managesUser(email) {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"baton-segment: user %s is managed by %s through SCIM, change their group memberships in %s instead",
+			email,
+			m.providerName(),
+			m.providerName(),
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package connector
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestManagesGroup(t *testing.T) {
+	idp := &IdPManagement{Groups: []string{"g-engineering", "Analytics"}}
+
+	tests := []struct {
+		groupID   string
+		groupName string
+		want      bool
+	}{
+		{groupID: "g-engineering", groupName: "Engineering", want: true},
+		{groupID: "g-analytics", groupName: "analytics", want: true},
+		{groupID: "g-sales", groupName: "Sales"},
+		{groupID: "G-ENGINEERING", groupName: "Platform"},
+	}
+
+	for _, tt := range tests {
+		if got := idp.managesGroup(tt.groupID, tt.groupName); got != tt.want {
+			t.Errorf("managesGroup(%s, %s) = %v, want %v", tt.groupID, tt.groupName, got, tt.want)
+		}
+	}
+}
+
+func TestManagesUser(t *testing.T) {
+	idp := &IdPManagement{EmailDomains: []string{"example.com", "@Corp.example"}}
+
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{email: "jane@example.com", want: true},
+		{email: "Jane@EXAMPLE.COM", want: true},
+		{email: "jane@corp.example", want: true},
+		{email: "jane@sub.example.com"},
+		{email: "jane@example.com.evil"},
+		{email: "example.com"},
+		{email: ""},
+	}
+
+	for _, tt := range tests {
+		if got := idp.managesUser(tt.email); got != tt.want {
+			t.Errorf("managesUser(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMembership(t *testing.T) {
+	managed := IdPManagement{Name: "Okta", Groups: []string{"Engineering"}, EmailDomains: []string{"example.com"}}
+	allowed := managed
+	allowed.AllowChanges = true
+
+	tests := []struct {
+		name      string
+		idp       IdPManagement
+		groupName string
+		email     string
+		wantErr   bool
+	}{
+		{name: "managed group", idp: managed, groupName: "Engineering", email: "jane@other.example", wantErr: true},
+		{name: "managed user", idp: managed, groupName: "Sales", email: "jane@example.com", wantErr: true},
+		{name: "unmanaged group and user", idp: managed, groupName: "Sales", email: "jane@other.example"},
+		{name: "changes allowed", idp: allowed, groupName: "Engineering", email: "jane@example.com"},
+		{name: "nothing configured", groupName: "Engineering", email: "jane@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.idp.checkMembership("g1", tt.groupName, tt.email)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.FailedPrecondition {
+				t.Fatalf("checkMembership() error = %v, want a FailedPrecondition error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package connector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// journalGenesisHash is the previous hash of the first record of a journal.
+const journalGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// journal appends a record of every change made in Segment to a JSONL file. Every record holds the hash of the
+// record before it, so removing or editing a record breaks the chain. The connector and the subcommands can share
+// a journal, so the file is locked while a record is chained to the last one and written.
+type journal struct {
+	mu   sync.Mutex
+	path string
+}
+
+// journalRecord is a line of the journal.
+type journalRecord struct {
+	Timestamp time.Time            `json:"timestamp"`
+	Operation string               `json:"operation"`
+	Task      *provisioningTask    `json:"task,omitempty"`
+	Principal *journalPrincipal    `json:"principal,omitempty"`
+	TargetID  string               `json:"target_id,omitempty"`
+	Emails    []string             `json:"emails,omitempty"`
+	Before    []segment.Permission `json:"before,omitempty"`
+	After     []segment.Permission `json:"after,omitempty"`
+	Status    int                  `json:"status"`
+	Error     string               `json:"error,omitempty"`
+	PrevHash  string               `json:"prev_hash"`
+	Hash      string               `json:"hash,omitempty"`
+}
+
+type journalPrincipal struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	SegmentID   string `json:"segment_id"`
+	DisplayName string `json:"display_name"`
+}
+
+func newJournalPrincipal(principal *v2.Resource, segmentID string) *journalPrincipal {
+	if principal == nil {
+		return nil
+	}
+
+	return &journalPrincipal{
+		Type:        principal.Id.ResourceType,
+		ID:          principal.Id.Resource,
+		SegmentID:   segmentID,
+		DisplayName: principal.DisplayName,
+	}
+}
+
+// provisioningTask is the baton request a change is made for.
+type provisioningTask struct {
+	Action        string `json:"action"`
+	EntitlementID string `json:"entitlement_id,omitempty"`
+	GrantID       string `json:"grant_id,omitempty"`
+	ResourceID    string `json:"resource_id,omitempty"`
+}
+
+type provisioningTaskKey struct{}
+
+// withProvisioningTask returns a context holding the baton request the changes made with it are for.
+func withProvisioningTask(ctx context.Context, task *provisioningTask) context.Context {
+	return context.WithValue(ctx, provisioningTaskKey{}, task)
+}
+
+func provisioningTaskFromContext(ctx context.Context) *provisioningTask {
+	task, _ := ctx.Value(provisioningTaskKey{}).(*provisioningTask)
+	return task
+}
+
+func grantTask(entitlement *v2.Entitlement) *provisioningTask {
+	return &provisioningTask{Action: "grant", EntitlementID: entitlement.Id}
+}
+
+func revokeTask(grant *v2.Grant) *provisioningTask {
+	return &provisioningTask{Action: "revoke", EntitlementID: grant.Entitlement.Id, GrantID: grant.Id}
+}
+
+// newJournal opens the journal at path, checking the hash chain of the records already in it.
+func newJournal(path string) (*journal, error) {
+	unlock, err := lockJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := verifyJournal(path); err != nil {
+		return nil, err
+	}
+
+	return &journal{path: path}, nil
+}
+
+// lockJournal locks the journal at path until the returned function is called.
+func lockJournal(path string) (func(), error) {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to lock audit journal: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// verifyJournal checks the hash chain of the journal at path, and returns the hash of its last record.
+func verifyJournal(path string) (string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return journalGenesisHash, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("baton-segment: failed to open audit journal: %w", err)
+	}
+	defer f.Close()
+
+	lastHash := journalGenesisHash
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// records are written with their newline at once, so a last line without one is a write that was
+			// interrupted, not a record.
+			if len(data) > 0 {
+				return "", fmt.Errorf("baton-segment: audit journal record %d is incomplete, the write was interrupted", line)
+			}
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("baton-segment: failed to read audit journal: %w", err)
+		}
+
+		var record journalRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return "", fmt.Errorf("baton-segment: audit journal record %d is invalid: %w", line, err)
+		}
+
+		if record.PrevHash != lastHash {
+			return "", fmt.Errorf("baton-segment: audit journal record %d doesn't follow the previous record", line)
+		}
+
+		hash, err := record.hash()
+		if err != nil {
+			return "", err
+		}
+		if hash != record.Hash {
+			return "", fmt.Errorf("baton-segment: audit journal record %d was modified", line)
+		}
+
+		lastHash = record.Hash
+	}
+
+	return lastHash, nil
+}
+
+// hash returns the SHA-256 hash of the record without its own hash.
+func (r journalRecord) hash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// append chains the record to the last one of the journal and writes it to the end of the journal. The last
+// record is read again under the lock, as other processes may have appended records since the journal was opened.
+func (j *journal) append(ctx context.Context, record journalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	unlock, err := lockJournal(j.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to open audit journal: %w", err)
+	}
+	defer f.Close()
+
+	prevHash, err := lastJournalHash(f)
+	if err != nil {
+		return err
+	}
+
+	record.Timestamp = time.Now().UTC()
+	record.Task = provisioningTaskFromContext(ctx)
+	record.PrevHash = prevHash
+
+	hash, err := record.hash()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("baton-segment: failed to write audit journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("baton-segment: failed to write audit journal: %w", err)
+	}
+
+	return nil
+}
+
+// lastJournalHash returns the hash of the last record of the journal file, read backwards from its end.
+func lastJournalHash(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("baton-segment: failed to read audit journal: %w", err)
+	}
+	size := info.Size()
+	if size == 0 {
+		return journalGenesisHash, nil
+	}
+
+	// the last record starts after the newline ending the one before it, or at the start of the file.
+	var line []byte
+	chunk := make([]byte, 4096)
+	for end := size; ; {
+		start := end - int64(len(chunk))
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(chunk[:end-start], start)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("baton-segment: failed to read audit journal: %w", err)
+		}
+		line = append(append([]byte{}, chunk[:n]...), line...)
+
+		if len(line) > 0 && line[len(line)-1] != '\n' {
+			return "", fmt.Errorf("baton-segment: last audit journal record is incomplete, the write was interrupted")
+		}
+		if i := bytes.LastIndexByte(line[:len(line)-1], '\n'); i >= 0 {
+			line = line[i+1:]
+			break
+		}
+		if start == 0 {
+			break
+		}
+		end = start
+	}
+
+	var record journalRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return "", fmt.Errorf("baton-segment: last audit journal record is invalid: %w", err)
+	}
+	hash, err := record.hash()
+	if err != nil {
+		return "", err
+	}
+	if hash != record.Hash {
+		return "", fmt.Errorf("baton-segment: last audit journal record was modified")
+	}
+
+	return record.Hash, nil
+}
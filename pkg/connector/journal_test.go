@@ -0,0 +1,236 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// writeTestJournal appends a record for every operation to a new journal, and returns its path and lines.
+func writeTestJournal(t *testing.T, operations ...string) (string, [][]byte) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := newJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := withProvisioningTask(context.Background(), &provisioningTask{Action: "grant", EntitlementID: "role:r1:member"})
+	for _, operation := range operations {
+		record := journalRecord{
+			Operation: operation,
+			After:     []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{{ID: "ws", Type: workspaceType}}}},
+			Status:    200,
+		}
+		if err := j.append(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, bytes.SplitAfter(data, []byte("\n"))
+}
+
+func rewriteJournal(t *testing.T, path string, lines [][]byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, bytes.Join(lines, nil), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalChain(t *testing.T) {
+	path, lines := writeTestJournal(t, "update_permissions", "add_group_members", "remove_group_members")
+
+	lastHash, err := verifyJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevHash := journalGenesisHash
+	for i, line := range lines[:3] {
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.PrevHash != prevHash {
+			t.Errorf("record %d prev_hash = %s, want %s", i+1, record.PrevHash, prevHash)
+		}
+		if record.Task == nil || record.Task.Action != "grant" {
+			t.Errorf("record %d task = %v, want the grant of the context", i+1, record.Task)
+		}
+		prevHash = record.Hash
+	}
+	if lastHash != prevHash {
+		t.Errorf("last hash = %s, want %s", lastHash, prevHash)
+	}
+
+	// a reopened journal continues the chain.
+	j, err := newJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.append(context.Background(), journalRecord{Operation: "delete_user"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyJournal(path); err != nil {
+		t.Errorf("journal appended after reopening is invalid: %v", err)
+	}
+}
+
+func TestJournalSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	first, err := newJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the journals are opened before either is written to, as by two processes sharing the file.
+	var wg sync.WaitGroup
+	for _, j := range []*journal{first, second, first, second} {
+		wg.Add(1)
+		go func(j *journal) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := j.append(context.Background(), journalRecord{Operation: "update_permissions"}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(j)
+	}
+	wg.Wait()
+
+	if _, err := verifyJournal(path); err != nil {
+		t.Fatalf("journal shared by two writers is invalid: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 40 {
+		t.Errorf("journal holds %d records, want 40", lines)
+	}
+	if _, err := newJournal(path); err != nil {
+		t.Errorf("newJournal() refused the shared journal: %v", err)
+	}
+}
+
+func TestJournalLongRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := newJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// records longer than a read of the end of the journal are chained too.
+	emails := make([]string, 1000)
+	for i := range emails {
+		emails[i] = "user@example.com"
+	}
+	for _, record := range []journalRecord{{Operation: "add_group_members", Emails: emails}, {Operation: "update_permissions"}} {
+		if err := j.append(context.Background(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := verifyJournal(path); err != nil {
+		t.Errorf("journal with a long record is invalid: %v", err)
+	}
+}
+
+func TestJournalMissing(t *testing.T) {
+	lastHash, err := verifyJournal(filepath.Join(t.TempDir(), "missing.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastHash != journalGenesisHash {
+		t.Errorf("last hash of a missing journal = %s, want the genesis hash", lastHash)
+	}
+}
+
+func TestJournalTampering(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(lines [][]byte) [][]byte
+		wantErr string
+	}{
+		{
+			name: "modified record",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`"status":200`), []byte(`"status":500`), 1)
+				return lines
+			},
+			wantErr: "record 2 was modified",
+		},
+		{
+			name: "removed record",
+			tamper: func(lines [][]byte) [][]byte {
+				return append(lines[:1], lines[2:]...)
+			},
+			wantErr: "record 2 doesn't follow the previous record",
+		},
+		{
+			name: "reordered records",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[0], lines[1] = lines[1], lines[0]
+				return lines
+			},
+			wantErr: "record 1 doesn't follow the previous record",
+		},
+		{
+			name: "invalid record",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[2] = []byte("not json\n")
+				return lines
+			},
+			wantErr: "record 3 is invalid",
+		},
+		{
+			name: "torn final line",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[2] = lines[2][:len(lines[2])/2]
+				return lines
+			},
+			wantErr: "record 3 is incomplete",
+		},
+		{
+			name: "final record without its newline",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[2] = bytes.TrimSuffix(lines[2], []byte("\n"))
+				return lines
+			},
+			wantErr: "record 3 is incomplete",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, lines := writeTestJournal(t, "update_permissions", "add_group_members", "remove_group_members")
+			rewriteJournal(t, path, tt.tamper(lines))
+
+			_, err := verifyJournal(path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verifyJournal() error = %v, want %q", err, tt.wantErr)
+			}
+			if _, err := newJournal(path); err == nil {
+				t.Error("newJournal() opened a broken journal")
+			}
+		})
+	}
+}
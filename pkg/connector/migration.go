@@ -0,0 +1,245 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// GroupMigrationOptions select the direct permissions moved to groups.
+type GroupMigrationOptions struct {
+	// MinMembers is the number of users that must hold the same permissions for a group to be proposed. Users
+	// holding the same permissions as an existing group are always proposed.
+	MinMembers int
+	// GroupPrefix is prepended to the names of the proposed new groups.
+	GroupPrefix string
+}
+
+// GroupMigration proposes groups for the users of a workspace holding the same direct permissions.
+type GroupMigration struct {
+	WorkspaceID   string          `json:"workspace_id"`
+	WorkspaceName string          `json:"workspace_name"`
+	Proposals     []GroupProposal `json:"proposals"`
+	Skipped       []MigrationSkip `json:"skipped,omitempty"`
+	client        *segment.Client
+}
+
+// GroupProposal moves the identical direct permissions of users to a group, new or existing, the users become
+// members of.
+type GroupProposal struct {
+	Group string `json:"group"`
+	// GroupID is the ID of the existing group holding the permissions, empty for a new group.
+	GroupID     string   `json:"group_id,omitempty"`
+	Permissions []string `json:"permissions"`
+	Members     []string `json:"members"`
+
+	permissions []segment.Permission
+	users       []segment.User
+	// alreadyMembers are the emails of the users already members of the existing group.
+	alreadyMembers []string
+}
+
+// MigrationSkip is a user whose direct permissions can't be moved to a group.
+type MigrationSkip struct {
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+}
+
+// GroupMigrations analyses the direct permissions of the users of every configured workspace and proposes a group
+// for every set of identical permissions, an existing group holding exactly these permissions or a new one.
+func (s *Segment) GroupMigrations(ctx context.Context, opts GroupMigrationOptions) ([]*GroupMigration, error) {
+	snapshots, err := s.snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []*GroupMigration
+	for _, snapshot := range snapshots {
+		rv = append(rv, s.groupMigration(snapshot, opts))
+	}
+
+	return rv, nil
+}
+
+func (s *Segment) groupMigration(snapshot *iamSnapshot, opts GroupMigrationOptions) *GroupMigration {
+	migration := &GroupMigration{
+		WorkspaceID:   snapshot.workspace.ID,
+		WorkspaceName: snapshot.workspace.Name,
+		client:        snapshot.client,
+	}
+
+	names := make(map[string]bool)
+	existing := make(map[string]*segment.Group)
+	for i, group := range snapshot.groups {
+		names[strings.ToLower(group.Name)] = true
+		if len(group.Permissions) == 0 || s.idp.managesGroup(group.ID, group.Name) {
+			continue
+		}
+		if key := permissionKey(group.Permissions); existing[key] == nil {
+			existing[key] = &snapshot.groups[i]
+		}
+	}
+
+	clusters := make(map[string]*GroupProposal)
+	var keys []string
+	for _, user := range snapshot.users {
+		if len(user.Permissions) == 0 {
+			continue
+		}
+		if reason := s.migrationSkipReason(snapshot, user); reason != "" {
+			migration.Skipped = append(migration.Skipped, MigrationSkip{Email: user.Email, Reason: reason})
+			continue
+		}
+
+		key := permissionKey(user.Permissions)
+		proposal, ok := clusters[key]
+		if !ok {
+			added, _ := diffPermissions(nil, user.Permissions)
+			proposal = &GroupProposal{Permissions: added, permissions: user.Permissions}
+			clusters[key] = proposal
+			keys = append(keys, key)
+		}
+		proposal.users = append(proposal.users, user)
+		proposal.Members = append(proposal.Members, user.Email)
+	}
+	sort.Strings(keys)
+
+	minMembers := opts.MinMembers
+	if minMembers < 1 {
+		minMembers = 1
+	}
+
+	for _, key := range keys {
+		proposal := clusters[key]
+		if group, ok := existing[key]; ok {
+			proposal.Group = group.Name
+			proposal.GroupID = group.ID
+			for _, user := range proposal.users {
+				for _, member := range snapshot.members[group.ID] {
+					if member.ID == user.ID {
+						proposal.alreadyMembers = append(proposal.alreadyMembers, user.Email)
+					}
+				}
+			}
+		} else {
+			if len(proposal.users) < minMembers {
+				continue
+			}
+			proposal.Group = proposedGroupName(opts.GroupPrefix, proposal.permissions, names)
+		}
+		sort.Strings(proposal.Members)
+		migration.Proposals = append(migration.Proposals, *proposal)
+	}
+
+	return migration
+}
+
+// migrationSkipReason returns why the direct permissions of the user can't be moved to a group, or an empty string.
+func (s *Segment) migrationSkipReason(snapshot *iamSnapshot, user segment.User) string {
+	err := s.policy.checkIdentifiers(userResourceType.Id, user.Email, user.ID, user.Email, workspaceScopedID(snapshot.workspace.ID, user.ID))
+	if err != nil {
+		return "protected principal"
+	}
+	if s.idp.managesUser(user.Email) && !s.idp.AllowChanges {
+		return fmt.Sprintf("group memberships managed by %s", s.idp.providerName())
+	}
+	for _, permission := range user.Permissions {
+		if s.policy.isProtectedRole(permission.RoleID, permission.RoleName) {
+			return fmt.Sprintf("holds protected role %s", permission.RoleName)
+		}
+	}
+
+	return ""
+}
+
+// permissionKey identifies a set of permissions, whatever the order of its roles and resources.
+func permissionKey(permissions []segment.Permission) string {
+	var entries []string
+	for entry := range permissionSet(permissions, nil) {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+
+	return strings.Join(entries, "\n")
+}
+
+// proposedGroupName returns a group name made of the role names of the permissions, unique among names.
+func proposedGroupName(prefix string, permissions []segment.Permission, names map[string]bool) string {
+	var roles []string
+	for _, permission := range permissions {
+		role := permission.RoleName
+		if role == "" {
+			role = permission.RoleID
+		}
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	base := prefix + strings.Join(roles, " + ")
+	name := base
+	for i := 2; names[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s (%d)", base, i)
+	}
+	names[strings.ToLower(name)] = true
+
+	return name
+}
+
+// ApplyGroupMigration creates the new groups of the proposals and gives them their permissions, adds the users to
+// their groups, and then removes their direct permissions. A user's direct permissions are only removed once they
+// are a member of the group, so access is never lost in between.
+func (s *Segment) ApplyGroupMigration(ctx context.Context, migration *GroupMigration) error {
+	ctx = withProvisioningTask(ctx, &provisioningTask{Action: "migrate_to_groups"})
+	client := migration.client
+
+	for _, proposal := range migration.Proposals {
+		groupID := proposal.GroupID
+		if groupID == "" {
+			group, err := s.provisioner.createGroup(ctx, client, proposal.Group)
+			if err != nil {
+				return fmt.Errorf("baton-segment: failed to create group %s: %w", proposal.Group, err)
+			}
+			groupID = group.ID
+
+			principal := s.migrationPrincipal(migration.WorkspaceID, groupResourceType, groupID, proposal.Group)
+			if err := s.provisioner.updatePermissions(ctx, client, principal, groupID, nil, proposal.permissions); err != nil {
+				return fmt.Errorf("baton-segment: failed to set permissions of group %s: %w", proposal.Group, err)
+			}
+		}
+
+		var emails []string
+		for _, email := range proposal.Members {
+			if !containsEmail(proposal.alreadyMembers, email) {
+				emails = append(emails, email)
+			}
+		}
+		if len(emails) > 0 {
+			if err := s.provisioner.addGroupMembers(ctx, client, groupID, proposal.Group, nil, emails); err != nil {
+				return fmt.Errorf("baton-segment: failed to add members to group %s: %w", proposal.Group, err)
+			}
+		}
+
+		for _, user := range proposal.users {
+			principal := s.migrationPrincipal(migration.WorkspaceID, userResourceType, user.ID, user.Email)
+			if err := s.provisioner.updatePermissions(ctx, client, principal, user.ID, user.Permissions, nil); err != nil {
+				return fmt.Errorf("baton-segment: failed to remove direct permissions of %s: %w", user.Email, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Segment) migrationPrincipal(workspaceID string, resourceType *v2.ResourceType, id, displayName string) *v2.Resource {
+	return &v2.Resource{
+		Id: &v2.ResourceId{
+			ResourceType: resourceType.Id,
+			Resource:     s.clients.scopedID(workspaceID, id),
+		},
+		DisplayName: displayName,
+	}
+}
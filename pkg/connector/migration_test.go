@@ -0,0 +1,58 @@
+package connector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestGroupMigrationsReuseGroups(t *testing.T) {
+	// resources aren't served, so only users, groups and roles are synced.
+	resourceTypes := []string{sourceResourceType.Id, warehouseResourceType.Id, functionResourceType.Id, spaceResourceType.Id}
+
+	tests := []struct {
+		name      string
+		skipTypes []string
+	}{
+		{name: "groups synced", skipTypes: resourceTypes},
+		{name: "groups not synced", skipTypes: append(append([]string{}, resourceTypes...), groupResourceType.Id)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncTypes, err := newResourceTypeSet(nil, tt.skipTypes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fake := newFakeSegment(t)
+			serveTestIAM(fake)
+			s := &Segment{
+				clients:   fake.clients(),
+				syncTypes: syncTypes,
+				policy:    &ProvisioningPolicy{},
+				idp:       &IdPManagement{},
+			}
+
+			migrations, err := s.GroupMigrations(context.Background(), GroupMigrationOptions{MinMembers: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(migrations) != 1 {
+				t.Fatalf("got %d migrations, want 1", len(migrations))
+			}
+
+			// alice holds the Workspace Owner role of the Admins group directly.
+			proposals := migrations[0].Proposals
+			if len(proposals) != 1 {
+				t.Fatalf("got %d proposals, want the Admins group", len(proposals))
+			}
+			if proposals[0].GroupID != "g-admins" || proposals[0].Group != "Admins" {
+				t.Errorf("proposed group %s (%s), want the existing Admins group", proposals[0].Group, proposals[0].GroupID)
+			}
+			if want := []string{"alice@example.com"}; !reflect.DeepEqual(proposals[0].Members, want) {
+				t.Errorf("members = %q, want %q", proposals[0].Members, want)
+			}
+		})
+	}
+}
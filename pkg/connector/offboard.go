@@ -0,0 +1,260 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OffboardSummary records what offboarding a user removed from every configured workspace.
+type OffboardSummary struct {
+	Email      string              `json:"email"`
+	DryRun     bool                `json:"dry_run"`
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt time.Time           `json:"finished_at"`
+	Workspaces []OffboardWorkspace `json:"workspaces"`
+}
+
+// OffboardWorkspace records what offboarding a user removed from a workspace.
+type OffboardWorkspace struct {
+	WorkspaceID   string `json:"workspace_id"`
+	WorkspaceName string `json:"workspace_name"`
+	// UserID is the ID of the user, empty when they only had a pending invite.
+	UserID             string   `json:"user_id,omitempty"`
+	GroupsRemoved      []string `json:"groups_removed,omitempty"`
+	PermissionsRemoved []string `json:"permissions_removed,omitempty"`
+	UserRemoved        bool     `json:"user_removed"`
+	InvitesRevoked     bool     `json:"invites_revoked"`
+	Error              string   `json:"error,omitempty"`
+}
+
+// offboardTarget is a workspace the user is a member of or has a pending invite to.
+type offboardTarget struct {
+	workspace *segment.Workspace
+	client    *segment.Client
+	user      *segment.User
+	invited   bool
+}
+
+// Offboard removes the user with the given email from every configured workspace: from all their groups, then
+// their direct permissions, then the workspace itself, and revokes their pending invites. Offboarding is refused
+// before any change if the user is a protected principal, or if removing them would leave a workspace without a
+// Workspace Owner, or with fewer than the provisioning policy requires. A failing step doesn't stop the next ones;
+// the summary records what was done and the errors are returned along with it.
+func (s *Segment) Offboard(ctx context.Context, email string) (*OffboardSummary, error) {
+	ctx = withProvisioningTask(ctx, &provisioningTask{Action: "offboard"})
+
+	summary := &OffboardSummary{
+		Email:     email,
+		DryRun:    s.dryRun,
+		StartedAt: time.Now().UTC(),
+	}
+
+	targets, err := s.offboardTargets(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("baton-segment: no user or pending invite found for %s", email)
+	}
+
+	var errs []error
+	for _, target := range targets {
+		result := s.offboardWorkspace(ctx, target, email)
+		if result.Error != "" {
+			errs = append(errs, fmt.Errorf("baton-segment: workspace %s: %s", target.workspace.Name, result.Error))
+		}
+		summary.Workspaces = append(summary.Workspaces, result)
+	}
+	summary.FinishedAt = time.Now().UTC()
+
+	return summary, errors.Join(errs...)
+}
+
+// offboardTargets finds the workspaces the user is a member of or invited to, and checks that they can be
+// offboarded from each of them.
+func (s *Segment) offboardTargets(ctx context.Context, email string) ([]offboardTarget, error) {
+	workspaces, err := s.clients.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []offboardTarget
+	for _, workspace := range workspaces {
+		client, err := s.clients.get(ctx, workspace.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		target := offboardTarget{workspace: workspace, client: client}
+
+		found, err := findUserByEmail(ctx, client, email)
+		if err != nil {
+			return nil, fmt.Errorf("baton-segment: failed to find user in workspace %s: %w", workspace.Name, err)
+		}
+		if found != nil {
+			target.user, err = client.GetUser(ctx, found.ID)
+			if err != nil {
+				return nil, fmt.Errorf("baton-segment: failed to get user %s: %w", found.ID, err)
+			}
+		}
+
+		err = paginate(ctx, client.ListInvites, func(invite string) error {
+			target.invited = target.invited || strings.EqualFold(invite, email)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("baton-segment: failed to list invites of workspace %s: %w", workspace.Name, err)
+		}
+
+		if target.user == nil && !target.invited {
+			continue
+		}
+
+		if target.user != nil {
+			err := s.policy.checkIdentifiers(
+				userResourceType.Id,
+				target.user.Email,
+				target.user.ID,
+				target.user.Email,
+				s.clients.scopedID(workspace.ID, target.user.ID),
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := s.checkOffboardOwners(ctx, target); err != nil {
+				return nil, err
+			}
+		}
+
+		rv = append(rv, target)
+	}
+
+	return rv, nil
+}
+
+// checkOffboardOwners denies offboarding the last Workspace Owner of a workspace, or an owner without whom fewer
+// owners remain than the provisioning policy requires.
+func (s *Segment) checkOffboardOwners(ctx context.Context, target offboardTarget) error {
+	ownerRoleID, err := getOwnerRoleID(ctx, target.client)
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to count workspace owners: %w", err)
+	}
+	paths, _, err := ownerPaths(ctx, target.client, target.workspace.ID, s.userCache, ownerRoleID)
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to count workspace owners: %w", err)
+	}
+
+	path, ok := paths[target.user.ID]
+	if !ok || (!path.direct && path.groups == 0) {
+		return nil
+	}
+
+	owners := 0
+	for userID, path := range paths {
+		if userID != target.user.ID && (path.direct || path.groups > 0) {
+			owners++
+		}
+	}
+
+	if owners == 0 {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"baton-segment: user %s is the last Workspace Owner of workspace %s and can't be offboarded",
+			target.user.Email,
+			target.workspace.Name,
+		)
+	}
+	if owners < s.policy.MinOwnerCount {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"baton-segment: offboarding %s would leave %d Workspace Owners in workspace %s, the provisioning policy requires at least %d",
+			target.user.Email,
+			owners,
+			target.workspace.Name,
+			s.policy.MinOwnerCount,
+		)
+	}
+
+	return nil
+}
+
+func (s *Segment) offboardWorkspace(ctx context.Context, target offboardTarget, email string) OffboardWorkspace {
+	result := OffboardWorkspace{
+		WorkspaceID:   target.workspace.ID,
+		WorkspaceName: target.workspace.Name,
+	}
+
+	var errs []error
+	if target.user != nil {
+		user := target.user
+		result.UserID = user.ID
+		principal := &v2.Resource{
+			Id: &v2.ResourceId{
+				ResourceType: userResourceType.Id,
+				Resource:     s.clients.scopedID(target.workspace.ID, user.ID),
+			},
+			DisplayName: user.Email,
+		}
+
+		err := paginate(ctx, target.client.ListGroups, func(group segment.Group) error {
+			remaining, err := remainingGroupMembers(ctx, target.client, group.ID, []string{user.Email})
+			if err != nil {
+				return err
+			}
+			if len(remaining) == 0 {
+				return nil
+			}
+
+			err = s.provisioner.removeGroupMembers(ctx, target.client, group.ID, group.Name, principal, []string{user.Email})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove from group %s: %w", group.Name, err))
+				return nil
+			}
+			result.GroupsRemoved = append(result.GroupsRemoved, group.Name)
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list groups: %w", err))
+		}
+		sort.Strings(result.GroupsRemoved)
+
+		if len(user.Permissions) > 0 {
+			err := s.provisioner.updatePermissions(ctx, target.client, principal, user.ID, user.Permissions, nil)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to clear permissions: %w", err))
+			} else {
+				result.PermissionsRemoved, _ = diffPermissions(nil, user.Permissions)
+			}
+		}
+
+		if err := s.provisioner.deleteUser(ctx, target.client, principal, user.ID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove user: %w", err))
+		} else {
+			result.UserRemoved = true
+		}
+	}
+
+	if target.invited {
+		if err := s.provisioner.deleteInvites(ctx, target.client, []string{email}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to revoke invites: %w", err))
+		} else {
+			result.InvitesRevoked = true
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
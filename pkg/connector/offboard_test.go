@@ -0,0 +1,121 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOffboardOwners(t *testing.T) {
+	alice := segment.User{ID: "u-alice", Email: "alice@example.com", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+	carol := segment.User{ID: "u-carol", Email: "carol@example.com"}
+	admins := segment.Group{ID: "g-admins", Name: "Admins", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+
+	tests := []struct {
+		name          string
+		members       []segment.User
+		minOwnerCount int
+		email         string
+		wantErr       string
+	}{
+		{
+			name:    "last direct owner",
+			email:   alice.Email,
+			wantErr: "is the last Workspace Owner",
+		},
+		{
+			name:    "owner through a group, a direct owner remains",
+			members: []segment.User{carol},
+			email:   carol.Email,
+		},
+		{
+			name:          "owner below the minimum",
+			members:       []segment.User{carol},
+			minOwnerCount: 2,
+			email:         alice.Email,
+			wantErr:       "would leave 1 Workspace Owners",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			fake.serveIAM(
+				[]segment.User{alice, carol},
+				[]segment.Group{admins},
+				map[string][]segment.User{admins.ID: tt.members},
+				[]segment.Role{testOwnerRole, testMemberRole},
+			)
+			fake.handle(http.MethodGet, "/invites", respondData(t, "invites", []string{}))
+			s := newElevationSegment(fake)
+			s.policy = &ProvisioningPolicy{MinOwnerCount: tt.minOwnerCount}
+			s.provisioner = newProvisioner(true, nil)
+
+			_, err := s.Offboard(context.Background(), tt.email)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.PermissionDenied || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Offboard() error = %v, want a PermissionDenied error %q", err, tt.wantErr)
+			}
+			for _, request := range fake.requested() {
+				if !strings.HasPrefix(request, http.MethodGet) {
+					t.Errorf("request %s made before offboarding was refused", request)
+				}
+			}
+		})
+	}
+}
+
+func TestOffboardPartialFailure(t *testing.T) {
+	alice := segment.User{ID: "u-alice", Email: "alice@example.com", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+	bob := segment.User{ID: "u-bob", Email: "bob@example.com", Permissions: []segment.Permission{testWorkspacePermission(testMemberRole)}}
+	analysts := segment.Group{ID: "g-analysts", Name: "Analysts", Permissions: []segment.Permission{testWorkspacePermission(testMemberRole)}}
+
+	fake := newFakeSegment(t)
+	fake.serveIAM(
+		[]segment.User{alice, bob},
+		[]segment.Group{analysts},
+		map[string][]segment.User{analysts.ID: {bob}},
+		[]segment.Role{testOwnerRole, testMemberRole},
+	)
+	fake.handle(http.MethodGet, "/invites", respondData(t, "invites", []string{"bob@example.com"}))
+	fake.handle(http.MethodDelete, "/groups/g-analysts/users", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	fake.handle(http.MethodPut, "/users/u-bob/permissions", respondData(t, "permissions", []segment.Permission{}))
+	fake.handle(http.MethodDelete, "/users", respondData(t, "status", "SUCCESS"))
+	fake.handle(http.MethodDelete, "/invites", respondData(t, "status", "SUCCESS"))
+
+	s := newElevationSegment(fake)
+	summary, err := s.Offboard(context.Background(), bob.Email)
+	if err == nil {
+		t.Fatal("Offboard() succeeded, want the failed group removal returned")
+	}
+	if summary == nil || len(summary.Workspaces) != 1 {
+		t.Fatalf("summary = %+v, want one workspace", summary)
+	}
+
+	got := summary.Workspaces[0]
+	if !strings.Contains(got.Error, "failed to remove from group Analysts") {
+		t.Errorf("error = %q, want the failed group removal", got.Error)
+	}
+	if len(got.GroupsRemoved) != 0 {
+		t.Errorf("groups removed = %q, want none", got.GroupsRemoved)
+	}
+	if want := []string{"Workspace Member on WORKSPACE ws1"}; !reflect.DeepEqual(got.PermissionsRemoved, want) {
+		t.Errorf("permissions removed = %q, want %q", got.PermissionsRemoved, want)
+	}
+	if !got.UserRemoved || !got.InvitesRevoked {
+		t.Errorf("user removed = %v, invites revoked = %v, want the steps after the failure made", got.UserRemoved, got.InvitesRevoked)
+	}
+}
@@ -0,0 +1,290 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// OrphanedPermission is a permission of a user or group referencing a source, warehouse, function or space that
+// no longer exists. Segment keeps these references when a resource is deleted.
+type OrphanedPermission struct {
+	WorkspaceID   string `json:"workspace_id"`
+	WorkspaceName string `json:"workspace_name"`
+	PrincipalType string `json:"principal_type"`
+	PrincipalID   string `json:"principal_id"`
+	Principal     string `json:"principal"`
+	RoleID        string `json:"role_id"`
+	RoleName      string `json:"role_name"`
+	ResourceType  string `json:"resource_type"`
+	ResourceID    string `json:"resource_id"`
+}
+
+// OrphanReport lists the orphaned permissions of every configured workspace.
+type OrphanReport struct {
+	Orphans []OrphanedPermission
+
+	cleanups []orphanCleanup
+}
+
+// orphanCleanup is the update of the permissions of a principal removing its orphaned references.
+type orphanCleanup struct {
+	client      *segment.Client
+	principal   *v2.Resource
+	principalID string
+	before      []segment.Permission
+	after       []segment.Permission
+}
+
+// danglingResources returns the resources of the permissions that weren't listed in the snapshot. Resources of
+// types that aren't synced aren't listed, and are never dangling.
+func (s *iamSnapshot) danglingResources(permissions []segment.Permission) []segment.Resource {
+	var rv []segment.Resource
+	for _, permission := range permissions {
+		for _, resource := range permission.Resources {
+			if resource.Type == workspaceType {
+				continue
+			}
+			names, listed := s.resourceNames[resource.Type]
+			if !listed {
+				continue
+			}
+			if _, ok := names[resource.ID]; !ok {
+				rv = append(rv, resource)
+			}
+		}
+	}
+
+	return rv
+}
+
+// withoutResources returns the permissions without the given resources. Permissions left without resources are
+// dropped.
+func withoutResources(permissions []segment.Permission, resources []segment.Resource) []segment.Permission {
+	removed := make(map[segment.Resource]bool)
+	for _, resource := range resources {
+		removed[resource] = true
+	}
+
+	var rv []segment.Permission
+	for _, permission := range permissions {
+		var kept []segment.Resource
+		for _, resource := range permission.Resources {
+			if !removed[resource] {
+				kept = append(kept, resource)
+			}
+		}
+		if len(kept) > 0 {
+			permission.Resources = kept
+			rv = append(rv, permission)
+		}
+	}
+
+	return rv
+}
+
+// OrphanedPermissions finds the permissions of the users and groups of every configured workspace referencing
+// resources that no longer exist.
+func (s *Segment) OrphanedPermissions(ctx context.Context) (*OrphanReport, error) {
+	snapshots, err := s.snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &OrphanReport{}
+	for _, snapshot := range snapshots {
+		add := func(principalType *v2.ResourceType, principalID, principalName string, permissions []segment.Permission) {
+			dangling := snapshot.danglingResources(permissions)
+			if len(dangling) == 0 {
+				return
+			}
+
+			for _, permission := range permissions {
+				for _, resource := range permission.Resources {
+					for _, d := range dangling {
+						if d != resource {
+							continue
+						}
+						report.Orphans = append(report.Orphans, OrphanedPermission{
+							WorkspaceID:   snapshot.workspace.ID,
+							WorkspaceName: snapshot.workspace.Name,
+							PrincipalType: principalType.Id,
+							PrincipalID:   principalID,
+							Principal:     principalName,
+							RoleID:        permission.RoleID,
+							RoleName:      permission.RoleName,
+							ResourceType:  resource.Type,
+							ResourceID:    resource.ID,
+						})
+						break
+					}
+				}
+			}
+
+			report.cleanups = append(report.cleanups, orphanCleanup{
+				client: snapshot.client,
+				principal: &v2.Resource{
+					Id: &v2.ResourceId{
+						ResourceType: principalType.Id,
+						Resource:     s.clients.scopedID(snapshot.workspace.ID, principalID),
+					},
+					DisplayName: principalName,
+				},
+				principalID: principalID,
+				before:      permissions,
+				after:       withoutResources(permissions, dangling),
+			})
+		}
+
+		for _, group := range snapshot.groups {
+			add(groupResourceType, group.ID, group.Name, group.Permissions)
+		}
+		for _, user := range snapshot.users {
+			add(userResourceType, user.ID, user.Email, user.Permissions)
+		}
+	}
+
+	return report, nil
+}
+
+// CleanupOrphans removes the orphaned references of the report from the permissions of their users and groups.
+// Protected principals are refused before any change is made.
+func (s *Segment) CleanupOrphans(ctx context.Context, report *OrphanReport) error {
+	ctx = withProvisioningTask(ctx, &provisioningTask{Action: "cleanup_orphans"})
+
+	for _, cleanup := range report.cleanups {
+		// users are known by their email, which the principal only has as its display name.
+		err := s.policy.checkIdentifiers(
+			cleanup.principal.Id.ResourceType,
+			cleanup.principal.DisplayName,
+			cleanup.principal.Id.Resource,
+			cleanup.principalID,
+			cleanup.principal.DisplayName,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, cleanup := range report.cleanups {
+		err := s.provisioner.updatePermissions(ctx, cleanup.client, cleanup.principal, cleanup.principalID, cleanup.before, cleanup.after)
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to remove orphaned permissions of %s %s: %w", cleanup.principal.Id.ResourceType, cleanup.principal.DisplayName, err)
+		}
+	}
+
+	return nil
+}
+
+// orphanSync holds the resources of every workspace for the duration of a sync, so the permissions of users and
+// groups referencing deleted resources can be flagged.
+type orphanSync struct {
+	clients   *workspaceClients
+	syncTypes resourceTypeSet
+
+	mu sync.Mutex
+	// snapshots hold the resources of the workspaces, keyed by workspace ID.
+	snapshots map[string]*iamSnapshot
+}
+
+func newOrphanSync(clients *workspaceClients, syncTypes resourceTypeSet) *orphanSync {
+	return &orphanSync{
+		clients:   clients,
+		syncTypes: syncTypes,
+		snapshots: make(map[string]*iamSnapshot),
+	}
+}
+
+// reset forgets the resources of the workspace, so they're listed again by the next sync.
+func (o *orphanSync) reset(workspaceID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.snapshots, workspaceID)
+}
+
+// resources returns a snapshot of the resources of the workspace, listing them on first use.
+func (o *orphanSync) resources(ctx context.Context, workspaceID string) (*iamSnapshot, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if snapshot, ok := o.snapshots[workspaceID]; ok {
+		return snapshot, nil
+	}
+
+	client, err := o.clients.get(ctx, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	workspace, err := o.clients.workspace(ctx, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &iamSnapshot{
+		workspace:      workspace,
+		client:         client,
+		resourceNames:  make(map[string]map[string]string),
+		resourceLabels: make(map[string]map[string][]string),
+	}
+	if err := snapshot.loadResources(ctx, o.syncTypes); err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to list resources to check permissions: %w", err)
+	}
+	o.snapshots[workspaceID] = snapshot
+
+	return snapshot, nil
+}
+
+// check returns the permissions without their references to deleted resources, and an annotation listing these
+// references, which are logged.
+func (o *orphanSync) check(
+	ctx context.Context,
+	workspaceID string,
+	principal *v2.ResourceId,
+	permissions []segment.Permission,
+) ([]segment.Permission, []proto.Message, error) {
+	snapshot, err := o.resources(ctx, workspaceID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dangling := snapshot.danglingResources(permissions)
+	if len(dangling) == 0 {
+		return permissions, nil, nil
+	}
+
+	refs := make([]string, 0, len(dangling))
+	for _, resource := range dangling {
+		refs = append(refs, fmt.Sprintf("%s %s", resource.Type, resource.ID))
+	}
+	sort.Strings(refs)
+
+	ctxzap.Extract(ctx).Warn(
+		"baton-segment: permissions reference deleted resources",
+		zap.String("principal_type", principal.ResourceType),
+		zap.String("principal_id", principal.Resource),
+		zap.Strings("resources", refs),
+	)
+
+	values := make([]interface{}, 0, len(refs))
+	for _, ref := range refs {
+		values = append(values, ref)
+	}
+	annotation, err := structpb.NewStruct(map[string]interface{}{
+		"warning":             "permissions reference deleted resources",
+		"orphaned_references": values,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return withoutResources(permissions, dangling), []proto.Message{annotation}, nil
+}
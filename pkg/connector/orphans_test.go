@@ -0,0 +1,188 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+func TestDanglingResources(t *testing.T) {
+	snapshot := &iamSnapshot{
+		workspace: &segment.Workspace{ID: testWorkspaceID},
+		resourceNames: map[string]map[string]string{
+			workspaceType: {testWorkspaceID: "Workspace"},
+			sourceType:    {"s1": "Web"},
+			// no warehouse was listed, but warehouses are synced.
+			warehouseType: {},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		permissions []segment.Permission
+		want        []segment.Resource
+	}{
+		{
+			name:        "listed resource",
+			permissions: []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{{ID: "s1", Type: sourceType}}}},
+		},
+		{
+			name:        "workspace",
+			permissions: []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{{ID: "other", Type: workspaceType}}}},
+		},
+		{
+			name:        "deleted resource",
+			permissions: []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{{ID: "s1", Type: sourceType}, {ID: "s2", Type: sourceType}}}},
+			want:        []segment.Resource{{ID: "s2", Type: sourceType}},
+		},
+		{
+			name:        "synced type without resources",
+			permissions: []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{{ID: "w1", Type: warehouseType}}}},
+			want:        []segment.Resource{{ID: "w1", Type: warehouseType}},
+		},
+		{
+			name:        "type that isn't synced",
+			permissions: []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{{ID: "sp1", Type: spaceType}}}},
+		},
+		{
+			name: "several permissions",
+			permissions: []segment.Permission{
+				{RoleID: "r1", Resources: []segment.Resource{{ID: "s3", Type: sourceType}}},
+				{RoleID: "r2", Resources: []segment.Resource{{ID: "s1", Type: sourceType}, {ID: "w2", Type: warehouseType}}},
+			},
+			want: []segment.Resource{{ID: "s3", Type: sourceType}, {ID: "w2", Type: warehouseType}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snapshot.danglingResources(tt.permissions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("danglingResources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithoutResources(t *testing.T) {
+	s1 := segment.Resource{ID: "s1", Type: sourceType}
+	s2 := segment.Resource{ID: "s2", Type: sourceType}
+	w1 := segment.Resource{ID: "s1", Type: warehouseType}
+
+	tests := []struct {
+		name        string
+		permissions []segment.Permission
+		resources   []segment.Resource
+		want        []segment.Permission
+	}{
+		{
+			name:        "nothing removed",
+			permissions: []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{s1, s2}}},
+			want:        []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{s1, s2}}},
+		},
+		{
+			name:        "resource removed",
+			permissions: []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{s1, s2}}},
+			resources:   []segment.Resource{s2},
+			want:        []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{s1}}},
+		},
+		{
+			name: "permission left without resources dropped",
+			permissions: []segment.Permission{
+				{RoleID: "r1", Resources: []segment.Resource{s2}},
+				{RoleID: "r2", Resources: []segment.Resource{s1}},
+			},
+			resources: []segment.Resource{s2},
+			want:      []segment.Permission{{RoleID: "r2", Resources: []segment.Resource{s1}}},
+		},
+		{
+			name:        "same ID of another type kept",
+			permissions: []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{s1, w1}}},
+			resources:   []segment.Resource{w1},
+			want:        []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{s1}}},
+		},
+		{
+			name:        "every permission dropped",
+			permissions: []segment.Permission{{RoleID: "r1", Resources: []segment.Resource{s1}}},
+			resources:   []segment.Resource{s1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withoutResources(tt.permissions, tt.resources); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withoutResources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrphanedPermissions(t *testing.T) {
+	syncTypes, err := newResourceTypeSet(nil, []string{warehouseResourceType.Id, functionResourceType.Id, spaceResourceType.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		sources     http.HandlerFunc
+		wantOrphans int
+		wantErr     bool
+	}{
+		{
+			name:        "deleted source",
+			sources:     respondJSON(`{"data":{"sources":[{"id":"s1","name":"Web"}],"pagination":{}}}`),
+			wantOrphans: 1,
+		},
+		{
+			name:    "empty source list response",
+			sources: respondJSON(""),
+			wantErr: true,
+		},
+		{
+			name: "failed source list",
+			sources: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			fake.serveIAM(
+				[]segment.User{{
+					ID:    "u1",
+					Email: "user@example.com",
+					Permissions: []segment.Permission{{
+						RoleID:    "r1",
+						RoleName:  "Source Admin",
+						Resources: []segment.Resource{{ID: "s1", Type: sourceType}, {ID: "s2", Type: sourceType}},
+					}},
+				}},
+				nil,
+				nil,
+				nil,
+			)
+			fake.handle(http.MethodGet, "/sources", tt.sources)
+			s := &Segment{clients: fake.clients(), syncTypes: syncTypes}
+
+			report, err := s.OrphanedPermissions(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("OrphanedPermissions() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Orphans) != tt.wantOrphans {
+				t.Errorf("got %d orphaned permissions, want %d", len(report.Orphans), tt.wantOrphans)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// workspaceOwnerRole is the name of the Segment role with full access to the workspace.
+const workspaceOwnerRole = "Workspace Owner"
+
+// ProvisioningPolicy guards provisioning against changes that must never be made through the connector,
+// whatever the access policies in ConductorOne allow.
+type ProvisioningPolicy struct {
+	// ProtectedRoles are the names or IDs of roles that can't be granted, directly or through group membership.
+	ProtectedRoles []string `yaml:"protected_roles"`
+	// ProtectedPrincipals are the IDs or emails of users and groups that can't be modified.
+	ProtectedPrincipals []string `yaml:"protected_principals"`
+	// MinOwnerCount is the number of Workspace Owners that must remain after a revoke. At least one always remains.
+	MinOwnerCount int `yaml:"min_owner_count"`
+}
+
+// LoadProvisioningPolicy reads a provisioning policy from a YAML file.
+func LoadProvisioningPolicy(path string) (*ProvisioningPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to read provisioning policy: %w", err)
+	}
+
+	var policy ProvisioningPolicy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to parse provisioning policy: %w", err)
+	}
+
+	if policy.MinOwnerCount < 0 {
+		return nil, fmt.Errorf("baton-segment: min_owner_count must not be negative")
+	}
+
+	return &policy, nil
+}
+
+// Merge adds the protected roles and principals of other to the policy, and keeps the highest owner count.
+func (p *ProvisioningPolicy) Merge(other ProvisioningPolicy) {
+	p.ProtectedRoles = append(p.ProtectedRoles, other.ProtectedRoles...)
+	p.ProtectedPrincipals = append(p.ProtectedPrincipals, other.ProtectedPrincipals...)
+	if other.MinOwnerCount > p.MinOwnerCount {
+		p.MinOwnerCount = other.MinOwnerCount
+	}
+}
+
+func (p *ProvisioningPolicy) isProtectedRole(roleID, roleName string) bool {
+	for _, role := range p.ProtectedRoles {
+		if role == roleID || strings.EqualFold(role, roleName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRole denies granting a protected role.
+func (p *ProvisioningPolicy) checkRole(roleID, roleName string) error {
+	if p.isProtectedRole(roleID, roleName) {
+		return status.Errorf(codes.PermissionDenied, "baton-segment: role %s is protected and can't be granted by the connector", roleName)
+	}
+
+	return nil
+}
+
+// checkPrincipal denies modifying a protected user or group.
+func (p *ProvisioningPolicy) checkPrincipal(principal *v2.Resource) error {
+	_, principalID := splitWorkspaceScopedID(principal.Id.Resource)
+	identifiers := []string{principal.Id.Resource, principalID}
+	if userTrait, err := rs.GetUserTrait(principal); err == nil {
+		for _, email := range userTrait.Emails {
+			identifiers = append(identifiers, email.Address)
+		}
+	}
+
+	return p.checkIdentifiers(principal.Id.ResourceType, principal.DisplayName, identifiers...)
+}
+
+// checkIdentifiers denies modifying the user or group known by any of the given IDs or emails.
+func (p *ProvisioningPolicy) checkIdentifiers(principalType, displayName string, identifiers ...string) error {
+	for _, protected := range p.ProtectedPrincipals {
+		for _, id := range identifiers {
+			if strings.EqualFold(protected, id) {
+				return status.Errorf(
+					codes.PermissionDenied,
+					"baton-segment: %s %s is protected and can't be modified by the connector",
+					principalType,
+					displayName,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkGroupRoles denies adding members to a group holding a protected role.
+func (p *ProvisioningPolicy) checkGroupRoles(ctx context.Context, client *segment.Client, groupID string) error {
+	if len(p.ProtectedRoles) == 0 {
+		return nil
+	}
+
+	group, err := client.GetGroup(ctx, groupID)
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to get group info while checking provisioning policy: %w", err)
+	}
+
+	for _, permission := range group.Permissions {
+		if p.isProtectedRole(permission.RoleID, permission.RoleName) {
+			return status.Errorf(
+				codes.PermissionDenied,
+				"baton-segment: group %s holds protected role %s, members can't be added by the connector",
+				group.Name,
+				permission.RoleName,
+			)
+		}
+	}
+
+	return nil
+}
+
+// ownerChange describes which Workspace Owner grants a revoke removes.
+type ownerChange struct {
+	// roleID is the role revoked from userID or groupID, checked only when it is the Workspace Owner role. Any role
+	// is checked when empty.
+	roleID string
+	// userID loses a direct Workspace Owner permission.
+	userID string
+	// groupID loses its Workspace Owner permission, or memberIDs are removed from it.
+	groupID   string
+	memberIDs []string
+}
+
+// minOwners is the number of Workspace Owners that must remain after a change, never less than one.
+func (p *ProvisioningPolicy) minOwners() int {
+	if p.MinOwnerCount < 1 {
+		return 1
+	}
+
+	return p.MinOwnerCount
+}
+
+// checkOwnerCount denies a revoke that leaves fewer Workspace Owners than the policy requires, or none. Owners are
+// counted once whether they hold the role directly or through any number of groups.
+func (p *ProvisioningPolicy) checkOwnerCount(
+	ctx context.Context,
+	client *segment.Client,
+	workspaceID string,
+	users *userCache,
+	change ownerChange,
+) error {
+	ownerRoleID, err := getOwnerRoleID(ctx, client)
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to count workspace owners: %w", err)
+	}
+	if change.roleID != "" && change.roleID != ownerRoleID {
+		return nil
+	}
+
+	if change.groupID != "" {
+		group, err := client.GetGroup(ctx, change.groupID)
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to get group info while checking provisioning policy: %w", err)
+		}
+		if !hasRole(group.Permissions, ownerRoleID) {
+			return nil
+		}
+	}
+
+	paths, groupMembers, err := ownerPaths(ctx, client, workspaceID, users, ownerRoleID)
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to count workspace owners: %w", err)
+	}
+
+	switch {
+	case change.userID != "":
+		if path, ok := paths[change.userID]; ok {
+			path.direct = false
+		}
+	case len(change.memberIDs) > 0:
+		for _, memberID := range change.memberIDs {
+			if path, ok := paths[memberID]; ok && containsID(groupMembers[change.groupID], memberID) {
+				path.groups--
+			}
+		}
+	default:
+		for _, memberID := range groupMembers[change.groupID] {
+			paths[memberID].groups--
+		}
+	}
+
+	owners := 0
+	for _, path := range paths {
+		if path.direct || path.groups > 0 {
+			owners++
+		}
+	}
+
+	if minOwners := p.minOwners(); owners < minOwners {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"baton-segment: revoke would leave %d Workspace Owners, at least %d are required",
+			owners,
+			minOwners,
+		)
+	}
+
+	return nil
+}
+
+type ownerPath struct {
+	direct bool
+	groups int
+}
+
+// ownerPaths returns how every Workspace Owner holds the role, keyed by user ID, along with the members of the
+// groups holding the role.
+//
+// Users are listed and read through the user cache, so a check made after a sync reads only the users it holds
+// as owners again, in case the role was revoked since. Users that became owners since the sync aren't counted,
+// which only makes the check stricter.
+func ownerPaths(
+	ctx context.Context,
+	client *segment.Client,
+	workspaceID string,
+	users *userCache,
+	ownerRoleID string,
+) (map[string]*ownerPath, map[string][]string, error) {
+	if users == nil {
+		users = newUserCache(0, 0)
+	}
+
+	paths := make(map[string]*ownerPath)
+	path := func(userID string) *ownerPath {
+		if _, ok := paths[userID]; !ok {
+			paths[userID] = &ownerPath{}
+		}
+		return paths[userID]
+	}
+
+	listed, err := users.listAll(ctx, client, workspaceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, u := range listed {
+		if cached, ok := users.cached(workspaceID, u.ID); ok && !hasRole(cached.Permissions, ownerRoleID) {
+			continue
+		}
+
+		user, err := client.GetUser(ctx, u.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		users.set(workspaceID, user)
+		if hasRole(user.Permissions, ownerRoleID) {
+			path(user.ID).direct = true
+		}
+	}
+
+	groupMembers := make(map[string][]string)
+	err = paginate(ctx, client.ListGroups, func(g segment.Group) error {
+		group, err := client.GetGroup(ctx, g.ID)
+		if err != nil {
+			return err
+		}
+		if !hasRole(group.Permissions, ownerRoleID) {
+			return nil
+		}
+
+		return paginate(
+			ctx,
+			func(ctx context.Context, cursor string) ([]segment.User, string, error) {
+				return client.ListGroupMembers(ctx, group.ID, cursor)
+			},
+			func(member segment.User) error {
+				path(member.ID).groups++
+				groupMembers[group.ID] = append(groupMembers[group.ID], member.ID)
+				return nil
+			},
+		)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return paths, groupMembers, nil
+}
+
+// getOwnerRoleID returns the ID of the Workspace Owner role of the workspace.
+func getOwnerRoleID(ctx context.Context, client *segment.Client) (string, error) {
+	var roles []segment.Role
+	err := paginate(ctx, client.ListRoles, func(role segment.Role) error {
+		roles = append(roles, role)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("baton-segment: failed to list roles: %w", err)
+	}
+
+	roleID := ownerRoleID(roles)
+	if roleID == "" {
+		return "", fmt.Errorf("baton-segment: role %s not found", workspaceOwnerRole)
+	}
+
+	return roleID, nil
+}
+
+// ownerRoleID returns the ID of the Workspace Owner role among roles, or an empty string.
+func ownerRoleID(roles []segment.Role) string {
+	for _, role := range roles {
+		if role.Name == workspaceOwnerRole {
+			return role.ID
+		}
+	}
+
+	return ""
+}
+
+func hasRole(permissions []segment.Permission, roleID string) bool {
+	for _, permission := range permissions {
+		if permission.RoleID == roleID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsID(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,216 @@
+package connector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+func TestCheckRole(t *testing.T) {
+	policy := &ProvisioningPolicy{ProtectedRoles: []string{"Workspace Owner", "r-source"}}
+
+	tests := []struct {
+		roleID   string
+		roleName string
+		wantErr  bool
+	}{
+		{roleID: "r-owner", roleName: "Workspace Owner", wantErr: true},
+		{roleID: "r-owner", roleName: "workspace owner", wantErr: true},
+		{roleID: "r-source", roleName: "Source Admin", wantErr: true},
+		{roleID: "r-member", roleName: "Workspace Member"},
+	}
+
+	for _, tt := range tests {
+		if err := policy.checkRole(tt.roleID, tt.roleName); (err != nil) != tt.wantErr {
+			t.Errorf("checkRole(%s, %s) error = %v, want error %v", tt.roleID, tt.roleName, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckPrincipal(t *testing.T) {
+	policy := &ProvisioningPolicy{ProtectedPrincipals: []string{"Admin@example.com", "g-admins", "u-scoped"}}
+	clients := newWorkspaceClients([]*segment.Client{segment.NewClient(nil, "token1"), segment.NewClient(nil, "token2")})
+	parent := &v2.ResourceId{ResourceType: workspaceResourceType.Id, Resource: testWorkspaceID}
+
+	user := func(id, email string) *v2.Resource {
+		resource, err := userResource(&segment.User{ID: id, Name: "User", Email: email}, parent, &IdPManagement{}, clients)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resource
+	}
+	group := func(id string) *v2.Resource {
+		resource, err := groupResource(&segment.Group{ID: id, Name: "Group"}, parent, &IdPManagement{}, clients)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resource
+	}
+
+	tests := []struct {
+		name      string
+		principal *v2.Resource
+		wantErr   bool
+	}{
+		{name: "user protected by email", principal: user("u1", "admin@example.com"), wantErr: true},
+		{name: "user protected by unscoped ID", principal: user("u-scoped", "scoped@example.com"), wantErr: true},
+		{name: "group protected by ID", principal: group("g-admins"), wantErr: true},
+		{name: "other user", principal: user("u2", "user@example.com")},
+		{name: "other group", principal: group("g-analysts")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := policy.checkPrincipal(tt.principal); (err != nil) != tt.wantErr {
+				t.Errorf("checkPrincipal() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckGroupRoles(t *testing.T) {
+	tests := []struct {
+		name           string
+		protectedRoles []string
+		groupID        string
+		wantErr        bool
+	}{
+		{name: "group holding a protected role", protectedRoles: []string{workspaceOwnerRole}, groupID: "g-admins", wantErr: true},
+		{name: "group without protected roles", protectedRoles: []string{"Source Admin"}, groupID: "g-admins"},
+		{name: "no protected roles", groupID: "g-admins"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			serveTestIAM(fake)
+			policy := &ProvisioningPolicy{ProtectedRoles: tt.protectedRoles}
+
+			if err := policy.checkGroupRoles(context.Background(), fake.client(), tt.groupID); (err != nil) != tt.wantErr {
+				t.Errorf("checkGroupRoles() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckOwnerCount(t *testing.T) {
+	alice := segment.User{ID: "u-alice", Email: "alice@example.com", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+	carol := segment.User{ID: "u-carol", Email: "carol@example.com"}
+	admins := segment.Group{ID: "g-admins", Name: "Admins", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+	analysts := segment.Group{ID: "g-analysts", Name: "Analysts", Permissions: []segment.Permission{testWorkspacePermission(testMemberRole)}}
+
+	tests := []struct {
+		name          string
+		members       map[string][]segment.User
+		minOwnerCount int
+		change        ownerChange
+		wantErr       string
+	}{
+		{
+			name:    "direct owner revoked, an owner through a group remains",
+			members: map[string][]segment.User{admins.ID: {carol}},
+			change:  ownerChange{roleID: testOwnerRole.ID, userID: alice.ID},
+		},
+		{
+			name:          "direct owner revoked below the minimum",
+			members:       map[string][]segment.User{admins.ID: {carol}},
+			minOwnerCount: 2,
+			change:        ownerChange{roleID: testOwnerRole.ID, userID: alice.ID},
+			wantErr:       "would leave 1 Workspace Owners, at least 2 are required",
+		},
+		{
+			name:    "last direct owner revoked",
+			members: map[string][]segment.User{admins.ID: {}},
+			change:  ownerChange{roleID: testOwnerRole.ID, userID: alice.ID},
+			wantErr: "would leave 0 Workspace Owners, at least 1 are required",
+		},
+		{
+			name:    "owner through a group and directly removed from the group",
+			members: map[string][]segment.User{admins.ID: {alice}},
+			change:  ownerChange{groupID: admins.ID, memberIDs: []string{alice.ID}},
+		},
+		{
+			name:    "owner through a group removed from it, a direct owner remains",
+			members: map[string][]segment.User{admins.ID: {carol}},
+			change:  ownerChange{groupID: admins.ID, memberIDs: []string{carol.ID}},
+		},
+		{
+			name:          "group owner role revoked below the minimum",
+			members:       map[string][]segment.User{admins.ID: {carol}},
+			minOwnerCount: 2,
+			change:        ownerChange{roleID: testOwnerRole.ID, groupID: admins.ID},
+			wantErr:       "would leave 1 Workspace Owners, at least 2 are required",
+		},
+		{
+			name:          "member removed from a group without the owner role",
+			members:       map[string][]segment.User{admins.ID: {carol}, analysts.ID: {alice}},
+			minOwnerCount: 5,
+			change:        ownerChange{groupID: analysts.ID, memberIDs: []string{alice.ID}},
+		},
+		{
+			name:          "other role revoked",
+			members:       map[string][]segment.User{admins.ID: {carol}},
+			minOwnerCount: 5,
+			change:        ownerChange{roleID: testMemberRole.ID, userID: alice.ID},
+		},
+		{
+			name:          "non-member removed from the owners group",
+			members:       map[string][]segment.User{admins.ID: {carol}},
+			minOwnerCount: 2,
+			change:        ownerChange{groupID: admins.ID, memberIDs: []string{alice.ID}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			fake.serveIAM([]segment.User{alice, carol}, []segment.Group{admins, analysts}, tt.members, []segment.Role{testOwnerRole, testMemberRole})
+			policy := &ProvisioningPolicy{MinOwnerCount: tt.minOwnerCount}
+
+			err := policy.checkOwnerCount(context.Background(), fake.client(), testWorkspaceID, newUserCache(1, 0), tt.change)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkOwnerCount() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckOwnerCountUsesUserCache(t *testing.T) {
+	fake := newFakeSegment(t)
+	serveTestIAM(fake)
+	client := fake.client()
+
+	// the users were listed and read by a sync.
+	users := newUserCache(1, 0)
+	listed := []segment.User{{ID: "u-alice"}, {ID: "u-bob"}, {ID: "u-carol"}}
+	if err := users.prefetch(context.Background(), client, testWorkspaceID, listed, true); err != nil {
+		t.Fatal(err)
+	}
+
+	before := len(fake.requested())
+	policy := &ProvisioningPolicy{}
+	change := ownerChange{groupID: "g-admins", memberIDs: []string{"u-carol"}}
+	if err := policy.checkOwnerCount(context.Background(), client, testWorkspaceID, users, change); err != nil {
+		t.Fatal(err)
+	}
+
+	var userRequests []string
+	for _, request := range fake.requested()[before:] {
+		if strings.HasPrefix(request, "GET /users") {
+			userRequests = append(userRequests, request)
+		}
+	}
+	// only the owner held by the cache is read again.
+	if len(userRequests) != 1 || userRequests[0] != "GET /users/u-alice" {
+		t.Errorf("user requests = %q, want only the owner read again", userRequests)
+	}
+}
@@ -0,0 +1,342 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+)
+
+// provisioner makes the changes of Grant, Revoke and Rotate in Segment, recording them in the audit journal when
+// one is configured. In dry run mode the changes are only logged, and summarized when the run is over.
+type provisioner struct {
+	dryRun  bool
+	journal *journal
+
+	mu      sync.Mutex
+	skipped []string
+}
+
+func newProvisioner(dryRun bool, journal *journal) *provisioner {
+	return &provisioner{
+		dryRun:  dryRun,
+		journal: journal,
+	}
+}
+
+// record makes a change in Segment with call, and appends it to the audit journal with the HTTP status of the
+// response. A change that can't be recorded fails, even though it was made, so it is never left out silently.
+func (p *provisioner) record(ctx context.Context, record journalRecord, call func(ctx context.Context) error) error {
+	if p.journal == nil {
+		return call(ctx)
+	}
+
+	status := &segment.ResponseStatus{}
+	err := call(segment.WithResponseStatus(ctx, status))
+
+	record.Status = status.Code
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if journalErr := p.journal.append(ctx, record); journalErr != nil {
+		return errors.Join(err, journalErr)
+	}
+
+	return err
+}
+
+// updatePermissions replaces the permissions of a user or a group, which currently holds the before permissions.
+func (p *provisioner) updatePermissions(
+	ctx context.Context,
+	client *segment.Client,
+	principal *v2.Resource,
+	principalID string,
+	before []segment.Permission,
+	after []segment.Permission,
+) error {
+	if p.dryRun {
+		added, removed := diffPermissions(before, after)
+		p.skip(
+			ctx,
+			fmt.Sprintf("update permissions of %s %s: added [%s], removed [%s]",
+				principal.Id.ResourceType,
+				principal.DisplayName,
+				strings.Join(added, "; "),
+				strings.Join(removed, "; "),
+			),
+			zap.String("principal_type", principal.Id.ResourceType),
+			zap.String("principal_id", principalID),
+			zap.Strings("added", added),
+			zap.Strings("removed", removed),
+		)
+		return nil
+	}
+
+	record := journalRecord{
+		Operation: "update_permissions",
+		Principal: newJournalPrincipal(principal, principalID),
+		TargetID:  principalID,
+		Before:    before,
+		After:     after,
+	}
+	return p.record(ctx, record, func(ctx context.Context) error {
+		return client.UpdatePermissions(ctx, principalID, principal.Id.ResourceType, after)
+	})
+}
+
+// addGroupMembers adds the users with the given emails to a group. The principal is nil for bulk changes that
+// aren't made for a single user.
+func (p *provisioner) addGroupMembers(
+	ctx context.Context,
+	client *segment.Client,
+	groupID string,
+	groupName string,
+	principal *v2.Resource,
+	emails []string,
+) error {
+	if p.dryRun {
+		p.skip(
+			ctx,
+			fmt.Sprintf("add %s to group %s", strings.Join(emails, ", "), groupName),
+			zap.String("group_id", groupID),
+			zap.Strings("emails", emails),
+		)
+		return nil
+	}
+
+	record := journalRecord{
+		Operation: "add_group_members",
+		Principal: newJournalPrincipal(principal, ""),
+		TargetID:  groupID,
+		Emails:    emails,
+	}
+	return p.record(ctx, record, func(ctx context.Context) error {
+		return client.AddGroupMembers(ctx, groupID, emails...)
+	})
+}
+
+// removeGroupMembers removes the users with the given emails from a group, then lists the members of the group to
+// check that none of them is left. A failed request is ignored when the users were removed anyway. The principal is
+// nil for bulk changes that aren't made for a single user.
+func (p *provisioner) removeGroupMembers(
+	ctx context.Context,
+	client *segment.Client,
+	groupID string,
+	groupName string,
+	principal *v2.Resource,
+	emails []string,
+) error {
+	if p.dryRun {
+		p.skip(
+			ctx,
+			fmt.Sprintf("remove %s from group %s", strings.Join(emails, ", "), groupName),
+			zap.String("group_id", groupID),
+			zap.Strings("emails", emails),
+		)
+		return nil
+	}
+
+	record := journalRecord{
+		Operation: "remove_group_members",
+		Principal: newJournalPrincipal(principal, ""),
+		TargetID:  groupID,
+		Emails:    emails,
+	}
+	return p.record(ctx, record, func(ctx context.Context) error {
+		removeErr := client.RemoveGroupMembers(ctx, groupID, emails...)
+
+		// The members are listed with their own status, so the journal keeps the status of the removal.
+		remaining, err := remainingGroupMembers(segment.WithResponseStatus(ctx, &segment.ResponseStatus{}), client, groupID, emails)
+		if err != nil {
+			return errors.Join(removeErr, fmt.Errorf("baton-segment: failed to check group members: %w", err))
+		}
+		if len(remaining) > 0 {
+			if removeErr != nil {
+				return removeErr
+			}
+			return fmt.Errorf("baton-segment: users %s are still members of group %s after removal", strings.Join(remaining, ", "), groupID)
+		}
+
+		if removeErr != nil {
+			ctxzap.Extract(ctx).Warn(
+				"baton-segment: removal from group failed, but the users are no longer members",
+				zap.String("group_id", groupID),
+				zap.Strings("emails", emails),
+				zap.Error(removeErr),
+			)
+		}
+
+		return nil
+	})
+}
+
+// createGroup creates a group without members or permissions. In dry run mode the group returned has no ID.
+func (p *provisioner) createGroup(ctx context.Context, client *segment.Client, name string) (*segment.Group, error) {
+	if p.dryRun {
+		p.skip(ctx, fmt.Sprintf("create group %s", name), zap.String("group_name", name))
+		return &segment.Group{Name: name}, nil
+	}
+
+	var group *segment.Group
+	record := journalRecord{
+		Operation: "create_group",
+		TargetID:  name,
+	}
+	err := p.record(ctx, record, func(ctx context.Context) error {
+		var err error
+		group, err = client.CreateGroup(ctx, name)
+		return err
+	})
+
+	return group, err
+}
+
+// deleteUser removes a user from the workspace.
+func (p *provisioner) deleteUser(ctx context.Context, client *segment.Client, principal *v2.Resource, userID string) error {
+	if p.dryRun {
+		p.skip(
+			ctx,
+			fmt.Sprintf("remove user %s from workspace", principal.DisplayName),
+			zap.String("user_id", userID),
+		)
+		return nil
+	}
+
+	record := journalRecord{
+		Operation: "delete_user",
+		Principal: newJournalPrincipal(principal, userID),
+		TargetID:  userID,
+	}
+	return p.record(ctx, record, func(ctx context.Context) error {
+		return client.DeleteUser(ctx, userID)
+	})
+}
+
+// deleteInvites revokes the pending invites sent to the given emails.
+func (p *provisioner) deleteInvites(ctx context.Context, client *segment.Client, emails []string) error {
+	if p.dryRun {
+		p.skip(
+			ctx,
+			fmt.Sprintf("revoke invites of %s", strings.Join(emails, ", ")),
+			zap.Strings("emails", emails),
+		)
+		return nil
+	}
+
+	record := journalRecord{
+		Operation: "delete_invites",
+		Emails:    emails,
+	}
+	return p.record(ctx, record, func(ctx context.Context) error {
+		return client.DeleteInvites(ctx, emails...)
+	})
+}
+
+// createWriteKey creates a new write key for a source. Write keys are secrets and are never recorded.
+func (p *provisioner) createWriteKey(ctx context.Context, client *segment.Client, sourceID string) (*segment.Source, error) {
+	var source *segment.Source
+	record := journalRecord{
+		Operation: "create_write_key",
+		TargetID:  sourceID,
+	}
+	err := p.record(ctx, record, func(ctx context.Context) error {
+		var err error
+		source, err = client.CreateWriteKey(ctx, sourceID)
+		return err
+	})
+
+	return source, err
+}
+
+// removeWriteKey removes a write key from a source.
+func (p *provisioner) removeWriteKey(ctx context.Context, client *segment.Client, sourceID, writeKey string) error {
+	record := journalRecord{
+		Operation: "remove_write_key",
+		TargetID:  sourceID,
+	}
+	return p.record(ctx, record, func(ctx context.Context) error {
+		_, err := client.RemoveWriteKey(ctx, sourceID, writeKey)
+		return err
+	})
+}
+
+// skip records a change that wasn't made because of dry run mode, and logs it.
+func (p *provisioner) skip(ctx context.Context, change string, fields ...zap.Field) {
+	p.mu.Lock()
+	p.skipped = append(p.skipped, change)
+	p.mu.Unlock()
+
+	ctxzap.Extract(ctx).Info("baton-segment: dry run, skipped "+change, fields...)
+}
+
+// logSummary logs the summary of every change skipped in dry run mode, once the run is over.
+func (p *provisioner) logSummary(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.dryRun || len(p.skipped) == 0 {
+		return
+	}
+
+	ctxzap.Extract(ctx).Info(
+		"baton-segment: dry run summary of changes that would have been applied",
+		zap.Int("change_count", len(p.skipped)),
+		zap.Strings("changes", p.skipped),
+	)
+	p.skipped = nil
+}
+
+// diffPermissions returns the role and resource pairs granted by after but not before, and the other way around,
+// formatted as "role on TYPE resource".
+func diffPermissions(before, after []segment.Permission) ([]string, []string) {
+	roleNames := make(map[string]string)
+	for _, permissions := range [][]segment.Permission{before, after} {
+		for _, permission := range permissions {
+			if permission.RoleName != "" {
+				roleNames[permission.RoleID] = permission.RoleName
+			}
+		}
+	}
+
+	beforeSet := permissionSet(before, roleNames)
+	afterSet := permissionSet(after, roleNames)
+
+	var added, removed []string
+	for entry := range afterSet {
+		if !beforeSet[entry] {
+			added = append(added, entry)
+		}
+	}
+	for entry := range beforeSet {
+		if !afterSet[entry] {
+			removed = append(removed, entry)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return added, removed
+}
+
+func permissionSet(permissions []segment.Permission, roleNames map[string]string) map[string]bool {
+	set := make(map[string]bool)
+	for _, permission := range permissions {
+		role := permission.RoleID
+		if name, ok := roleNames[permission.RoleID]; ok {
+			role = name
+		}
+
+		for _, resource := range permission.Resources {
+			set[fmt.Sprintf("%s on %s %s", role, resource.Type, resource.ID)] = true
+		}
+	}
+
+	return set
+}
@@ -0,0 +1,86 @@
+package connector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// requestPacer spaces the requests shared by a pool of workers. Requests are spread over the rate limit budget left
+// until it is reset, as reported by the last response of the client, and never made faster than the fixed rate.
+type requestPacer struct {
+	client *segment.Client
+	// interval is the minimum time between requests, none when zero.
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRequestPacer(client *segment.Client, requestsPerSecond float64) *requestPacer {
+	p := &requestPacer{client: client}
+	if requestsPerSecond > 0 {
+		p.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+
+	return p
+}
+
+// wait blocks until the next request can be made.
+func (p *requestPacer) wait(ctx context.Context) error {
+	now := time.Now()
+	interval := p.interval
+
+	// an exhausted budget holds every request until it is reset.
+	var resetAt time.Time
+	if rateLimit := p.client.RateLimit(); rateLimit != nil && rateLimit.ResetAt.AsTime().After(now) {
+		untilReset := rateLimit.ResetAt.AsTime().Sub(now)
+		if rateLimit.Remaining <= 0 {
+			resetAt = rateLimit.ResetAt.AsTime()
+		} else if budgetInterval := untilReset / time.Duration(rateLimit.Remaining); budgetInterval > interval {
+			interval = budgetInterval
+		}
+	}
+
+	p.mu.Lock()
+	at := now
+	if p.next.After(at) {
+		at = p.next
+	}
+	if resetAt.After(at) {
+		at = resetAt
+	}
+	p.next = at.Add(interval)
+	p.mu.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoff holds the requests after one was refused by the rate limit, until the budget is reset at resetAt or for
+// a second if it is already past.
+func (p *requestPacer) backoff(resetAt time.Time) {
+	if until := time.Now().Add(time.Second); resetAt.Before(until) {
+		resetAt = until
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if resetAt.After(p.next) {
+		p.next = resetAt
+	}
+}
@@ -1,6 +1,8 @@
 package connector
 
 import (
+	"fmt"
+
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 )
 
@@ -27,6 +29,7 @@ var (
 	sourceResourceType = &v2.ResourceType{
 		Id:          "source",
 		DisplayName: "Source",
+		Traits:      []v2.ResourceType_Trait{v2.ResourceType_TRAIT_APP},
 	}
 	warehouseResourceType = &v2.ResourceType{
 		Id:          "warehouse",
@@ -35,9 +38,76 @@ var (
 	functionResourceType = &v2.ResourceType{
 		Id:          "function",
 		DisplayName: "Function",
+		Traits:      []v2.ResourceType_Trait{v2.ResourceType_TRAIT_APP},
 	}
 	spaceResourceType = &v2.ResourceType{
 		Id:          "space",
 		DisplayName: "Space",
 	}
 )
+
+// alwaysSyncedResourceTypes can't be skipped, every other resource is parented under the workspace
+// and users are the principals of all grants.
+var alwaysSyncedResourceTypes = []*v2.ResourceType{
+	workspaceResourceType,
+	userResourceType,
+}
+
+var allResourceTypes = []*v2.ResourceType{
+	userResourceType,
+	workspaceResourceType,
+	groupResourceType,
+	roleResourceType,
+	sourceResourceType,
+	warehouseResourceType,
+	functionResourceType,
+	spaceResourceType,
+}
+
+// resourceTypeSet holds the IDs of the resource types that are synced.
+type resourceTypeSet map[string]bool
+
+func (s resourceTypeSet) has(resourceTypeID string) bool {
+	return s[resourceTypeID]
+}
+
+// newResourceTypeSet returns the resource types to sync. When syncTypes is empty all resource types are
+// synced, except the ones in skipTypes.
+func newResourceTypeSet(syncTypes, skipTypes []string) (resourceTypeSet, error) {
+	known := make(map[string]bool, len(allResourceTypes))
+	for _, rt := range allResourceTypes {
+		known[rt.Id] = true
+	}
+
+	set := make(resourceTypeSet, len(allResourceTypes))
+	if len(syncTypes) == 0 {
+		for _, rt := range allResourceTypes {
+			set[rt.Id] = true
+		}
+	}
+
+	for _, id := range syncTypes {
+		if !known[id] {
+			return nil, fmt.Errorf("baton-segment: unknown resource type %q", id)
+		}
+		set[id] = true
+	}
+
+	for _, id := range skipTypes {
+		if !known[id] {
+			return nil, fmt.Errorf("baton-segment: unknown resource type %q", id)
+		}
+		for _, rt := range alwaysSyncedResourceTypes {
+			if rt.Id == id {
+				return nil, fmt.Errorf("baton-segment: resource type %q can't be skipped", id)
+			}
+		}
+		delete(set, id)
+	}
+
+	for _, rt := range alwaysSyncedResourceTypes {
+		set[rt.Id] = true
+	}
+
+	return set, nil
+}
@@ -17,7 +17,10 @@ const roleMembership = "member"
 
 type roleBuilder struct {
 	resourceType *v2.ResourceType
-	client       *segment.Client
+	clients      *workspaceClients
+	policy       *ProvisioningPolicy
+	provisioner  *provisioner
+	users        *userCache
 }
 
 func (r *roleBuilder) ResourceType(_ context.Context) *v2.ResourceType {
@@ -25,7 +28,7 @@ func (r *roleBuilder) ResourceType(_ context.Context) *v2.ResourceType {
 }
 
 // Create a new connector resource for an Segment Role.
-func roleResource(role *segment.Role, parentResourceID *v2.ResourceId) (*v2.Resource, error) {
+func roleResource(role *segment.Role, parentResourceID *v2.ResourceId, clients *workspaceClients) (*v2.Resource, error) {
 	profile := map[string]interface{}{
 		"role_name":        role.Name,
 		"role_id":          role.ID,
@@ -39,7 +42,7 @@ func roleResource(role *segment.Role, parentResourceID *v2.ResourceId) (*v2.Reso
 	resource, err := rs.NewRoleResource(
 		role.Name,
 		roleResourceType,
-		role.ID,
+		clients.scopedID(parentResourceID.Resource, role.ID),
 		roleTraitOptions,
 		rs.WithParentResourceID(parentResourceID),
 	)
@@ -61,7 +64,12 @@ func (r *roleBuilder) List(ctx context.Context, parentResourceID *v2.ResourceId,
 		return nil, "", nil, err
 	}
 
-	roles, nextCursor, err := r.client.ListRoles(ctx, page)
+	client, err := r.clients.get(ctx, parentResourceID.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	roles, nextCursor, err := client.ListRoles(ctx, page)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -74,7 +82,7 @@ func (r *roleBuilder) List(ctx context.Context, parentResourceID *v2.ResourceId,
 	var rv []*v2.Resource
 	for _, role := range roles {
 		roleCopy := role
-		rr, err := roleResource(&roleCopy, parentResourceID)
+		rr, err := roleResource(&roleCopy, parentResourceID, r.clients)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -107,16 +115,30 @@ func (r *roleBuilder) Grants(ctx context.Context, resource *v2.Resource, pToken
 }
 
 func (r *roleBuilder) Grant(ctx context.Context, principal *v2.Resource, entitlement *v2.Entitlement) (annotations.Annotations, error) {
-	roleID := entitlement.Resource.Id.Resource
+	ctx = withProvisioningTask(ctx, grantTask(entitlement))
+
+	if err := r.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+
+	client, roleID, principalID, err := r.clients.forGrant(ctx, entitlement.Resource.Id, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.policy.checkRole(roleID, entitlement.Resource.DisplayName); err != nil {
+		return nil, err
+	}
+
 	resourceType := strings.ToUpper(workspaceType)
 	workspaceID := entitlement.Resource.ParentResourceId.Resource
 
-	permissions, err := grantPermissions(ctx, r.client, principal, roleID, resourceType, workspaceID)
+	current, permissions, err := grantPermissions(ctx, client, principal, principalID, roleID, resourceType, workspaceID)
 	if err != nil {
 		return nil, err
 	}
 
-	err = r.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, permissions)
+	err = r.provisioner.updatePermissions(ctx, client, principal, principalID, current, permissions)
 	if err != nil {
 		return nil, fmt.Errorf("baton-segment: failed to add permission to user %s for on the workspace resource: %w", principal.DisplayName, err)
 	}
@@ -125,16 +147,37 @@ func (r *roleBuilder) Grant(ctx context.Context, principal *v2.Resource, entitle
 }
 
 func (r *roleBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, revokeTask(grant))
+
 	entitlement := grant.Entitlement
 	principal := grant.Principal
-	roleID := entitlement.Resource.Id.Resource
+	if err := r.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+
+	client, roleID, principalID, err := r.clients.forGrant(ctx, entitlement.Resource.Id, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	workspaceID, err := r.clients.workspaceOf(ctx, entitlement.Resource.Id.Resource)
+	if err != nil {
+		return nil, err
+	}
+	change := ownerChange{roleID: roleID, userID: principalID}
+	if principal.Id.ResourceType == groupResourceType.Id {
+		change = ownerChange{roleID: roleID, groupID: principalID}
+	}
+	if err := r.policy.checkOwnerCount(ctx, client, workspaceID, r.users, change); err != nil {
+		return nil, err
+	}
 
-	permissions, err := revokePermissions(ctx, r.client, principal, roleID)
+	current, permissions, err := revokePermissions(ctx, client, principal, principalID, roleID)
 	if err != nil {
 		return nil, err
 	}
 
-	err = r.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, permissions)
+	err = r.provisioner.updatePermissions(ctx, client, principal, principalID, current, permissions)
 	if err != nil {
 		return nil, fmt.Errorf("baton-segment: failed to remove permission from user %s for on the workspace: %w", principal.DisplayName, err)
 	}
@@ -142,9 +185,12 @@ func (r *roleBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations.
 	return nil, nil
 }
 
-func newRoleBuilder(client *segment.Client) *roleBuilder {
+func newRoleBuilder(clients *workspaceClients, policy *ProvisioningPolicy, provisioner *provisioner, users *userCache) *roleBuilder {
 	return &roleBuilder{
 		resourceType: roleResourceType,
-		client:       client,
+		clients:      clients,
+		policy:       policy,
+		provisioner:  provisioner,
+		users:        users,
 	}
 }
@@ -0,0 +1,146 @@
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+const testWorkspaceID = "ws1"
+
+// fakeSegment serves the Segment API requests of a test from handlers keyed by method and path, and records the
+// requests made.
+type fakeSegment struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	handlers map[string]http.HandlerFunc
+	requests []string
+}
+
+func newFakeSegment(t *testing.T) *fakeSegment {
+	f := &fakeSegment{
+		t:        t,
+		handlers: make(map[string]http.HandlerFunc),
+	}
+	f.handle(http.MethodGet, "/", respondJSON(fmt.Sprintf(`{"data":{"workspace":{"id":%q,"name":"Workspace","slug":"workspace"}}}`, testWorkspaceID)))
+
+	return f
+}
+
+// respondJSON returns a handler responding with the JSON body.
+func respondJSON(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}
+}
+
+// respondStatus returns a handler responding with the status and no body.
+func respondStatus(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}
+}
+
+// respondData returns a handler responding with the value under key in the data of the response.
+func respondData(t *testing.T, key string, value interface{}) http.HandlerFunc {
+	data, err := json.Marshal(map[string]interface{}{"data": map[string]interface{}{key: value}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return respondJSON(string(data))
+}
+
+// serveIAM serves the users, groups, group members and roles of the workspace, each list on a single page.
+func (f *fakeSegment) serveIAM(users []segment.User, groups []segment.Group, members map[string][]segment.User, roles []segment.Role) {
+	f.handle(http.MethodGet, "/users", respondData(f.t, "users", users))
+	for _, user := range users {
+		f.handle(http.MethodGet, "/users/"+user.ID, respondData(f.t, "user", user))
+	}
+
+	f.handle(http.MethodGet, "/groups", respondData(f.t, "userGroups", groups))
+	for _, group := range groups {
+		f.handle(http.MethodGet, "/groups/"+group.ID, respondData(f.t, "group", group))
+		groupMembers := members[group.ID]
+		if groupMembers == nil {
+			groupMembers = []segment.User{}
+		}
+		f.handle(http.MethodGet, "/groups/"+group.ID+"/users", respondData(f.t, "users", groupMembers))
+	}
+
+	f.handle(http.MethodGet, "/roles", respondData(f.t, "roles", roles))
+}
+
+func (f *fakeSegment) handle(method, path string, handler http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.handlers[method+" "+path] = handler
+}
+
+// requested returns the requests made, as their method, path and query.
+func (f *fakeSegment) requested() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeSegment) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.Path
+
+	f.mu.Lock()
+	handler, ok := f.handlers[key]
+	request := key
+	if r.URL.RawQuery != "" {
+		request += "?" + r.URL.RawQuery
+	}
+	f.requests = append(f.requests, request)
+	f.mu.Unlock()
+
+	if !ok {
+		f.t.Errorf("unexpected request %s", request)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	handler(w, r)
+}
+
+// client returns a client sending its requests to the fake instead of the Segment API.
+func (f *fakeSegment) client() *segment.Client {
+	srv := httptest.NewServer(f)
+	f.t.Cleanup(srv.Close)
+
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	return segment.NewClient(&http.Client{Transport: redirectTransport{target: target}}, "token")
+}
+
+// clients returns the clients of the single workspace served by the fake.
+func (f *fakeSegment) clients() *workspaceClients {
+	return newWorkspaceClients([]*segment.Client{f.client()})
+}
+
+// redirectTransport sends requests to the target host.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+
+	return http.DefaultTransport.RoundTrip(req)
+}
@@ -0,0 +1,239 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// functionTypes are the types of functions, which are listed separately.
+var functionTypes = []string{"DESTINATION", "INSERT_DESTINATION", "SOURCE"}
+
+// iamSnapshot is the identity and access configuration of a workspace at a point in time: users and groups with
+// their permissions, the members of every group and the names of the resources permissions can refer to.
+type iamSnapshot struct {
+	workspace *segment.Workspace
+	client    *segment.Client
+	users     []segment.User
+	groups    []segment.Group
+	// members are the members of every group, keyed by group ID.
+	members map[string][]segment.User
+	// resourceNames are the names of the synced resources, keyed by Segment resource type and ID.
+	resourceNames map[string]map[string]string
+	// resourceLabels are the labels of the synced sources as key:value, keyed by connector resource type and ID.
+	resourceLabels map[string]map[string][]string
+}
+
+// userGetter returns the details of a user, with their permissions.
+type userGetter func(ctx context.Context, userID string) (*segment.User, error)
+
+// loadIAMSnapshot reads the users, groups, group members and resources of the workspace. The details of the users are
+// read with getUser. Groups are always read, since access held through them counts whether or not groups are synced,
+// while resources of types that aren't synced are not listed.
+func loadIAMSnapshot(
+	ctx context.Context,
+	client *segment.Client,
+	workspace *segment.Workspace,
+	syncTypes resourceTypeSet,
+	getUser userGetter,
+) (*iamSnapshot, error) {
+	snapshot := &iamSnapshot{
+		workspace:      workspace,
+		client:         client,
+		members:        make(map[string][]segment.User),
+		resourceNames:  make(map[string]map[string]string),
+		resourceLabels: make(map[string]map[string][]string),
+	}
+
+	err := paginate(ctx, client.ListUsers, func(user segment.User) error {
+		details, err := getUser(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to get user %s: %w", user.ID, err)
+		}
+		snapshot.users = append(snapshot.users, *details)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = paginate(ctx, client.ListGroups, func(group segment.Group) error {
+		details, err := client.GetGroup(ctx, group.ID)
+		if err != nil {
+			return fmt.Errorf("baton-segment: failed to get group %s: %w", group.ID, err)
+		}
+		snapshot.groups = append(snapshot.groups, *details)
+
+		return paginate(
+			ctx,
+			func(ctx context.Context, cursor string) ([]segment.User, string, error) {
+				return client.ListGroupMembers(ctx, group.ID, cursor)
+			},
+			func(member segment.User) error {
+				snapshot.members[group.ID] = append(snapshot.members[group.ID], member)
+				return nil
+			},
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := snapshot.loadResources(ctx, syncTypes); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// loadResources reads the names of the resources of the synced types, and the labels of the sources. Every synced
+// type has an entry in resourceNames, even without resources.
+func (s *iamSnapshot) loadResources(ctx context.Context, syncTypes resourceTypeSet) error {
+	client := s.client
+	s.resourceNames[workspaceType] = map[string]string{s.workspace.ID: s.workspace.Name}
+
+	for segmentType, resourceType := range permissionResourceTypes {
+		if segmentType != workspaceType && syncTypes.has(resourceType.Id) {
+			s.resourceNames[segmentType] = make(map[string]string)
+		}
+	}
+
+	if syncTypes.has(sourceResourceType.Id) {
+		err := paginate(ctx, client.ListSources, func(source segment.Source) error {
+			s.addResource(sourceType, source.ID, source.Name)
+			for _, label := range source.Labels {
+				s.addLabel(sourceResourceType.Id, source.ID, fmt.Sprintf("%s:%s", label.Key, label.Value))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if syncTypes.has(warehouseResourceType.Id) {
+		err := paginate(ctx, client.ListWarehouses, func(warehouse segment.Warehouse) error {
+			s.addResource(warehouseType, warehouse.ID, warehouse.Metadata.Name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if syncTypes.has(functionResourceType.Id) {
+		for _, t := range functionTypes {
+			fnType := t
+			err := paginate(
+				ctx,
+				func(ctx context.Context, cursor string) ([]segment.Function, string, error) {
+					return client.ListFunctions(ctx, cursor, fnType)
+				},
+				func(function segment.Function) error {
+					s.addResource(functionType, function.ID, function.DisplayName)
+					return nil
+				},
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if syncTypes.has(spaceResourceType.Id) {
+		err := paginate(ctx, client.ListSpaces, func(space segment.Space) error {
+			s.addResource(spaceType, space.ID, space.Name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *iamSnapshot) addResource(resourceType, id, name string) {
+	if s.resourceNames[resourceType] == nil {
+		s.resourceNames[resourceType] = make(map[string]string)
+	}
+	s.resourceNames[resourceType][id] = name
+}
+
+func (s *iamSnapshot) addLabel(resourceType, id, label string) {
+	if s.resourceLabels[resourceType] == nil {
+		s.resourceLabels[resourceType] = make(map[string][]string)
+	}
+	s.resourceLabels[resourceType][id] = append(s.resourceLabels[resourceType][id], label)
+}
+
+// resourceName returns the name of a resource, or its ID when the resource wasn't listed.
+func (s *iamSnapshot) resourceName(resource segment.Resource) string {
+	if name, ok := s.resourceNames[resource.Type][resource.ID]; ok {
+		return name
+	}
+
+	return resource.ID
+}
+
+// userGroups returns the groups the user is a member of.
+func (s *iamSnapshot) userGroups(userID string) []segment.Group {
+	var rv []segment.Group
+	for _, group := range s.groups {
+		for _, member := range s.members[group.ID] {
+			if member.ID == userID {
+				rv = append(rv, group)
+				break
+			}
+		}
+	}
+
+	return rv
+}
+
+// paginate calls fn with every item of a paginated list.
+func paginate[T any](ctx context.Context, list func(ctx context.Context, cursor string) ([]T, string, error), fn func(T) error) error {
+	var cursor string
+	for {
+		items, nextCursor, err := list(ctx, cursor)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+
+		if nextCursor == "" {
+			return nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// snapshots loads the IAM snapshot of every configured workspace.
+func (s *Segment) snapshots(ctx context.Context) ([]*iamSnapshot, error) {
+	workspaces, err := s.clients.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []*iamSnapshot
+	for _, workspace := range workspaces {
+		client, err := s.clients.get(ctx, workspace.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshot, err := loadIAMSnapshot(ctx, client, workspace, s.syncTypes, client.GetUser)
+		if err != nil {
+			return nil, fmt.Errorf("baton-segment: failed to read workspace %s: %w", workspace.Name, err)
+		}
+		rv = append(rv, snapshot)
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,325 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+// SoDRules are separation of duties rules, checked against the effective access of every user.
+type SoDRules struct {
+	Rules []SoDRule `yaml:"rules"`
+}
+
+// SoDRule is a set of roles no user may hold at the same time.
+type SoDRule struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Workspaces are the IDs or names of the workspaces the rule applies to, all workspaces if empty.
+	Workspaces []string `yaml:"workspaces"`
+	// Conflicts are the roles of the rule. A user matching every one of them violates the rule.
+	Conflicts []SoDCondition `yaml:"conflicts"`
+}
+
+// SoDCondition matches a role held on some resources. Roles held on the whole workspace match any resource.
+type SoDCondition struct {
+	// Role is the name or ID of the role.
+	Role string `yaml:"role"`
+	// ResourceType is the type of resource the role is held on, any type if empty.
+	ResourceType string `yaml:"resource_type"`
+	// Resources are the IDs or names of the resources the role is held on, any resource if empty.
+	Resources []string `yaml:"resources"`
+	// Labels are the key:value labels the resource must all have. Only sources have labels.
+	Labels []string `yaml:"labels"`
+}
+
+// SoDViolation is a user holding all the conflicting roles of a rule.
+type SoDViolation struct {
+	Rule          string `json:"rule"`
+	Description   string `json:"description,omitempty"`
+	WorkspaceID   string `json:"workspace_id"`
+	WorkspaceName string `json:"workspace_name"`
+	UserID        string `json:"user_id"`
+	UserEmail     string `json:"user_email"`
+	UserName      string `json:"user_name"`
+	// Access is the access of the user matching the conflicting roles of the rule.
+	Access []Access `json:"access"`
+}
+
+// LoadSoDRules reads separation of duties rules from a YAML file.
+func LoadSoDRules(path string) (*SoDRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to read SoD rules: %w", err)
+	}
+
+	var rules SoDRules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to parse SoD rules: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range rules.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("baton-segment: SoD rule %d has no name", i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("baton-segment: SoD rule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if len(rule.Conflicts) < 2 {
+			return nil, fmt.Errorf("baton-segment: SoD rule %s must have at least two conflicting roles", rule.Name)
+		}
+		for _, condition := range rule.Conflicts {
+			if condition.Role == "" {
+				return nil, fmt.Errorf("baton-segment: SoD rule %s has a conflict without a role", rule.Name)
+			}
+		}
+	}
+
+	return &rules, nil
+}
+
+// SoDViolations checks the effective access of the users of every configured workspace, held directly, through
+// groups or on the whole workspace, against the rules.
+func (s *Segment) SoDViolations(ctx context.Context, rules *SoDRules) ([]SoDViolation, error) {
+	snapshots, err := s.snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []SoDViolation
+	for _, snapshot := range snapshots {
+		rv = append(rv, rules.evaluate(snapshot)...)
+	}
+
+	return rv, nil
+}
+
+// evaluate returns the violations of the rules in the workspace of the snapshot, sorted by user email.
+func (r *SoDRules) evaluate(snapshot *iamSnapshot) []SoDViolation {
+	access := make(map[string][]Access)
+	for _, a := range snapshot.accessMatrix() {
+		access[a.UserID] = append(access[a.UserID], a)
+	}
+
+	users := make([]segment.User, len(snapshot.users))
+	copy(users, snapshot.users)
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].Email < users[j].Email
+	})
+
+	var rv []SoDViolation
+	for _, rule := range r.Rules {
+		if !rule.appliesTo(snapshot.workspace) {
+			continue
+		}
+
+		for _, user := range users {
+			matched, ok := rule.match(snapshot, access[user.ID])
+			if !ok {
+				continue
+			}
+
+			rv = append(rv, SoDViolation{
+				Rule:          rule.Name,
+				Description:   rule.Description,
+				WorkspaceID:   snapshot.workspace.ID,
+				WorkspaceName: snapshot.workspace.Name,
+				UserID:        user.ID,
+				UserEmail:     user.Email,
+				UserName:      user.Name,
+				Access:        matched,
+			})
+		}
+	}
+
+	return rv
+}
+
+func (r SoDRule) appliesTo(workspace *segment.Workspace) bool {
+	if len(r.Workspaces) == 0 {
+		return true
+	}
+
+	for _, w := range r.Workspaces {
+		if w == workspace.ID || strings.EqualFold(w, workspace.Name) || strings.EqualFold(w, workspace.Slug) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// match returns the access matching the conflicting roles of the rule, and whether every one of them is matched.
+func (r SoDRule) match(snapshot *iamSnapshot, access []Access) ([]Access, bool) {
+	var rv []Access
+	for _, condition := range r.Conflicts {
+		found := false
+		for _, a := range access {
+			if condition.matches(snapshot, a) {
+				rv = append(rv, a)
+				found = true
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+
+	return rv, true
+}
+
+func (c SoDCondition) matches(snapshot *iamSnapshot, access Access) bool {
+	if c.Role != access.RoleID && !strings.EqualFold(c.Role, access.RoleName) {
+		return false
+	}
+
+	// roles held on the workspace apply to every resource of the workspace.
+	if access.ResourceType == workspaceResourceType.Id {
+		return true
+	}
+
+	if c.ResourceType != "" && !strings.EqualFold(c.ResourceType, access.ResourceType) {
+		return false
+	}
+
+	if len(c.Resources) > 0 {
+		found := false
+		for _, resource := range c.Resources {
+			found = found || resource == access.ResourceID || strings.EqualFold(resource, access.ResourceName)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	labels := snapshot.resourceLabels[access.ResourceType][access.ResourceID]
+	for _, label := range c.Labels {
+		found := false
+		for _, l := range labels {
+			found = found || strings.EqualFold(label, l)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sodSync holds the SoD violations of the users of every workspace for the duration of a sync, so they can be
+// annotated on the user resources.
+type sodSync struct {
+	rules *SoDRules
+
+	mu sync.Mutex
+	// violations are keyed by workspace ID and user ID.
+	violations map[string]map[string][]SoDViolation
+}
+
+func newSoDSync(rules *SoDRules) *sodSync {
+	if rules == nil {
+		return nil
+	}
+
+	return &sodSync{
+		rules:      rules,
+		violations: make(map[string]map[string][]SoDViolation),
+	}
+}
+
+// load checks the rules against the workspace when a sync lists its users from the first page. The details of all
+// users are fetched through the user cache, so they aren't fetched again when the pages are listed.
+func (s *sodSync) load(ctx context.Context, clients *workspaceClients, workspaceID string, syncTypes resourceTypeSet, cache *userCache) error {
+	l := ctxzap.Extract(ctx)
+
+	// the violations of the previous sync must not be annotated if this one fails to check the rules.
+	s.mu.Lock()
+	delete(s.violations, workspaceID)
+	s.mu.Unlock()
+
+	client, err := clients.get(ctx, workspaceID)
+	if err != nil {
+		return err
+	}
+	workspace, err := clients.workspace(ctx, workspaceID)
+	if err != nil {
+		return err
+	}
+
+	var users []segment.User
+	err = paginate(ctx, client.ListUsers, func(user segment.User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := cache.fetch(ctx, client, workspaceID, users); err != nil {
+		return err
+	}
+
+	snapshot, err := loadIAMSnapshot(ctx, client, workspace, syncTypes, func(ctx context.Context, userID string) (*segment.User, error) {
+		return cache.get(ctx, client, workspaceID, userID)
+	})
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to check SoD rules: %w", err)
+	}
+
+	violations := make(map[string][]SoDViolation)
+	for _, violation := range s.rules.evaluate(snapshot) {
+		l.Warn(
+			"baton-segment: user violates SoD rule",
+			zap.String("rule", violation.Rule),
+			zap.String("workspace_id", workspaceID),
+			zap.String("user_id", violation.UserID),
+			zap.String("user_email", violation.UserEmail),
+		)
+		violations[violation.UserID] = append(violations[violation.UserID], violation)
+	}
+
+	s.mu.Lock()
+	s.violations[workspaceID] = violations
+	s.mu.Unlock()
+
+	return nil
+}
+
+// annotations returns an annotation for every rule the user violates.
+func (s *sodSync) annotations(workspaceID, userID string) []proto.Message {
+	s.mu.Lock()
+	violations := s.violations[workspaceID][userID]
+	s.mu.Unlock()
+
+	var rv []proto.Message
+	for _, violation := range violations {
+		access := make([]interface{}, 0, len(violation.Access))
+		for _, a := range violation.Access {
+			access = append(access, fmt.Sprintf("%s on %s %s", a.RoleName, a.ResourceType, a.ResourceName))
+		}
+
+		annotation, err := structpb.NewStruct(map[string]interface{}{
+			"sod_violation": violation.Rule,
+			"description":   violation.Description,
+			"access":        access,
+		})
+		if err != nil {
+			continue
+		}
+		rv = append(rv, annotation)
+	}
+
+	return rv
+}
@@ -0,0 +1,249 @@
+package connector
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+var testWarehouseAdminRole = segment.Role{ID: "r-warehouse-admin", Name: "Warehouse Admin"}
+
+func testWarehousePermission(role segment.Role, warehouseIDs ...string) segment.Permission {
+	permission := segment.Permission{RoleID: role.ID, RoleName: role.Name}
+	for _, id := range warehouseIDs {
+		permission.Resources = append(permission.Resources, segment.Resource{ID: id, Type: warehouseType})
+	}
+
+	return permission
+}
+
+// newSoDSnapshot returns a snapshot of a workspace with the users and groups, where the Admins group holds the
+// Warehouse Admin role on the prod warehouse, and the web source is labelled env:prod.
+func newSoDSnapshot(users []segment.User, members []segment.User) *iamSnapshot {
+	admins := segment.Group{ID: "g-admins", Name: "Admins", Permissions: []segment.Permission{testWarehousePermission(testWarehouseAdminRole, "w-prod")}}
+	snapshot := &iamSnapshot{
+		workspace:      &segment.Workspace{ID: testWorkspaceID, Name: "Production", Slug: "production"},
+		users:          users,
+		groups:         []segment.Group{admins},
+		members:        map[string][]segment.User{admins.ID: members},
+		resourceNames:  make(map[string]map[string]string),
+		resourceLabels: make(map[string]map[string][]string),
+	}
+	snapshot.addResource(sourceType, "s-web", "Web")
+	snapshot.addResource(sourceType, "s-dev", "Dev")
+	snapshot.addResource(warehouseType, "w-prod", "Prod")
+	snapshot.addLabel(sourceResourceType.Id, "s-web", "env:prod")
+	snapshot.addLabel(sourceResourceType.Id, "s-dev", "env:dev")
+
+	return snapshot
+}
+
+func TestSoDRulesEvaluate(t *testing.T) {
+	rule := SoDRule{
+		Name: "source-warehouse-admin",
+		Conflicts: []SoDCondition{
+			{Role: "Source Admin", ResourceType: "source", Labels: []string{"env:prod"}},
+			{Role: testWarehouseAdminRole.ID, Resources: []string{"prod"}},
+		},
+	}
+	sourceAdmin := segment.Role{ID: "r-source-admin", Name: "Source Admin"}
+
+	tests := []struct {
+		name      string
+		rule      SoDRule
+		user      segment.User
+		inGroup   bool
+		wantRoles []string
+	}{
+		{
+			name:      "both roles held directly",
+			rule:      rule,
+			user:      segment.User{Permissions: []segment.Permission{testSourcePermission(sourceAdmin, "s-web"), testWarehousePermission(testWarehouseAdminRole, "w-prod")}},
+			wantRoles: []string{"Source Admin", "Warehouse Admin"},
+		},
+		{
+			name:      "role held through a group",
+			rule:      rule,
+			user:      segment.User{Permissions: []segment.Permission{testSourcePermission(sourceAdmin, "s-web")}},
+			inGroup:   true,
+			wantRoles: []string{"Source Admin", "Warehouse Admin"},
+		},
+		{
+			name:      "workspace-wide role matches any resource",
+			rule:      rule,
+			user:      segment.User{Permissions: []segment.Permission{testWorkspacePermission(sourceAdmin)}},
+			inGroup:   true,
+			wantRoles: []string{"Source Admin", "Warehouse Admin"},
+		},
+		{
+			name:    "label not matched",
+			rule:    rule,
+			user:    segment.User{Permissions: []segment.Permission{testSourcePermission(sourceAdmin, "s-dev")}},
+			inGroup: true,
+		},
+		{
+			name: "one role only",
+			rule: rule,
+			user: segment.User{Permissions: []segment.Permission{testSourcePermission(sourceAdmin, "s-web")}},
+		},
+		{
+			name:    "rule scoped to another workspace",
+			rule:    SoDRule{Name: rule.Name, Workspaces: []string{"staging"}, Conflicts: rule.Conflicts},
+			user:    segment.User{Permissions: []segment.Permission{testSourcePermission(sourceAdmin, "s-web")}},
+			inGroup: true,
+		},
+		{
+			name:      "rule scoped to the workspace by slug",
+			rule:      SoDRule{Name: rule.Name, Workspaces: []string{"PRODUCTION"}, Conflicts: rule.Conflicts},
+			user:      segment.User{Permissions: []segment.Permission{testSourcePermission(sourceAdmin, "s-web")}},
+			inGroup:   true,
+			wantRoles: []string{"Source Admin", "Warehouse Admin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := tt.user
+			user.ID, user.Email = "u-jane", "jane@example.com"
+			var members []segment.User
+			if tt.inGroup {
+				members = append(members, user)
+			}
+			snapshot := newSoDSnapshot([]segment.User{{ID: "u-bob", Email: "bob@example.com"}, user}, members)
+
+			violations := (&SoDRules{Rules: []SoDRule{tt.rule}}).evaluate(snapshot)
+			if len(tt.wantRoles) == 0 {
+				if len(violations) != 0 {
+					t.Fatalf("violations = %+v, want none", violations)
+				}
+				return
+			}
+			if len(violations) != 1 || violations[0].UserID != user.ID || violations[0].Rule != tt.rule.Name {
+				t.Fatalf("violations = %+v, want one of %s", violations, user.ID)
+			}
+
+			var roles []string
+			for _, access := range violations[0].Access {
+				roles = append(roles, access.RoleName)
+			}
+			if !reflect.DeepEqual(roles, tt.wantRoles) {
+				t.Errorf("matched roles = %q, want %q", roles, tt.wantRoles)
+			}
+		})
+	}
+}
+
+func TestSoDConditionMatches(t *testing.T) {
+	snapshot := newSoDSnapshot(nil, nil)
+	web := Access{ResourceType: sourceResourceType.Id, ResourceID: "s-web", ResourceName: "Web", RoleID: "r-source-admin", RoleName: "Source Admin"}
+
+	tests := []struct {
+		name      string
+		condition SoDCondition
+		want      bool
+	}{
+		{name: "role by name", condition: SoDCondition{Role: "source admin"}, want: true},
+		{name: "role by ID", condition: SoDCondition{Role: "r-source-admin"}, want: true},
+		{name: "other role", condition: SoDCondition{Role: "Source Read-only"}},
+		{name: "resource type", condition: SoDCondition{Role: "Source Admin", ResourceType: "SOURCE"}, want: true},
+		{name: "other resource type", condition: SoDCondition{Role: "Source Admin", ResourceType: "warehouse"}},
+		{name: "resource by name", condition: SoDCondition{Role: "Source Admin", Resources: []string{"web"}}, want: true},
+		{name: "resource by ID", condition: SoDCondition{Role: "Source Admin", Resources: []string{"s-dev", "s-web"}}, want: true},
+		{name: "other resource", condition: SoDCondition{Role: "Source Admin", Resources: []string{"s-dev"}}},
+		{name: "label", condition: SoDCondition{Role: "Source Admin", Labels: []string{"ENV:PROD"}}, want: true},
+		{name: "every label required", condition: SoDCondition{Role: "Source Admin", Labels: []string{"env:prod", "team:data"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.condition.matches(snapshot, web); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSoDRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr string
+	}{
+		{
+			name: "valid rules",
+			rules: `rules:
+  - name: source-warehouse-admin
+    conflicts:
+      - role: Source Admin
+        resource_type: source
+        labels: [env:prod]
+      - role: Warehouse Admin
+`,
+		},
+		{
+			name:    "invalid YAML",
+			rules:   "rules: [",
+			wantErr: "failed to parse SoD rules",
+		},
+		{
+			name: "rule without a name",
+			rules: `rules:
+  - conflicts: [{role: Source Admin}, {role: Warehouse Admin}]
+`,
+			wantErr: "SoD rule 1 has no name",
+		},
+		{
+			name: "rule defined twice",
+			rules: `rules:
+  - name: admins
+    conflicts: [{role: Source Admin}, {role: Warehouse Admin}]
+  - name: admins
+    conflicts: [{role: Source Admin}, {role: Function Admin}]
+`,
+			wantErr: "SoD rule admins is defined twice",
+		},
+		{
+			name: "single conflicting role",
+			rules: `rules:
+  - name: admins
+    conflicts: [{role: Source Admin}]
+`,
+			wantErr: "must have at least two conflicting roles",
+		},
+		{
+			name: "conflict without a role",
+			rules: `rules:
+  - name: admins
+    conflicts: [{role: Source Admin}, {resource_type: source}]
+`,
+			wantErr: "has a conflict without a role",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sod.yaml")
+			if err := os.WriteFile(path, []byte(tt.rules), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := LoadSoDRules(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(rules.Rules) != 1 || len(rules.Rules[0].Conflicts[0].Labels) != 1 {
+					t.Errorf("rules = %+v, want the rule with its conditions", rules.Rules)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadSoDRules() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,19 +2,31 @@ package connector
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/url"
 	"strings"
+	"time"
 
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 	"github.com/conductorone/baton-sdk/pkg/annotations"
 	"github.com/conductorone/baton-sdk/pkg/pagination"
 	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
 	"github.com/conductorone/baton-segment/pkg/segment"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type sourceResourceBuilder struct {
-	resourceType *v2.ResourceType
-	client       *segment.Client
+	resourceType        *v2.ResourceType
+	clients             *workspaceClients
+	policy              *ProvisioningPolicy
+	provisioner         *provisioner
+	removeOldWriteKeys  bool
+	writeKeyGracePeriod time.Duration
+	removals            *writeKeyRemovals
 }
 
 func (s *sourceResourceBuilder) ResourceType(_ context.Context) *v2.ResourceType {
@@ -22,14 +34,62 @@ func (s *sourceResourceBuilder) ResourceType(_ context.Context) *v2.ResourceType
 }
 
 // Create a new connector resource for an Segment Source.
-func sourceResource(source *segment.Source, parentResourceID *v2.ResourceId) (*v2.Resource, error) {
-	resource, err := rs.NewResource(
+func sourceResource(source *segment.Source, parentResourceID *v2.ResourceId, workspaceSlug string, clients *workspaceClients) (*v2.Resource, error) {
+	categories := make([]interface{}, 0, len(source.Metadata.Categories))
+	for _, category := range source.Metadata.Categories {
+		categories = append(categories, category)
+	}
+
+	labels := make([]interface{}, 0, len(source.Labels))
+	for _, label := range source.Labels {
+		labels = append(labels, fmt.Sprintf("%s:%s", label.Key, label.Value))
+	}
+
+	profile := map[string]interface{}{
+		"source_id":             source.ID,
+		"source_slug":           source.Slug,
+		"integration_name":      source.Metadata.Name,
+		"integration_slug":      source.Metadata.Slug,
+		"categories":            categories,
+		"enabled":               source.Enabled,
+		"is_cloud_event_source": source.Metadata.IsCloudEventSource,
+		"labels":                labels,
+		// only the number of write keys is tracked, the keys themselves are secrets. Their age isn't: Segment lists
+		// write keys as bare strings, without the time they were created.
+		"write_key_count": len(source.WriteKeys),
+	}
+
+	resourceID := clients.scopedID(parentResourceID.Resource, source.ID)
+	appTraitOptions := []rs.AppTraitOption{
+		rs.WithAppProfile(profile),
+	}
+	// the icon is served by GetAsset, which looks the logo up again from the source.
+	if source.Metadata.Logos.Default != "" {
+		appTraitOptions = append(appTraitOptions, rs.WithAppIcon(&v2.AssetRef{Id: sourceIconAssetID(resourceID)}))
+	}
+	if !source.Enabled {
+		appTraitOptions = append(appTraitOptions, rs.WithAppFlags(v2.AppTrait_APP_FLAG_INACTIVE))
+	}
+
+	resourceOptions := []rs.ResourceOption{
+		rs.WithParentResourceID(parentResourceID),
+		rs.WithDescription(source.Metadata.Description),
+	}
+	if workspaceSlug != "" && source.Slug != "" {
+		link, err := url.JoinPath(segment.AppUrl, workspaceSlug, "sources", source.Slug, "overview")
+		if err != nil {
+			return nil, err
+		}
+		resourceOptions = append(resourceOptions, rs.WithAnnotation(&v2.ExternalLink{Url: link}))
+	}
+
+	resource, err := rs.NewAppResource(
 		source.Name,
 		sourceResourceType,
-		source.ID,
-		rs.WithParentResourceID(parentResourceID),
+		resourceID,
+		appTraitOptions,
+		resourceOptions...,
 	)
-
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +107,17 @@ func (s *sourceResourceBuilder) List(ctx context.Context, parentResourceID *v2.R
 		return nil, "", nil, err
 	}
 
-	sources, nextCursor, err := s.client.ListSources(ctx, page)
+	workspace, err := s.clients.workspace(ctx, parentResourceID.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	client, err := s.clients.get(ctx, parentResourceID.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	sources, nextCursor, err := client.ListSources(ctx, page)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -60,7 +130,7 @@ func (s *sourceResourceBuilder) List(ctx context.Context, parentResourceID *v2.R
 	var rv []*v2.Resource
 	for _, source := range sources {
 		sourceCopy := source
-		sr, err := sourceResource(&sourceCopy, parentResourceID)
+		sr, err := sourceResource(&sourceCopy, parentResourceID, workspace.Slug, s.clients)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -77,7 +147,12 @@ func (s *sourceResourceBuilder) Entitlements(ctx context.Context, resource *v2.R
 		return nil, "", nil, err
 	}
 
-	roles, nextCursor, err := s.client.ListRoles(ctx, page)
+	client, err := s.clients.get(ctx, resource.ParentResourceId.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	roles, nextCursor, err := client.ListRoles(ctx, page)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -103,14 +178,27 @@ func (s *sourceResourceBuilder) Grants(ctx context.Context, resource *v2.Resourc
 }
 
 func (s *sourceResourceBuilder) Grant(ctx context.Context, principal *v2.Resource, entitlement *v2.Entitlement) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, grantTask(entitlement))
+
 	roleID, resourceType := getRoleIdAndResourceType(entitlement)
-	resourceID := entitlement.Resource.Id.Resource
-	permissions, err := grantPermissions(ctx, s.client, principal, roleID, resourceType, resourceID)
+	if err := s.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+	if err := s.policy.checkRole(roleID, getRoleName(entitlement)); err != nil {
+		return nil, err
+	}
+
+	client, resourceID, principalID, err := s.clients.forGrant(ctx, entitlement.Resource.Id, principal)
 	if err != nil {
 		return nil, err
 	}
 
-	err = s.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, permissions)
+	current, permissions, err := grantPermissions(ctx, client, principal, principalID, roleID, resourceType, resourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.provisioner.updatePermissions(ctx, client, principal, principalID, current, permissions)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"baton-segment: failed to add permission to %s %s for source resource %s: %w",
@@ -125,16 +213,26 @@ func (s *sourceResourceBuilder) Grant(ctx context.Context, principal *v2.Resourc
 }
 
 func (s *sourceResourceBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, revokeTask(grant))
+
 	entitlement := grant.Entitlement
 	principal := grant.Principal
-	roleID, _ := getRoleIdAndResourceType(entitlement)
+	if err := s.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
 
-	permissions, err := revokePermissions(ctx, s.client, principal, roleID)
+	client, _, principalID, err := s.clients.forGrant(ctx, entitlement.Resource.Id, principal)
 	if err != nil {
 		return nil, err
 	}
 
-	err = s.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, permissions)
+	roleID, _ := getRoleIdAndResourceType(entitlement)
+	current, permissions, err := revokePermissions(ctx, client, principal, principalID, roleID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.provisioner.updatePermissions(ctx, client, principal, principalID, current, permissions)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"baton-segment: failed to remove permission from %s %s for source resource %s: %w",
@@ -148,9 +246,140 @@ func (s *sourceResourceBuilder) Revoke(ctx context.Context, grant *v2.Grant) (an
 	return nil, nil
 }
 
-func newSourceBuilder(client *segment.Client) *sourceResourceBuilder {
+// Rotate creates a new write key for the source and returns it. Previous write keys are removed right away when
+// removal of old keys is enabled, or recorded in the write key removal file and removed by the first rotation or
+// remove-write-keys run after the configured grace period. Once the new key is created it's always returned, and
+// failures to remove or schedule the removal of the previous keys are logged.
+func (s *sourceResourceBuilder) Rotate(ctx context.Context, resourceId *v2.ResourceId, _ *v2.CredentialOptions) ([]*v2.PlaintextData, annotations.Annotations, error) {
+	l := ctxzap.Extract(ctx)
+
+	if resourceId.ResourceType != sourceResourceType.Id {
+		return nil, nil, fmt.Errorf("baton-segment: only sources can have write keys rotated")
+	}
+
+	task := &provisioningTask{Action: "rotate_credentials", ResourceID: resourceId.Resource}
+	ctx = withProvisioningTask(ctx, task)
+
+	// a rotation can't return a write key without creating it.
+	if s.provisioner.dryRun {
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "baton-segment: write keys can't be rotated in dry run mode")
+	}
+
+	if s.removeOldWriteKeys && s.writeKeyGracePeriod > 0 && s.removals == nil {
+		return nil, nil, status.Errorf(
+			codes.FailedPrecondition,
+			"baton-segment: a write key removal file is required to remove previous write keys after a grace period",
+		)
+	}
+
+	// removals scheduled by earlier rotations are made first, they don't depend on this one.
+	if err := s.removals.removeDue(ctx); err != nil {
+		l.Error("baton-segment: failed to remove previous write keys after their grace period", zap.Error(err))
+	}
+
+	client, sourceID, err := s.clients.forResource(ctx, resourceId)
+	if err != nil {
+		return nil, nil, err
+	}
+	workspaceID, err := s.clients.workspaceOf(ctx, resourceId.Resource)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	source, err := client.GetSource(ctx, sourceID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("baton-segment: failed to get source %s while rotating write key: %w", sourceID, err)
+	}
+
+	updated, err := s.provisioner.createWriteKey(ctx, client, sourceID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("baton-segment: failed to create write key for source %s: %w", sourceID, err)
+	}
+
+	oldKeys := make(map[string]bool, len(source.WriteKeys))
+	for _, key := range source.WriteKeys {
+		oldKeys[key] = true
+	}
+
+	var newKey string
+	for _, key := range updated.WriteKeys {
+		if !oldKeys[key] {
+			newKey = key
+			break
+		}
+	}
+	if newKey == "" {
+		return nil, nil, fmt.Errorf("baton-segment: no new write key returned for source %s", sourceID)
+	}
+
+	// the new write key exists from here on, so it's returned even when the previous ones can't be removed: failing
+	// the rotation would leave it on the source without anyone holding it.
+	if s.removeOldWriteKeys && len(source.WriteKeys) > 0 {
+		if s.writeKeyGracePeriod > 0 {
+			// the rotation may be the only thing this run does, so the removal is recorded for a later run to make.
+			err := s.removals.schedule(workspaceID, sourceID, source.WriteKeys, s.writeKeyGracePeriod)
+			if err != nil {
+				l.Error(
+					"baton-segment: created a write key but failed to schedule the removal of the previous ones, they must be removed by hand",
+					zap.String("source_id", sourceID),
+					zap.Int("write_key_count", len(source.WriteKeys)),
+					zap.Error(err),
+				)
+			} else {
+				l.Info(
+					"baton-segment: scheduled removal of previous write keys",
+					zap.String("source_id", sourceID),
+					zap.Int("write_key_count", len(source.WriteKeys)),
+					zap.Duration("grace_period", s.writeKeyGracePeriod),
+				)
+			}
+		} else if err := removeWriteKeys(ctx, s.provisioner, client, sourceID, source.WriteKeys); err != nil {
+			l.Error(
+				"baton-segment: created a write key but failed to remove the previous ones, they must be removed by hand",
+				zap.String("source_id", sourceID),
+				zap.Error(err),
+			)
+		}
+	}
+
+	return []*v2.PlaintextData{
+		{
+			Name:        "write_key",
+			Description: fmt.Sprintf("Write key for Segment source %s", source.Name),
+			Bytes:       []byte(newKey),
+		},
+	}, nil, nil
+}
+
+// removeWriteKeys removes the given write keys from the source, and returns the errors of the ones that could not
+// be removed.
+func removeWriteKeys(ctx context.Context, provisioner *provisioner, client *segment.Client, sourceID string, keys []string) error {
+	var errs []error
+	for i, key := range keys {
+		err := provisioner.removeWriteKey(ctx, client, sourceID, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("baton-segment: failed to remove previous write key %d of source %s: %w", i, sourceID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func newSourceBuilder(
+	clients *workspaceClients,
+	policy *ProvisioningPolicy,
+	provisioner *provisioner,
+	removeOldWriteKeys bool,
+	writeKeyGracePeriod time.Duration,
+	removals *writeKeyRemovals,
+) *sourceResourceBuilder {
 	return &sourceResourceBuilder{
-		resourceType: sourceResourceType,
-		client:       client,
+		resourceType:        sourceResourceType,
+		clients:             clients,
+		policy:              policy,
+		provisioner:         provisioner,
+		removeOldWriteKeys:  removeOldWriteKeys,
+		writeKeyGracePeriod: writeKeyGracePeriod,
+		removals:            removals,
 	}
 }
@@ -0,0 +1,132 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		name          string
+		gracePeriod   time.Duration
+		removalPath   func(dir string) string
+		removalStatus int
+		wantRemoved   bool
+		wantScheduled bool
+	}{
+		{
+			name:          "previous key removed",
+			removalStatus: http.StatusOK,
+			wantRemoved:   true,
+		},
+		{
+			name:          "previous key removal failed",
+			removalStatus: http.StatusInternalServerError,
+			wantRemoved:   true,
+		},
+		{
+			name:          "previous key removal scheduled",
+			gracePeriod:   time.Hour,
+			removalPath:   func(dir string) string { return filepath.Join(dir, "removals.json") },
+			wantScheduled: true,
+		},
+		{
+			name:        "previous key removal failed to be scheduled",
+			gracePeriod: time.Hour,
+			removalPath: func(dir string) string { return filepath.Join(dir, "missing", "removals.json") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSegment(t)
+			fake.handle(http.MethodGet, "/sources/s1", respondData(t, "source", segment.Source{ID: "s1", Name: "Web", WriteKeys: []string{"old-key"}}))
+			fake.handle(http.MethodPost, "/sources/s1/writekeys", respondData(t, "source", segment.Source{ID: "s1", Name: "Web", WriteKeys: []string{"old-key", "new-key"}}))
+			fake.handle(http.MethodDelete, "/sources/s1/writekeys/old-key", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.removalStatus)
+				respondData(t, "source", segment.Source{ID: "s1", Name: "Web", WriteKeys: []string{"new-key"}})(w, r)
+			})
+
+			clients := fake.clients()
+			provisioner := newProvisioner(false, nil)
+			var removals *writeKeyRemovals
+			var removalPath string
+			if tt.removalPath != nil {
+				removalPath = tt.removalPath(t.TempDir())
+				removals = newWriteKeyRemovals(removalPath, clients, provisioner)
+			}
+			builder := newSourceBuilder(clients, &ProvisioningPolicy{}, provisioner, true, tt.gracePeriod, removals)
+
+			before := len(fake.requested())
+			plaintexts, _, err := builder.Rotate(context.Background(), &v2.ResourceId{ResourceType: sourceResourceType.Id, Resource: "s1"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plaintexts) != 1 || string(plaintexts[0].Bytes) != "new-key" {
+				t.Fatalf("Rotate() returned %v, want the new write key", plaintexts)
+			}
+
+			removed := false
+			for _, request := range fake.requested()[before:] {
+				if request == "DELETE /sources/s1/writekeys/old-key" {
+					removed = true
+				}
+			}
+			if removed != tt.wantRemoved {
+				t.Errorf("previous key removed = %v, want %v", removed, tt.wantRemoved)
+			}
+
+			if removalPath == "" {
+				return
+			}
+			var state writeKeyRemovalState
+			if err := readStateFile(removalPath, &state); err != nil {
+				t.Fatal(err)
+			}
+			if scheduled := len(state.Removals) == 1; scheduled != tt.wantScheduled {
+				t.Errorf("removal scheduled = %v, want %v", scheduled, tt.wantScheduled)
+			}
+		})
+	}
+}
+
+func TestRemoveDueWriteKeys(t *testing.T) {
+	fake := newFakeSegment(t)
+	fake.handle(http.MethodGet, "/sources/s1", respondData(t, "source", segment.Source{ID: "s1", WriteKeys: []string{"old-key", "new-key"}}))
+	fake.handle(http.MethodDelete, "/sources/s1/writekeys/old-key", respondData(t, "source", segment.Source{ID: "s1", WriteKeys: []string{"new-key"}}))
+
+	clients := fake.clients()
+	path := filepath.Join(t.TempDir(), "removals.json")
+	now := time.Now().UTC()
+	due := writeKeyRemoval{WorkspaceID: testWorkspaceID, SourceID: "s1", KeyHashes: []string{hashWriteKey("old-key")}, RemoveAfter: now.Add(-time.Minute)}
+	pending := writeKeyRemoval{WorkspaceID: testWorkspaceID, SourceID: "s2", KeyHashes: []string{hashWriteKey("other-key")}, RemoveAfter: now.Add(time.Hour)}
+	if err := writeStateFile(path, &writeKeyRemovalState{Removals: []writeKeyRemoval{due, pending}}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Segment{clients: clients, writeKeyRemovals: newWriteKeyRemovals(path, clients, newProvisioner(false, nil))}
+	before := len(fake.requested())
+	if err := s.RemoveDueWriteKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"GET /", "GET /sources/s1", "DELETE /sources/s1/writekeys/old-key"}
+	if got := fake.requested()[before:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+
+	var state writeKeyRemovalState
+	if err := readStateFile(path, &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Removals) != 1 || state.Removals[0].SourceID != "s2" {
+		t.Errorf("removals left = %+v, want the one of s2", state.Removals)
+	}
+}
@@ -14,7 +14,9 @@ import (
 
 type spaceResourceBuilder struct {
 	resourceType *v2.ResourceType
-	client       *segment.Client
+	clients      *workspaceClients
+	policy       *ProvisioningPolicy
+	provisioner  *provisioner
 }
 
 func (s *spaceResourceBuilder) ResourceType(_ context.Context) *v2.ResourceType {
@@ -22,11 +24,11 @@ func (s *spaceResourceBuilder) ResourceType(_ context.Context) *v2.ResourceType
 }
 
 // Create a new connector resource for an Segment Space.
-func spaceResource(space *segment.Space, parentResourceID *v2.ResourceId) (*v2.Resource, error) {
+func spaceResource(space *segment.Space, parentResourceID *v2.ResourceId, clients *workspaceClients) (*v2.Resource, error) {
 	resource, err := rs.NewResource(
 		space.Name,
 		spaceResourceType,
-		space.ID,
+		clients.scopedID(parentResourceID.Resource, space.ID),
 		rs.WithParentResourceID(parentResourceID),
 	)
 
@@ -47,7 +49,12 @@ func (s *spaceResourceBuilder) List(ctx context.Context, parentResourceID *v2.Re
 		return nil, "", nil, err
 	}
 
-	spaces, nextCursor, err := s.client.ListSpaces(ctx, page)
+	client, err := s.clients.get(ctx, parentResourceID.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	spaces, nextCursor, err := client.ListSpaces(ctx, page)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -60,7 +67,7 @@ func (s *spaceResourceBuilder) List(ctx context.Context, parentResourceID *v2.Re
 	var rv []*v2.Resource
 	for _, space := range spaces {
 		spaceCopy := space
-		sr, err := spaceResource(&spaceCopy, parentResourceID)
+		sr, err := spaceResource(&spaceCopy, parentResourceID, s.clients)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -77,7 +84,12 @@ func (s *spaceResourceBuilder) Entitlements(ctx context.Context, resource *v2.Re
 		return nil, "", nil, err
 	}
 
-	roles, nextCursor, err := s.client.ListRoles(ctx, page)
+	client, err := s.clients.get(ctx, resource.ParentResourceId.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	roles, nextCursor, err := client.ListRoles(ctx, page)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -105,14 +117,27 @@ func (s *spaceResourceBuilder) Grants(ctx context.Context, resource *v2.Resource
 }
 
 func (s *spaceResourceBuilder) Grant(ctx context.Context, principal *v2.Resource, entitlement *v2.Entitlement) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, grantTask(entitlement))
+
 	roleID, resourceType := getRoleIdAndResourceType(entitlement)
-	resourceID := entitlement.Resource.Id.Resource
-	permissions, err := grantPermissions(ctx, s.client, principal, roleID, resourceType, resourceID)
+	if err := s.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+	if err := s.policy.checkRole(roleID, getRoleName(entitlement)); err != nil {
+		return nil, err
+	}
+
+	client, resourceID, principalID, err := s.clients.forGrant(ctx, entitlement.Resource.Id, principal)
 	if err != nil {
 		return nil, err
 	}
 
-	err = s.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, permissions)
+	current, permissions, err := grantPermissions(ctx, client, principal, principalID, roleID, resourceType, resourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.provisioner.updatePermissions(ctx, client, principal, principalID, current, permissions)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"baton-segment: failed to add permission to %s %s for space resource %s: %w",
@@ -127,16 +152,26 @@ func (s *spaceResourceBuilder) Grant(ctx context.Context, principal *v2.Resource
 }
 
 func (s *spaceResourceBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, revokeTask(grant))
+
 	entitlement := grant.Entitlement
 	principal := grant.Principal
-	roleID, _ := getRoleIdAndResourceType(entitlement)
+	if err := s.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+
+	client, _, principalID, err := s.clients.forGrant(ctx, entitlement.Resource.Id, principal)
+	if err != nil {
+		return nil, err
+	}
 
-	permissions, err := revokePermissions(ctx, s.client, principal, roleID)
+	roleID, _ := getRoleIdAndResourceType(entitlement)
+	current, permissions, err := revokePermissions(ctx, client, principal, principalID, roleID)
 	if err != nil {
 		return nil, err
 	}
 
-	err = s.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, permissions)
+	err = s.provisioner.updatePermissions(ctx, client, principal, principalID, current, permissions)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"baton-segment: failed to remove permission from %s %s for space resource %s: %w",
@@ -150,9 +185,11 @@ func (s *spaceResourceBuilder) Revoke(ctx context.Context, grant *v2.Grant) (ann
 	return nil, nil
 }
 
-func newSpaceBuilder(client *segment.Client) *spaceResourceBuilder {
+func newSpaceBuilder(clients *workspaceClients, policy *ProvisioningPolicy, provisioner *provisioner) *spaceResourceBuilder {
 	return &spaceResourceBuilder{
 		resourceType: spaceResourceType,
-		client:       client,
+		clients:      clients,
+		policy:       policy,
+		provisioner:  provisioner,
 	}
 }
@@ -0,0 +1,83 @@
+package connector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// updateStateFile reads the JSON state file at path into state, calls update and writes state back, holding a
+// lock on the file throughout so concurrent runs can't overwrite each other's changes. A missing file leaves state
+// as is. The file isn't written when update fails.
+func updateStateFile(path string, state interface{}, update func() error) error {
+	unlock, err := lockStateFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := readStateFile(path, state); err != nil {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+
+	return writeStateFile(path, state)
+}
+
+// lockStateFile locks the state file at path until the returned function is called, waiting for other runs holding
+// the lock to release it.
+func lockStateFile(path string) (func(), error) {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("baton-segment: failed to lock %s: %w", path, err)
+	}
+
+	return unlock, nil
+}
+
+// readStateFile reads the JSON state file at path into state. A missing file leaves state as is.
+func readStateFile(path string, state interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to read %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return fmt.Errorf("baton-segment: failed to parse %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// writeStateFile writes state to the JSON state file at path, replacing it at once so it's never left half written.
+func writeStateFile(path string, state interface{}) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to write %s: %w", path, err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("baton-segment: failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+// TerraformConfig is the IAM configuration of a workspace as resources of Segment's Terraform provider: a
+// segment_user_group for every group, with its members and permissions, and a segment_user for every user, with
+// their direct permissions.
+type TerraformConfig struct {
+	WorkspaceID   string
+	WorkspaceName string
+	WorkspaceSlug string
+
+	snapshot *iamSnapshot
+	// groups and users are those of the snapshot, sorted by name and email.
+	groups []segment.Group
+	users  []segment.User
+	// addresses are the Terraform resource names of the users and groups, keyed by ID.
+	addresses map[string]string
+}
+
+// TerraformConfigs returns the Terraform configuration of every configured workspace.
+func (s *Segment) TerraformConfigs(ctx context.Context) ([]*TerraformConfig, error) {
+	snapshots, err := s.snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []*TerraformConfig
+	for _, snapshot := range snapshots {
+		rv = append(rv, newTerraformConfig(snapshot))
+	}
+
+	return rv, nil
+}
+
+func newTerraformConfig(snapshot *iamSnapshot) *TerraformConfig {
+	c := &TerraformConfig{
+		WorkspaceID:   snapshot.workspace.ID,
+		WorkspaceName: snapshot.workspace.Name,
+		WorkspaceSlug: snapshot.workspace.Slug,
+		snapshot:      snapshot,
+		groups:        append([]segment.Group{}, snapshot.groups...),
+		users:         append([]segment.User{}, snapshot.users...),
+		addresses:     make(map[string]string),
+	}
+
+	// copies are sorted, so the snapshot keeps the order its users and groups were listed in.
+	sort.SliceStable(c.groups, func(i, j int) bool {
+		return strings.ToLower(c.groups[i].Name) < strings.ToLower(c.groups[j].Name)
+	})
+	sort.SliceStable(c.users, func(i, j int) bool {
+		return strings.ToLower(c.users[i].Email) < strings.ToLower(c.users[j].Email)
+	})
+
+	used := make(map[string]bool)
+	for _, group := range c.groups {
+		c.addresses[group.ID] = terraformName(group.Name, used)
+	}
+	used = make(map[string]bool)
+	for _, user := range c.users {
+		c.addresses[user.ID] = terraformName(strings.Split(user.Email, "@")[0], used)
+	}
+
+	return c
+}
+
+// WriteResources writes the segment_user_group and segment_user resources of the workspace. Roles and resources are
+// referenced by ID, with their names in comments.
+func (c *TerraformConfig) WriteResources(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("# Segment IAM configuration of workspace %s (%s), exported by baton-segment.\n", hclComment(c.WorkspaceName), c.WorkspaceID)
+
+	for _, group := range c.groups {
+		var members []string
+		for _, member := range c.snapshot.members[group.ID] {
+			members = append(members, member.Email)
+		}
+		sort.Strings(members)
+
+		ew.printf("\nresource \"segment_user_group\" %s {\n", hclString(c.addresses[group.ID]))
+		ew.printf("  name = %s\n", hclString(group.Name))
+		ew.printf("  members = [")
+		for i, member := range members {
+			if i > 0 {
+				ew.printf(",")
+			}
+			ew.printf("\n    %s", hclString(member))
+		}
+		if len(members) > 0 {
+			ew.printf("\n  ")
+		}
+		ew.printf("]\n")
+		c.writePermissions(ew, group.Permissions)
+		ew.printf("}\n")
+	}
+
+	for _, user := range c.users {
+		ew.printf("\nresource \"segment_user\" %s {\n", hclString(c.addresses[user.ID]))
+		ew.printf("  email = %s\n", hclString(user.Email))
+		c.writePermissions(ew, user.Permissions)
+		ew.printf("}\n")
+	}
+
+	return ew.err
+}
+
+func (c *TerraformConfig) writePermissions(ew *errWriter, permissions []segment.Permission) {
+	ew.printf("  permissions = [")
+	for i, permission := range permissions {
+		if i > 0 {
+			ew.printf(",")
+		}
+		ew.printf("\n    {\n")
+		if permission.RoleName != "" {
+			ew.printf("      # %s\n", hclComment(permission.RoleName))
+		}
+		ew.printf("      role_id = %s\n", hclString(permission.RoleID))
+		ew.printf("      resources = [")
+		for j, resource := range permission.Resources {
+			if j > 0 {
+				ew.printf(",")
+			}
+			ew.printf("\n        {\n")
+			ew.printf("          # %s\n", hclComment(c.snapshot.resourceName(resource)))
+			ew.printf("          id   = %s\n", hclString(resource.ID))
+			ew.printf("          type = %s\n", hclString(resource.Type))
+			ew.printf("        }")
+		}
+		if len(permission.Resources) > 0 {
+			ew.printf("\n      ")
+		}
+		ew.printf("]\n")
+		ew.printf("    }")
+	}
+	if len(permissions) > 0 {
+		ew.printf("\n  ")
+	}
+	ew.printf("]\n")
+}
+
+// WriteImports writes an import block for every resource of WriteResources, so Terraform adopts the existing users
+// and groups instead of creating them.
+func (c *TerraformConfig) WriteImports(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("# Import blocks adopting the Segment IAM configuration of workspace %s (%s).\n", hclComment(c.WorkspaceName), c.WorkspaceID)
+
+	for _, group := range c.groups {
+		ew.printf("\nimport {\n")
+		ew.printf("  to = segment_user_group.%s\n", c.addresses[group.ID])
+		ew.printf("  id = %s\n", hclString(group.ID))
+		ew.printf("}\n")
+	}
+	for _, user := range c.users {
+		ew.printf("\nimport {\n")
+		ew.printf("  to = segment_user.%s\n", c.addresses[user.ID])
+		ew.printf("  id = %s\n", hclString(user.ID))
+		ew.printf("}\n")
+	}
+
+	return ew.err
+}
+
+// terraformName returns a Terraform resource name made of the lowercase letters, digits and underscores of name,
+// with a numeric suffix if it's already used.
+func terraformName(name string, used map[string]bool) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	base := strings.Trim(b.String(), "_")
+	if base == "" || (base[0] >= '0' && base[0] <= '9') {
+		base = "r_" + base
+	}
+
+	rv := base
+	for i := 2; used[rv]; i++ {
+		rv = fmt.Sprintf("%s_%d", base, i)
+	}
+	used[rv] = true
+
+	return rv
+}
+
+// hclString returns s as a quoted HCL string, with template sequences escaped.
+func hclString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '$', '%':
+			b.WriteRune(r)
+			if i+1 < len(s) && s[i+1] == '{' {
+				b.WriteRune(r)
+			}
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// hclComment returns s on a single line, to be written after a comment marker.
+func hclComment(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// errWriter keeps the first error of a sequence of writes.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
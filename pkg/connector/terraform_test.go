@@ -0,0 +1,110 @@
+package connector
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the tests")
+
+func TestHCLString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "Analysts", want: `"Analysts"`},
+		{in: `say "hi" \o/`, want: `"say \"hi\" \\o/"`},
+		{in: "${var.secret}", want: `"$${var.secret}"`},
+		{in: "%{ if true }", want: `"%%{ if true }"`},
+		{in: "$5 and 100%", want: `"$5 and 100%"`},
+		{in: "$${already}", want: `"$$${already}"`},
+		{in: "line\nbreak\r\ttab", want: `"line\nbreak\r\ttab"`},
+		{in: "bell\x07null\x00", want: `"bell\u0007null\u0000"`},
+		{in: "Équipe données", want: `"Équipe données"`},
+	}
+
+	for _, tt := range tests {
+		if got := hclString(tt.in); got != tt.want {
+			t.Errorf("hclString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTerraformName(t *testing.T) {
+	used := make(map[string]bool)
+	var got []string
+	for _, name := range []string{"Data Team", "data-team", "data_team_2", "Data.Team", "42 Ops", "", "!!!", "Ünïcode"} {
+		got = append(got, terraformName(name, used))
+	}
+
+	want := []string{"data_team", "data_team_2", "data_team_2_2", "data_team_3", "r_42_ops", "r_", "r__2", "n_code"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+}
+
+func newTestTerraformSnapshot() *iamSnapshot {
+	alice := segment.User{ID: "u-alice", Email: "alice@example.com", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+	bob := segment.User{ID: "u-bob", Email: "Bob@example.com", Permissions: []segment.Permission{testSourcePermission(testSourceReadRole, "s-web", "s-gone")}}
+	otherBob := segment.User{ID: "u-bob-2", Email: "bob@example.org"}
+	admins := segment.Group{ID: "g-admins", Name: "Admins", Permissions: []segment.Permission{testWorkspacePermission(testOwnerRole)}}
+	analysts := segment.Group{ID: "g-analysts", Name: `Analysts "${prod}"`}
+
+	snapshot := &iamSnapshot{
+		workspace:      &segment.Workspace{ID: testWorkspaceID, Name: "Production\nEU", Slug: "production"},
+		users:          []segment.User{otherBob, bob, alice},
+		groups:         []segment.Group{analysts, admins},
+		members:        map[string][]segment.User{admins.ID: {bob, alice}},
+		resourceNames:  make(map[string]map[string]string),
+		resourceLabels: make(map[string]map[string][]string),
+	}
+	snapshot.addResource(sourceType, "s-web", "Web")
+
+	return snapshot
+}
+
+// checkGolden compares got to the golden file, or updates the file with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", "terraform", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file:\n%s", name, got)
+	}
+}
+
+func TestTerraformConfig(t *testing.T) {
+	snapshot := newTestTerraformSnapshot()
+	c := newTerraformConfig(snapshot)
+
+	var resources, imports bytes.Buffer
+	if err := c.WriteResources(&resources); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteImports(&imports); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "segment_iam.tf", resources.Bytes())
+	checkGolden(t, "imports.tf", imports.Bytes())
+
+	// the snapshot is left in the order it was listed in.
+	if snapshot.users[0].ID != "u-bob-2" || snapshot.groups[0].ID != "g-analysts" {
+		t.Error("newTerraformConfig() sorted the users and groups of the snapshot")
+	}
+}
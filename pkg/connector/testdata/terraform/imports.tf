@@ -0,0 +1,26 @@
+# Import blocks adopting the Segment IAM configuration of workspace Production EU (ws1).
+
+import {
+  to = segment_user_group.admins
+  id = "g-admins"
+}
+
+import {
+  to = segment_user_group.analysts____prod
+  id = "g-analysts"
+}
+
+import {
+  to = segment_user.alice
+  id = "u-alice"
+}
+
+import {
+  to = segment_user.bob
+  id = "u-bob"
+}
+
+import {
+  to = segment_user.bob_2
+  id = "u-bob-2"
+}
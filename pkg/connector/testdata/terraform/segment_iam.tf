@@ -0,0 +1,72 @@
+# Segment IAM configuration of workspace Production EU (ws1), exported by baton-segment.
+
+resource "segment_user_group" "admins" {
+  name = "Admins"
+  members = [
+    "Bob@example.com",
+    "alice@example.com"
+  ]
+  permissions = [
+    {
+      # Workspace Owner
+      role_id = "r-owner"
+      resources = [
+        {
+          # ws1
+          id   = "ws1"
+          type = "WORKSPACE"
+        }
+      ]
+    }
+  ]
+}
+
+resource "segment_user_group" "analysts____prod" {
+  name = "Analysts \"$${prod}\""
+  members = []
+  permissions = []
+}
+
+resource "segment_user" "alice" {
+  email = "alice@example.com"
+  permissions = [
+    {
+      # Workspace Owner
+      role_id = "r-owner"
+      resources = [
+        {
+          # ws1
+          id   = "ws1"
+          type = "WORKSPACE"
+        }
+      ]
+    }
+  ]
+}
+
+resource "segment_user" "bob" {
+  email = "Bob@example.com"
+  permissions = [
+    {
+      # Source Read-only
+      role_id = "r-source-read"
+      resources = [
+        {
+          # Web
+          id   = "s-web"
+          type = "SOURCE"
+        },
+        {
+          # s-gone
+          id   = "s-gone"
+          type = "SOURCE"
+        }
+      ]
+    }
+  ]
+}
+
+resource "segment_user" "bob_2" {
+  email = "bob@example.org"
+  permissions = []
+}
@@ -0,0 +1,239 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultUserPrefetchConcurrency = 10
+	// maxRateLimitRetries is the number of times a prefetched user is requested while the rate limit is reached.
+	maxRateLimitRetries = 5
+)
+
+// userCache holds the details of the users of every workspace for the duration of a sync. ListUsers doesn't
+// return permissions, so the details of each page of users are fetched in parallel as soon as the page is listed,
+// instead of one at a time when the grants of each user are synced.
+type userCache struct {
+	// concurrency is the number of users fetched at the same time.
+	concurrency int
+	// requestsPerSecond caps the rate of requests of a prefetch, on top of the rate limit budget of the token.
+	requestsPerSecond float64
+
+	mu sync.Mutex
+	// users are the details of the users of each workspace, keyed by workspace ID and user ID.
+	users map[string]map[string]*segment.User
+	// listed are the users of each workspace in list order, complete once the last page is listed.
+	listed   map[string][]segment.User
+	complete map[string]bool
+	// byEmail are the listed users of each workspace, keyed by workspace ID and lowercase email, indexed on first
+	// use once complete.
+	byEmail map[string]map[string]segment.User
+}
+
+func newUserCache(concurrency int, requestsPerSecond float64) *userCache {
+	if concurrency <= 0 {
+		concurrency = defaultUserPrefetchConcurrency
+	}
+
+	return &userCache{
+		concurrency:       concurrency,
+		requestsPerSecond: requestsPerSecond,
+		users:             make(map[string]map[string]*segment.User),
+		listed:            make(map[string][]segment.User),
+		complete:          make(map[string]bool),
+		byEmail:           make(map[string]map[string]segment.User),
+	}
+}
+
+// reset drops the users of the workspace when a new sync lists them from the first page.
+func (c *userCache) reset(workspaceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.users[workspaceID] = make(map[string]*segment.User)
+	c.listed[workspaceID] = nil
+	c.complete[workspaceID] = false
+	delete(c.byEmail, workspaceID)
+}
+
+// prefetch records a listed page of users and fetches their details. Users that fail to be fetched are logged and
+// fetched again when their grants are synced.
+func (c *userCache) prefetch(ctx context.Context, client *segment.Client, workspaceID string, users []segment.User, lastPage bool) error {
+	c.mu.Lock()
+	c.listed[workspaceID] = append(c.listed[workspaceID], users...)
+	c.complete[workspaceID] = lastPage
+	delete(c.byEmail, workspaceID)
+	c.mu.Unlock()
+
+	return c.fetch(ctx, client, workspaceID, users)
+}
+
+// fetch fetches the details of the users that aren't cached yet through a pool of workers, paced to stay within the
+// rate limit budget of the token. Requests refused by the rate limit are retried once the budget is reset, and other
+// failures are logged and left to get.
+func (c *userCache) fetch(ctx context.Context, client *segment.Client, workspaceID string, users []segment.User) error {
+	l := ctxzap.Extract(ctx)
+
+	c.mu.Lock()
+	var missing []string
+	for _, user := range users {
+		if _, ok := c.users[workspaceID][user.ID]; !ok {
+			missing = append(missing, user.ID)
+		}
+	}
+	c.mu.Unlock()
+
+	pacer := newRequestPacer(client, c.requestsPerSecond)
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < c.concurrency && i < len(missing); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for userID := range jobs {
+				user, err := c.fetchUser(ctx, client, pacer, userID)
+				if err != nil {
+					if ctx.Err() == nil {
+						l.Warn("baton-segment: failed to prefetch user", zap.String("user_id", userID), zap.Error(err))
+					}
+					continue
+				}
+				c.set(workspaceID, user)
+			}
+		}()
+	}
+
+	for _, userID := range missing {
+		jobs <- userID
+	}
+	close(jobs)
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// fetchUser fetches a user, waiting for the rate limit budget to be reset when the request is refused by it.
+func (c *userCache) fetchUser(ctx context.Context, client *segment.Client, pacer *requestPacer, userID string) (*segment.User, error) {
+	for attempt := 1; ; attempt++ {
+		if err := pacer.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		user, err := client.GetUser(ctx, userID)
+		var rateLimitErr *segment.RateLimitError
+		if !errors.As(err, &rateLimitErr) || attempt == maxRateLimitRetries {
+			return user, err
+		}
+		pacer.backoff(rateLimitErr.ResetAt)
+	}
+}
+
+func (c *userCache) set(workspaceID string, user *segment.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.users[workspaceID] == nil {
+		c.users[workspaceID] = make(map[string]*segment.User)
+	}
+	c.users[workspaceID][user.ID] = user
+}
+
+// get returns the details of a user, from the cache if it was prefetched.
+func (c *userCache) get(ctx context.Context, client *segment.Client, workspaceID, userID string) (*segment.User, error) {
+	c.mu.Lock()
+	user, ok := c.users[workspaceID][userID]
+	c.mu.Unlock()
+	if ok {
+		return user, nil
+	}
+
+	user, err := client.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	c.set(workspaceID, user)
+
+	return user, nil
+}
+
+// list returns the users of the workspace if all of them were listed during this sync.
+func (c *userCache) list(workspaceID string) ([]segment.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.complete[workspaceID] {
+		return nil, false
+	}
+
+	return c.listed[workspaceID], true
+}
+
+// cached returns the details of a user if they are in the cache.
+func (c *userCache) cached(workspaceID, userID string) (*segment.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	user, ok := c.users[workspaceID][userID]
+	return user, ok
+}
+
+// listAll returns the users of the workspace. Users are listed before grants are synced, so the users of the sync
+// are used, and are listed once otherwise.
+func (c *userCache) listAll(ctx context.Context, client *segment.Client, workspaceID string) ([]segment.User, error) {
+	if users, ok := c.list(workspaceID); ok {
+		return users, nil
+	}
+
+	var users []segment.User
+	err := paginate(ctx, client.ListUsers, func(user segment.User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.listed[workspaceID] = users
+	c.complete[workspaceID] = true
+	delete(c.byEmail, workspaceID)
+	c.mu.Unlock()
+
+	return users, nil
+}
+
+// findByEmail returns the user of the workspace with the given email, or nil if there is none.
+func (c *userCache) findByEmail(ctx context.Context, client *segment.Client, workspaceID, email string) (*segment.User, error) {
+	if _, err := c.listAll(ctx, client, workspaceID); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	index, ok := c.byEmail[workspaceID]
+	if !ok {
+		index = make(map[string]segment.User, len(c.listed[workspaceID]))
+		for _, user := range c.listed[workspaceID] {
+			key := strings.ToLower(user.Email)
+			if _, ok := index[key]; !ok {
+				index[key] = user
+			}
+		}
+		c.byEmail[workspaceID] = index
+	}
+
+	user, ok := index[strings.ToLower(email)]
+	if !ok {
+		return nil, nil
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,136 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/conductorone/baton-segment/pkg/segment"
+)
+
+func TestUserCachePrefetch(t *testing.T) {
+	const concurrency = 3
+
+	fake := newFakeSegment(t)
+	var users []segment.User
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	for i := 0; i < 10; i++ {
+		user := segment.User{ID: fmt.Sprintf("u-%d", i), Email: fmt.Sprintf("user%d@example.com", i)}
+		users = append(users, user)
+		respond := respondData(t, "user", user)
+		fake.handle(http.MethodGet, "/users/"+user.ID, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+			respond(w, r)
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		})
+	}
+	client := fake.client()
+	cache := newUserCache(concurrency, 0)
+
+	if err := cache.prefetch(context.Background(), client, testWorkspaceID, users, true); err != nil {
+		t.Fatal(err)
+	}
+	if maxInFlight > concurrency || maxInFlight < 2 {
+		t.Errorf("%d users fetched at the same time, want between 2 and %d", maxInFlight, concurrency)
+	}
+	if n := len(fake.requested()); n != len(users) {
+		t.Errorf("%d requests, want %d", n, len(users))
+	}
+
+	// prefetched users are served from the cache.
+	for _, user := range users {
+		got, err := cache.get(context.Background(), client, testWorkspaceID, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Email != user.Email {
+			t.Errorf("get(%s) = %s, want %s", user.ID, got.Email, user.Email)
+		}
+	}
+	if n := len(fake.requested()); n != len(users) {
+		t.Errorf("%d requests after get, want %d", n, len(users))
+	}
+
+	listed, ok := cache.list(testWorkspaceID)
+	if !ok || len(listed) != len(users) {
+		t.Errorf("list() = %d users, %v, want %d listed", len(listed), ok, len(users))
+	}
+}
+
+func TestUserCacheRateLimit(t *testing.T) {
+	fake := newFakeSegment(t)
+	bob := segment.User{ID: "u-bob", Email: "bob@example.com"}
+	refused := 0
+	fake.handle(http.MethodGet, "/users/u-bob", func(w http.ResponseWriter, r *http.Request) {
+		if refused == 0 {
+			refused++
+			w.Header().Set("X-Ratelimit-Limit", "10")
+			w.Header().Set("X-Ratelimit-Remaining", "0")
+			w.Header().Set("X-Ratelimit-Reset", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		respondData(t, "user", bob)(w, r)
+	})
+	client := fake.client()
+	cache := newUserCache(1, 0)
+
+	if err := cache.prefetch(context.Background(), client, testWorkspaceID, []segment.User{bob}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.cached(testWorkspaceID, bob.ID); !ok {
+		t.Fatal("user refused by the rate limit wasn't fetched again")
+	}
+	if n := len(fake.requested()); n != 2 {
+		t.Errorf("%d requests, want the refused one and its retry", n)
+	}
+}
+
+func TestUserCacheFallback(t *testing.T) {
+	fake := newFakeSegment(t)
+	carol := segment.User{ID: "u-carol", Email: "carol@example.com"}
+	failed := false
+	fake.handle(http.MethodGet, "/users/u-carol", func(w http.ResponseWriter, r *http.Request) {
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		respondData(t, "user", carol)(w, r)
+	})
+	client := fake.client()
+	cache := newUserCache(1, 0)
+
+	// a failed prefetch is logged, not returned.
+	if err := cache.prefetch(context.Background(), client, testWorkspaceID, []segment.User{carol}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.cached(testWorkspaceID, carol.ID); ok {
+		t.Fatal("user that failed to be fetched is cached")
+	}
+
+	got, err := cache.get(context.Background(), client, testWorkspaceID, carol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != carol.Email {
+		t.Errorf("get() = %s, want %s", got.Email, carol.Email)
+	}
+	if _, ok := cache.cached(testWorkspaceID, carol.ID); !ok {
+		t.Error("user fetched by get isn't cached")
+	}
+}
@@ -2,16 +2,15 @@ package connector
 
 import (
 	"context"
-	"fmt"
 
 	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
 	"github.com/conductorone/baton-sdk/pkg/annotations"
 	"github.com/conductorone/baton-sdk/pkg/helpers"
 	"github.com/conductorone/baton-sdk/pkg/pagination"
-	grant "github.com/conductorone/baton-sdk/pkg/types/grant"
 	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
 	"github.com/conductorone/baton-segment/pkg/segment"
-	"github.com/iancoleman/strcase"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
 )
 
 const (
@@ -24,7 +23,12 @@ const (
 
 type userBuilder struct {
 	resourceType *v2.ResourceType
-	client       *segment.Client
+	clients      *workspaceClients
+	syncTypes    resourceTypeSet
+	cache        *userCache
+	idp          *IdPManagement
+	sod          *sodSync
+	orphans      *orphanSync
 }
 
 func (u *userBuilder) ResourceType(ctx context.Context) *v2.ResourceType {
@@ -32,13 +36,14 @@ func (u *userBuilder) ResourceType(ctx context.Context) *v2.ResourceType {
 }
 
 // Create a new connector resource for a Segment user.
-func userResource(user *segment.User, parentResourceID *v2.ResourceId) (*v2.Resource, error) {
+func userResource(user *segment.User, parentResourceID *v2.ResourceId, idp *IdPManagement, clients *workspaceClients) (*v2.Resource, error) {
 	firstName, lastName := helpers.SplitFullName(user.Name)
 	profile := map[string]interface{}{
-		"first_name": firstName,
-		"last_name":  lastName,
-		"login":      user.Email,
-		"user_id":    user.ID,
+		"first_name":  firstName,
+		"last_name":   lastName,
+		"login":       user.Email,
+		"user_id":     user.ID,
+		"idp_managed": idp.managesUser(user.Email),
 	}
 
 	userTraitOptions := []rs.UserTraitOption{
@@ -50,7 +55,7 @@ func userResource(user *segment.User, parentResourceID *v2.ResourceId) (*v2.Reso
 	ret, err := rs.NewUserResource(
 		user.Name,
 		userResourceType,
-		user.ID,
+		clients.scopedID(parentResourceID.Resource, user.ID),
 		userTraitOptions,
 		rs.WithParentResourceID(parentResourceID),
 	)
@@ -73,11 +78,37 @@ func (u *userBuilder) List(ctx context.Context, parentResourceID *v2.ResourceId,
 		return nil, "", nil, err
 	}
 
-	users, nextCursor, err := u.client.ListUsers(ctx, page)
+	client, err := u.clients.get(ctx, parentResourceID.Resource)
 	if err != nil {
 		return nil, "", nil, err
 	}
 
+	// a new sync lists users from the first page.
+	if page == "" {
+		u.cache.reset(parentResourceID.Resource)
+		u.orphans.reset(parentResourceID.Resource)
+
+		// users are synced without SoD annotations when the rules can't be checked.
+		if u.sod != nil {
+			if err := u.sod.load(ctx, u.clients, parentResourceID.Resource, u.syncTypes, u.cache); err != nil {
+				ctxzap.Extract(ctx).Error(
+					"baton-segment: failed to check SoD rules, users are synced without violations",
+					zap.String("workspace_id", parentResourceID.Resource),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+
+	users, nextCursor, err := client.ListUsers(ctx, page)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	if err := u.cache.prefetch(ctx, client, parentResourceID.Resource, users, nextCursor == ""); err != nil {
+		return nil, "", nil, err
+	}
+
 	pageToken, err := bag.NextToken(nextCursor)
 	if err != nil {
 		return nil, "", nil, err
@@ -86,10 +117,15 @@ func (u *userBuilder) List(ctx context.Context, parentResourceID *v2.ResourceId,
 	var rv []*v2.Resource
 	for _, user := range users {
 		userCopy := user
-		ur, err := userResource(&userCopy, parentResourceID)
+		ur, err := userResource(&userCopy, parentResourceID, u.idp, u.clients)
 		if err != nil {
 			return nil, "", nil, err
 		}
+		if u.sod != nil {
+			annos := annotations.Annotations(ur.Annotations)
+			annos.Append(u.sod.annotations(parentResourceID.Resource, user.ID)...)
+			ur.Annotations = annos
+		}
 		rv = append(rv, ur)
 	}
 
@@ -103,53 +139,40 @@ func (u *userBuilder) Entitlements(_ context.Context, resource *v2.Resource, _ *
 
 // Usually grants are not implemented on the user, but due to the way the segment API is structured, it's easier to implement it here.
 func (u *userBuilder) Grants(ctx context.Context, resource *v2.Resource, pToken *pagination.Token) ([]*v2.Grant, string, annotations.Annotations, error) {
-	user, err := u.client.GetUser(ctx, resource.Id.Resource)
+	client, userID, err := u.clients.forResource(ctx, resource.Id)
 	if err != nil {
 		return nil, "", nil, err
 	}
 
-	ur, err := userResource(user, resource.ParentResourceId)
+	user, err := u.cache.get(ctx, client, resource.ParentResourceId.Resource, userID)
 	if err != nil {
 		return nil, "", nil, err
 	}
 
-	var rv []*v2.Grant
-	for _, p := range user.Permissions {
-		var role segment.Role
-		role.ID = p.RoleID
-		role.Name = p.RoleName
-		rr, err := roleResource(&role, resource.ParentResourceId)
-		if err != nil {
-			return nil, "", nil, fmt.Errorf("error creating role resource for user permissions")
-		}
-
-		// grant user permissions on resources
-		for _, r := range p.Resources {
-			var roleResource segment.Resource
-			roleResource.ID = r.ID
-			roleResource.Type = r.Type
-			roleEntitlement := strcase.ToSnake(role.Name)
-
-			if r.Type == workspaceType {
-				rv = append(rv, grant.NewGrant(rr, roleMembership, ur.Id))
-				continue
-			}
-
-			resource, err := baseResource(roleResource, resource.ParentResourceId)
-			if err != nil {
-				return nil, "", nil, fmt.Errorf("error creating %s resource", r.Type)
-			}
+	permissions, orphaned, err := u.orphans.check(ctx, resource.ParentResourceId.Resource, resource.Id, user.Permissions)
+	if err != nil {
+		return nil, "", nil, err
+	}
 
-			rv = append(rv, grant.NewGrant(resource, roleEntitlement, ur.Id))
-		}
+	rv, err := permissionGrants(ctx, permissions, resource.Id, resource.ParentResourceId, u.syncTypes, u.clients)
+	if err != nil {
+		return nil, "", nil, err
 	}
 
-	return rv, "", nil, nil
+	var annos annotations.Annotations
+	annos.Append(orphaned...)
+
+	return rv, "", annos, nil
 }
 
-func newUserBuilder(client *segment.Client) *userBuilder {
+func newUserBuilder(clients *workspaceClients, syncTypes resourceTypeSet, cache *userCache, idp *IdPManagement, sod *sodSync, orphans *orphanSync) *userBuilder {
 	return &userBuilder{
 		resourceType: userResourceType,
-		client:       client,
+		clients:      clients,
+		syncTypes:    syncTypes,
+		cache:        cache,
+		idp:          idp,
+		sod:          sod,
+		orphans:      orphans,
 	}
 }
@@ -14,7 +14,9 @@ import (
 
 type warehouseResourceBuilder struct {
 	resourceType *v2.ResourceType
-	client       *segment.Client
+	clients      *workspaceClients
+	policy       *ProvisioningPolicy
+	provisioner  *provisioner
 }
 
 func (w *warehouseResourceBuilder) ResourceType(_ context.Context) *v2.ResourceType {
@@ -22,11 +24,11 @@ func (w *warehouseResourceBuilder) ResourceType(_ context.Context) *v2.ResourceT
 }
 
 // Create a new connector resource for an Segment Warehouse.
-func warehouseResource(warehouse *segment.Warehouse, parentResourceID *v2.ResourceId) (*v2.Resource, error) {
+func warehouseResource(warehouse *segment.Warehouse, parentResourceID *v2.ResourceId, clients *workspaceClients) (*v2.Resource, error) {
 	resource, err := rs.NewResource(
 		warehouse.Metadata.Name,
 		warehouseResourceType,
-		warehouse.ID,
+		clients.scopedID(parentResourceID.Resource, warehouse.ID),
 		rs.WithParentResourceID(parentResourceID),
 	)
 
@@ -47,7 +49,12 @@ func (w *warehouseResourceBuilder) List(ctx context.Context, parentResourceID *v
 		return nil, "", nil, err
 	}
 
-	warehouses, nextCursor, err := w.client.ListWarehouses(ctx, page)
+	client, err := w.clients.get(ctx, parentResourceID.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	warehouses, nextCursor, err := client.ListWarehouses(ctx, page)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -60,7 +67,7 @@ func (w *warehouseResourceBuilder) List(ctx context.Context, parentResourceID *v
 	var rv []*v2.Resource
 	for _, warehouse := range warehouses {
 		whCopy := warehouse
-		wr, err := warehouseResource(&whCopy, parentResourceID)
+		wr, err := warehouseResource(&whCopy, parentResourceID, w.clients)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -77,7 +84,12 @@ func (w *warehouseResourceBuilder) Entitlements(ctx context.Context, resource *v
 		return nil, "", nil, err
 	}
 
-	roles, nextCursor, err := w.client.ListRoles(ctx, page)
+	client, err := w.clients.get(ctx, resource.ParentResourceId.Resource)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	roles, nextCursor, err := client.ListRoles(ctx, page)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -103,14 +115,27 @@ func (w *warehouseResourceBuilder) Grants(ctx context.Context, resource *v2.Reso
 }
 
 func (w *warehouseResourceBuilder) Grant(ctx context.Context, principal *v2.Resource, entitlement *v2.Entitlement) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, grantTask(entitlement))
+
 	roleID, resourceType := getRoleIdAndResourceType(entitlement)
-	resourceID := entitlement.Resource.Id.Resource
-	permissions, err := grantPermissions(ctx, w.client, principal, roleID, resourceType, resourceID)
+	if err := w.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+	if err := w.policy.checkRole(roleID, getRoleName(entitlement)); err != nil {
+		return nil, err
+	}
+
+	client, resourceID, principalID, err := w.clients.forGrant(ctx, entitlement.Resource.Id, principal)
 	if err != nil {
 		return nil, err
 	}
 
-	err = w.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, permissions)
+	current, permissions, err := grantPermissions(ctx, client, principal, principalID, roleID, resourceType, resourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.provisioner.updatePermissions(ctx, client, principal, principalID, current, permissions)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"baton-segment: failed to add permission to %s %s for warehouse resource %s: %w",
@@ -125,16 +150,26 @@ func (w *warehouseResourceBuilder) Grant(ctx context.Context, principal *v2.Reso
 }
 
 func (w *warehouseResourceBuilder) Revoke(ctx context.Context, grant *v2.Grant) (annotations.Annotations, error) {
+	ctx = withProvisioningTask(ctx, revokeTask(grant))
+
 	entitlement := grant.Entitlement
 	principal := grant.Principal
-	roleID, _ := getRoleIdAndResourceType(entitlement)
+	if err := w.policy.checkPrincipal(principal); err != nil {
+		return nil, err
+	}
+
+	client, _, principalID, err := w.clients.forGrant(ctx, entitlement.Resource.Id, principal)
+	if err != nil {
+		return nil, err
+	}
 
-	permissions, err := revokePermissions(ctx, w.client, principal, roleID)
+	roleID, _ := getRoleIdAndResourceType(entitlement)
+	current, permissions, err := revokePermissions(ctx, client, principal, principalID, roleID)
 	if err != nil {
 		return nil, err
 	}
 
-	err = w.client.UpdatePermissions(ctx, principal.Id.Resource, principal.Id.ResourceType, permissions)
+	err = w.provisioner.updatePermissions(ctx, client, principal, principalID, current, permissions)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"baton-segment: failed to remove permission from %s %s for warehouse resource %s: %w",
@@ -148,9 +183,11 @@ func (w *warehouseResourceBuilder) Revoke(ctx context.Context, grant *v2.Grant)
 	return nil, nil
 }
 
-func newWarehouseBuilder(client *segment.Client) *warehouseResourceBuilder {
+func newWarehouseBuilder(clients *workspaceClients, policy *ProvisioningPolicy, provisioner *provisioner) *warehouseResourceBuilder {
 	return &warehouseResourceBuilder{
 		resourceType: warehouseResourceType,
-		client:       client,
+		clients:      clients,
+		policy:       policy,
+		provisioner:  provisioner,
 	}
 }
@@ -11,13 +11,17 @@ import (
 	grant "github.com/conductorone/baton-sdk/pkg/types/grant"
 	rs "github.com/conductorone/baton-sdk/pkg/types/resource"
 	"github.com/conductorone/baton-segment/pkg/segment"
+	"google.golang.org/protobuf/proto"
 )
 
 const workspaceMembership = "member"
 
 type workspaceBuilder struct {
 	resourceType *v2.ResourceType
-	client       *segment.Client
+	clients      *workspaceClients
+	syncTypes    resourceTypeSet
+	cache        *userCache
+	idp          *IdPManagement
 }
 
 func (w *workspaceBuilder) ResourceType(_ context.Context) *v2.ResourceType {
@@ -25,20 +29,29 @@ func (w *workspaceBuilder) ResourceType(_ context.Context) *v2.ResourceType {
 }
 
 // Create a new connector resource for a Segment workspace.
-func workspaceResource(workspace *segment.Workspace) (*v2.Resource, error) {
+func workspaceResource(workspace *segment.Workspace, syncTypes resourceTypeSet) (*v2.Resource, error) {
+	childTypes := []*v2.ResourceType{
+		userResourceType,
+		groupResourceType,
+		roleResourceType,
+		functionResourceType,
+		sourceResourceType,
+		warehouseResourceType,
+		spaceResourceType,
+	}
+
+	var childAnnotations []proto.Message
+	for _, rt := range childTypes {
+		if syncTypes.has(rt.Id) {
+			childAnnotations = append(childAnnotations, &v2.ChildResourceType{ResourceTypeId: rt.Id})
+		}
+	}
+
 	ret, err := rs.NewResource(
 		workspace.Name,
 		workspaceResourceType,
 		workspace.ID,
-		rs.WithAnnotation(
-			&v2.ChildResourceType{ResourceTypeId: userResourceType.Id},
-			&v2.ChildResourceType{ResourceTypeId: groupResourceType.Id},
-			&v2.ChildResourceType{ResourceTypeId: roleResourceType.Id},
-			&v2.ChildResourceType{ResourceTypeId: functionResourceType.Id},
-			&v2.ChildResourceType{ResourceTypeId: sourceResourceType.Id},
-			&v2.ChildResourceType{ResourceTypeId: warehouseResourceType.Id},
-			&v2.ChildResourceType{ResourceTypeId: spaceResourceType.Id},
-		),
+		rs.WithAnnotation(childAnnotations...),
 	)
 	if err != nil {
 		return nil, err
@@ -48,17 +61,19 @@ func workspaceResource(workspace *segment.Workspace) (*v2.Resource, error) {
 }
 
 func (w *workspaceBuilder) List(ctx context.Context, _ *v2.ResourceId, pToken *pagination.Token) ([]*v2.Resource, string, annotations.Annotations, error) {
-	workspace, err := w.client.GetWorkspace(ctx)
+	workspaces, err := w.clients.list(ctx)
 	if err != nil {
 		return nil, "", nil, err
 	}
 
 	var rv []*v2.Resource
-	ur, err := workspaceResource(workspace)
-	if err != nil {
-		return nil, "", nil, err
+	for _, workspace := range workspaces {
+		ur, err := workspaceResource(workspace, w.syncTypes)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		rv = append(rv, ur)
 	}
-	rv = append(rv, ur)
 
 	return rv, "", nil, nil
 }
@@ -86,20 +101,31 @@ func (w *workspaceBuilder) Grants(ctx context.Context, resource *v2.Resource, pT
 		return nil, "", nil, err
 	}
 
-	users, nextToken, err := w.client.ListUsers(ctx, page)
-	if err != nil {
-		return nil, "", nil, fmt.Errorf("failed to list workspace members: %w", err)
-	}
+	// users are listed before grants are synced, so the members are usually known already.
+	users, ok := w.cache.list(resource.Id.Resource)
+	pageToken := ""
+	if !ok || page != "" {
+		client, err := w.clients.get(ctx, resource.Id.Resource)
+		if err != nil {
+			return nil, "", nil, err
+		}
 
-	pageToken, err := bag.NextToken(nextToken)
-	if err != nil {
-		return nil, "", nil, err
+		var nextToken string
+		users, nextToken, err = client.ListUsers(ctx, page)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("failed to list workspace members: %w", err)
+		}
+
+		pageToken, err = bag.NextToken(nextToken)
+		if err != nil {
+			return nil, "", nil, err
+		}
 	}
 
 	var rv []*v2.Grant
 	for _, user := range users {
 		userCopy := user
-		ur, err := userResource(&userCopy, resource.Id)
+		ur, err := userResource(&userCopy, resource.Id, w.idp, w.clients)
 		if err != nil {
 			return nil, "", nil, fmt.Errorf("error creating workspace user %s: %w", resource.Id.Resource, err)
 		}
@@ -113,9 +139,12 @@ func (w *workspaceBuilder) Grants(ctx context.Context, resource *v2.Resource, pT
 	return rv, pageToken, nil, nil
 }
 
-func newWorkspaceBuilder(client *segment.Client) *workspaceBuilder {
+func newWorkspaceBuilder(clients *workspaceClients, syncTypes resourceTypeSet, cache *userCache, idp *IdPManagement) *workspaceBuilder {
 	return &workspaceBuilder{
 		resourceType: workspaceResourceType,
-		client:       client,
+		clients:      clients,
+		syncTypes:    syncTypes,
+		cache:        cache,
+		idp:          idp,
 	}
 }
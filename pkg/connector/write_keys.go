@@ -0,0 +1,148 @@
+package connector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+)
+
+// writeKeyRemoval is the removal of the previous write keys of a source once their grace period ends. The keys are
+// recorded by their SHA-256 hash, so no write key is written to disk.
+type writeKeyRemoval struct {
+	WorkspaceID string    `json:"workspace_id"`
+	SourceID    string    `json:"source_id"`
+	KeyHashes   []string  `json:"key_hashes"`
+	RemoveAfter time.Time `json:"remove_after"`
+}
+
+// writeKeyRemovals are the pending write key removals, kept in a local file so they outlive the run that rotated
+// the keys and are made by a later one.
+type writeKeyRemovals struct {
+	path        string
+	clients     *workspaceClients
+	provisioner *provisioner
+}
+
+type writeKeyRemovalState struct {
+	Removals []writeKeyRemoval `json:"removals"`
+}
+
+func newWriteKeyRemovals(path string, clients *workspaceClients, provisioner *provisioner) *writeKeyRemovals {
+	if path == "" {
+		return nil
+	}
+
+	return &writeKeyRemovals{
+		path:        path,
+		clients:     clients,
+		provisioner: provisioner,
+	}
+}
+
+func hashWriteKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// schedule records the removal of the keys of the source after the grace period.
+func (w *writeKeyRemovals) schedule(workspaceID, sourceID string, keys []string, gracePeriod time.Duration) error {
+	removal := writeKeyRemoval{
+		WorkspaceID: workspaceID,
+		SourceID:    sourceID,
+		RemoveAfter: time.Now().UTC().Add(gracePeriod),
+	}
+	for _, key := range keys {
+		removal.KeyHashes = append(removal.KeyHashes, hashWriteKey(key))
+	}
+
+	var state writeKeyRemovalState
+	return updateStateFile(w.path, &state, func() error {
+		state.Removals = append(state.Removals, removal)
+		return nil
+	})
+}
+
+// RemoveDueWriteKeys removes the previous write keys of rotated sources whose grace period ended, as recorded in the
+// write key removal file. Removals that fail stay in the file and are retried by the next call.
+func (s *Segment) RemoveDueWriteKeys(ctx context.Context) error {
+	if s.writeKeyRemovals == nil {
+		return fmt.Errorf("baton-segment: a write key removal file is required to remove previous write keys")
+	}
+
+	return s.writeKeyRemovals.removeDue(ctx)
+}
+
+// removeDue removes the write keys whose grace period ended. Removals that fail stay pending and are retried by
+// the next run.
+func (w *writeKeyRemovals) removeDue(ctx context.Context) error {
+	// the keys aren't removed in dry run mode, so their removal must stay pending.
+	if w == nil || w.provisioner.dryRun {
+		return nil
+	}
+
+	ctx = withProvisioningTask(ctx, &provisioningTask{Action: "remove_write_keys"})
+	now := time.Now()
+
+	var errs []error
+	var state writeKeyRemovalState
+	err := updateStateFile(w.path, &state, func() error {
+		var pending []writeKeyRemoval
+		for _, removal := range state.Removals {
+			if now.Before(removal.RemoveAfter) {
+				pending = append(pending, removal)
+				continue
+			}
+
+			if err := w.remove(ctx, removal); err != nil {
+				errs = append(errs, err)
+				pending = append(pending, removal)
+			}
+		}
+		state.Removals = pending
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
+
+func (w *writeKeyRemovals) remove(ctx context.Context, removal writeKeyRemoval) error {
+	client, err := w.clients.get(ctx, removal.WorkspaceID)
+	if err != nil {
+		return err
+	}
+
+	source, err := client.GetSource(ctx, removal.SourceID)
+	if err != nil {
+		return fmt.Errorf("baton-segment: failed to get source %s to remove previous write keys: %w", removal.SourceID, err)
+	}
+
+	hashes := make(map[string]bool, len(removal.KeyHashes))
+	for _, hash := range removal.KeyHashes {
+		hashes[hash] = true
+	}
+
+	// keys already removed in Segment are no longer listed, and have nothing left to remove.
+	var keys []string
+	for _, key := range source.WriteKeys {
+		if hashes[hashWriteKey(key)] {
+			keys = append(keys, key)
+		}
+	}
+
+	ctxzap.Extract(ctx).Info(
+		"baton-segment: removing previous write keys after their grace period",
+		zap.String("source_id", removal.SourceID),
+		zap.Int("write_key_count", len(keys)),
+	)
+
+	return removeWriteKeys(ctx, w.provisioner, client, removal.SourceID, keys)
+}
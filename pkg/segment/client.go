@@ -4,13 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
+
+	v2 "github.com/conductorone/baton-sdk/pb/c1/connector/v2"
+	"github.com/conductorone/baton-sdk/pkg/helpers"
 )
 
 const (
 	BaseUrl = "https://api.segmentapis.com/"
+	AppUrl  = "https://app.segment.com/"
 
 	groups      = "groups"
 	users       = "users"
@@ -20,6 +28,8 @@ const (
 	functions   = "functions"
 	spaces      = "spaces"
 	permissions = "permissions"
+	writeKeys   = "writekeys"
+	invites     = "invites"
 )
 
 type Error struct {
@@ -37,9 +47,53 @@ type Payload struct {
 	Emails []string `json:"emails"`
 }
 
+// GroupMembersBatchSize is the number of emails sent in each request adding or removing group members. Removals
+// pass the emails in the query string, which keeps it within the URL length Segment accepts.
+const GroupMembersBatchSize = 100
+
+// emailBatches splits emails into batches of up to GroupMembersBatchSize.
+func emailBatches(emails []string) [][]string {
+	var rv [][]string
+	for len(emails) > GroupMembersBatchSize {
+		rv = append(rv, emails[:GroupMembersBatchSize])
+		emails = emails[GroupMembersBatchSize:]
+	}
+	if len(emails) > 0 {
+		rv = append(rv, emails)
+	}
+
+	return rv
+}
+
+type responseStatusKey struct{}
+
+// ResponseStatus holds the HTTP status of the last request made with a context from WithResponseStatus.
+type ResponseStatus struct {
+	Code int
+}
+
+// WithResponseStatus returns a context recording the HTTP status of requests made with it in status.
+func WithResponseStatus(ctx context.Context, status *ResponseStatus) context.Context {
+	return context.WithValue(ctx, responseStatusKey{}, status)
+}
+
+// RateLimitError is returned for requests refused because the rate limit of the token was reached.
+type RateLimitError struct {
+	// ResetAt is when the rate limit budget of the token is reset.
+	ResetAt time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit reached, resets at %s", e.ResetAt.Format(time.RFC3339))
+}
+
 type Client struct {
 	httpClient *http.Client
 	token      string
+	oauth      *oauthTokenSource
+
+	mu        sync.Mutex
+	rateLimit *v2.RateLimitDescription
 }
 
 type PermissionsPayload struct {
@@ -53,6 +107,15 @@ func NewClient(httpClient *http.Client, token string) *Client {
 	}
 }
 
+// NewOAuthClient returns a client authenticating with access tokens of a Segment OAuth app.
+// Access tokens are fetched when needed and refreshed before they expire.
+func NewOAuthClient(httpClient *http.Client, config OAuthConfig) *Client {
+	return &Client{
+		httpClient: httpClient,
+		oauth:      newOAuthTokenSource(httpClient, config),
+	}
+}
+
 // ListUsers returns a list of all users.
 func (c *Client) ListUsers(ctx context.Context, cursor string) ([]User, string, error) {
 	var res struct {
@@ -107,6 +170,114 @@ func (c *Client) ListSources(ctx context.Context, cursor string) ([]Source, stri
 	return res.Data.Sources, "", nil
 }
 
+// GetSource returns single source details.
+func (c *Client) GetSource(ctx context.Context, sourceID string) (*Source, error) {
+	var res struct {
+		Data struct {
+			Source Source `json:"source"`
+		} `json:"data,omitempty"`
+		Errors []Error `json:"errors,omitempty"`
+	}
+
+	url, _ := url.JoinPath(BaseUrl, sources, sourceID)
+	if err := c.doRequest(ctx, url, &res, http.MethodGet, nil, nil); err != nil {
+		return nil, err
+	}
+
+	if res.Errors != nil {
+		return nil, fmt.Errorf("error fetching source: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+	}
+
+	return &res.Data.Source, nil
+}
+
+// maxLogoSize is the largest logo GetLogo downloads.
+const maxLogoSize = 5 << 20
+
+// GetLogo downloads the logo of an integration from the URL Segment lists it at, and returns it along with its
+// content type. Logos are served from Segment's CDN, which doesn't take the API token, so none is sent.
+func (c *Client) GetLogo(ctx context.Context, logoURL string) ([]byte, string, error) {
+	u, err := url.Parse(logoURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid logo URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		return nil, "", fmt.Errorf("invalid logo URL %s: only https URLs are downloaded", logoURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", fmt.Errorf("logo request failed with status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLogoSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxLogoSize {
+		return nil, "", fmt.Errorf("logo is larger than %d bytes", maxLogoSize)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	return data, contentType, nil
+}
+
+// CreateWriteKey creates a new write key for the source and returns the updated source.
+func (c *Client) CreateWriteKey(ctx context.Context, sourceID string) (*Source, error) {
+	var res struct {
+		Data struct {
+			Source Source `json:"source"`
+		} `json:"data,omitempty"`
+		Errors []Error `json:"errors,omitempty"`
+	}
+
+	url, _ := url.JoinPath(BaseUrl, sources, sourceID, writeKeys)
+	if err := c.doRequest(ctx, url, &res, http.MethodPost, nil, nil); err != nil {
+		return nil, err
+	}
+
+	if res.Errors != nil {
+		return nil, fmt.Errorf("error creating write key: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+	}
+
+	return &res.Data.Source, nil
+}
+
+// RemoveWriteKey removes the write key from the source and returns the updated source.
+func (c *Client) RemoveWriteKey(ctx context.Context, sourceID, writeKey string) (*Source, error) {
+	var res struct {
+		Data struct {
+			Source Source `json:"source"`
+		} `json:"data,omitempty"`
+		Errors []Error `json:"errors,omitempty"`
+	}
+
+	url, _ := url.JoinPath(BaseUrl, sources, sourceID, writeKeys, writeKey)
+	if err := c.doRequest(ctx, url, &res, http.MethodDelete, nil, nil); err != nil {
+		return nil, err
+	}
+
+	if res.Errors != nil {
+		return nil, fmt.Errorf("error removing write key: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+	}
+
+	return &res.Data.Source, nil
+}
+
 // ListWarehouses returns a list of all warehouses.
 func (c *Client) ListWarehouses(ctx context.Context, cursor string) ([]Warehouse, string, error) {
 	var res struct {
@@ -118,7 +289,7 @@ func (c *Client) ListWarehouses(ctx context.Context, cursor string) ([]Warehouse
 	}
 
 	params := c.setParams(cursor)
-	url, _ := url.JoinPath(BaseUrl, sources)
+	url, _ := url.JoinPath(BaseUrl, warehouses)
 	if err := c.doRequest(ctx, url, &res, http.MethodGet, params, nil); err != nil {
 		return nil, "", err
 	}
@@ -173,7 +344,7 @@ func (c *Client) ListSpaces(ctx context.Context, cursor string) ([]Space, string
 	}
 
 	params := c.setParams(cursor)
-	url, _ := url.JoinPath(BaseUrl, sources)
+	url, _ := url.JoinPath(BaseUrl, spaces)
 	if err := c.doRequest(ctx, url, &res, http.MethodGet, params, nil); err != nil {
 		return nil, "", err
 	}
@@ -183,7 +354,7 @@ func (c *Client) ListSpaces(ctx context.Context, cursor string) ([]Space, string
 	}
 
 	if res.Errors != nil {
-		return nil, "", fmt.Errorf("error fetching functions: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+		return nil, "", fmt.Errorf("error fetching spaces: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
 	}
 
 	return res.Data.Spaces, "", nil
@@ -305,6 +476,31 @@ func (c *Client) GetGroup(ctx context.Context, groupID string) (*Group, error) {
 	return &res.Data.Group, nil
 }
 
+// CreateGroup creates a user group with the given name, without members or permissions.
+func (c *Client) CreateGroup(ctx context.Context, name string) (*Group, error) {
+	var res struct {
+		Data struct {
+			Group Group `json:"userGroup"`
+		} `json:"data,omitempty"`
+		Errors []Error `json:"errors,omitempty"`
+	}
+
+	body := struct {
+		Name string `json:"name"`
+	}{Name: name}
+
+	url, _ := url.JoinPath(BaseUrl, groups)
+	if err := c.doRequest(ctx, url, &res, http.MethodPost, nil, body); err != nil {
+		return nil, err
+	}
+
+	if res.Errors != nil {
+		return nil, fmt.Errorf("error creating group: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+	}
+
+	return &res.Data.Group, nil
+}
+
 // ListRoles returns a list of all roles.
 func (c *Client) ListRoles(ctx context.Context, cursor string) ([]Role, string, error) {
 	var res struct {
@@ -332,11 +528,22 @@ func (c *Client) ListRoles(ctx context.Context, cursor string) ([]Role, string,
 	return res.Data.Roles, "", nil
 }
 
-// AddGroupMembers adds user to a group.
-func (c *Client) AddGroupMembers(ctx context.Context, groupId, userEmail string) error {
+// AddGroupMembers adds the users with the given emails to a group, in requests of up to GroupMembersBatchSize
+// emails. When a request fails, the users of the requests before it remain added.
+func (c *Client) AddGroupMembers(ctx context.Context, groupId string, userEmails ...string) error {
+	for _, batch := range emailBatches(userEmails) {
+		if err := c.addGroupMembers(ctx, groupId, batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) addGroupMembers(ctx context.Context, groupId string, userEmails []string) error {
 	url, _ := url.JoinPath(BaseUrl, groups, groupId, users)
 	body := Payload{
-		Emails: []string{userEmail},
+		Emails: userEmails,
 	}
 
 	var res struct {
@@ -352,7 +559,7 @@ func (c *Client) AddGroupMembers(ctx context.Context, groupId, userEmail string)
 	}
 
 	if res.Errors != nil {
-		return fmt.Errorf("error adding user to a group: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+		return fmt.Errorf("error adding users to a group: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
 	}
 
 	return nil
@@ -367,6 +574,11 @@ func (c *Client) UpdatePermissions(ctx context.Context, principalId, principalTy
 		principal = groups
 	}
 
+	// removing every permission is an empty list, not null.
+	if newPermissions == nil {
+		newPermissions = []Permission{}
+	}
+
 	url, _ := url.JoinPath(BaseUrl, principal, principalId, permissions)
 	body := PermissionsPayload{Permissions: newPermissions}
 	var res struct {
@@ -388,9 +600,22 @@ func (c *Client) UpdatePermissions(ctx context.Context, principalId, principalTy
 	return nil
 }
 
-// RemoveGroupMember removes member from the group.
-func (c *Client) RemoveGroupMember(ctx context.Context, groupId, userEmail string) error {
-	url, _ := url.JoinPath(BaseUrl, groups, groupId, users)
+// RemoveGroupMembers removes the users with the given emails from the group, in requests of up to
+// GroupMembersBatchSize emails. When a request fails, the users of the requests before it remain removed.
+func (c *Client) RemoveGroupMembers(ctx context.Context, groupId string, userEmails ...string) error {
+	for _, batch := range emailBatches(userEmails) {
+		if err := c.removeGroupMembers(ctx, groupId, batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeGroupMembers removes users from the group in a single request. Segment answers with a SUCCESS status, or
+// with an empty body.
+func (c *Client) removeGroupMembers(ctx context.Context, groupId string, userEmails []string) error {
+	path, _ := url.JoinPath(BaseUrl, groups, groupId, users)
 	var res struct {
 		Data struct {
 			Status string `json:"status"`
@@ -399,21 +624,130 @@ func (c *Client) RemoveGroupMember(ctx context.Context, groupId, userEmail strin
 	}
 
 	params := c.setParams("")
-	emailParamValue, _ := json.Marshal([]string{userEmail})
+	emailParamValue, _ := json.Marshal(userEmails)
 	params.Add("emails", string(emailParamValue))
-	err := c.doRequest(ctx, url, res, http.MethodDelete, params, nil)
-	if err != nil {
-		return fmt.Errorf("failed to remove user from group: %w", err)
+	if err := c.doRequestAllowEmpty(ctx, path, &res, http.MethodDelete, params, nil); err != nil {
+		return fmt.Errorf("failed to remove users from group: %w", err)
+	}
+
+	if res.Errors != nil {
+		return fmt.Errorf("failed to remove users from group: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+	}
+
+	if res.Data.Status != "" && res.Data.Status != "SUCCESS" {
+		return fmt.Errorf("failed to remove users from group: status %s", res.Data.Status)
 	}
 
-	if res.Data.Status != "SUCCESS" {
-		return fmt.Errorf("failed to remove user from group")
+	return nil
+}
+
+// DeleteUser removes a user from the workspace.
+func (c *Client) DeleteUser(ctx context.Context, userId string) error {
+	path, _ := url.JoinPath(BaseUrl, users)
+	var res struct {
+		Data struct {
+			Status string `json:"status"`
+		} `json:"data,omitempty"`
+		Errors []Error `json:"errors,omitempty"`
+	}
+
+	params := c.setParams("")
+	userIdsParamValue, _ := json.Marshal([]string{userId})
+	params.Add("userIds", string(userIdsParamValue))
+	if err := c.doRequestAllowEmpty(ctx, path, &res, http.MethodDelete, params, nil); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	if res.Errors != nil {
+		return fmt.Errorf("failed to delete user: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+	}
+
+	if res.Data.Status != "" && res.Data.Status != "SUCCESS" {
+		return fmt.Errorf("failed to delete user: status %s", res.Data.Status)
 	}
 
 	return nil
 }
 
+// ListInvites returns the emails of the pending invites to the workspace.
+func (c *Client) ListInvites(ctx context.Context, cursor string) ([]string, string, error) {
+	var res struct {
+		Data struct {
+			Invites    []string   `json:"invites"`
+			Pagination Pagination `json:"pagination"`
+		} `json:"data,omitempty"`
+		Errors []Error `json:"errors,omitempty"`
+	}
+
+	params := c.setParams(cursor)
+	url, _ := url.JoinPath(BaseUrl, invites)
+	if err := c.doRequest(ctx, url, &res, http.MethodGet, params, nil); err != nil {
+		return nil, "", err
+	}
+
+	if res.Errors != nil {
+		return nil, "", fmt.Errorf("error fetching invites: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+	}
+
+	return res.Data.Invites, res.Data.Pagination.Next, nil
+}
+
+// DeleteInvites revokes the pending invites sent to the given emails.
+func (c *Client) DeleteInvites(ctx context.Context, emails ...string) error {
+	path, _ := url.JoinPath(BaseUrl, invites)
+	var res struct {
+		Data struct {
+			Status string `json:"status"`
+		} `json:"data,omitempty"`
+		Errors []Error `json:"errors,omitempty"`
+	}
+
+	params := c.setParams("")
+	emailParamValue, _ := json.Marshal(emails)
+	params.Add("emails", string(emailParamValue))
+	if err := c.doRequestAllowEmpty(ctx, path, &res, http.MethodDelete, params, nil); err != nil {
+		return fmt.Errorf("failed to delete invites: %w", err)
+	}
+
+	if res.Errors != nil {
+		return fmt.Errorf("failed to delete invites: %s - %s", res.Errors[0].Type, res.Errors[0].Message)
+	}
+
+	if res.Data.Status != "" && res.Data.Status != "SUCCESS" {
+		return fmt.Errorf("failed to delete invites: status %s", res.Data.Status)
+	}
+
+	return nil
+}
+
+// doRequest makes the request and decodes the response into res. Responses with an error status or without a body
+// fail.
 func (c *Client) doRequest(ctx context.Context, path string, res interface{}, method string, params url.Values, payload interface{}) error {
+	return c.sendRequest(ctx, path, res, method, params, payload, false)
+}
+
+// doRequestAllowEmpty makes the request like doRequest, except that an empty response body succeeds and leaves res
+// unchanged. Segment answers some deletions with an empty body.
+func (c *Client) doRequestAllowEmpty(
+	ctx context.Context,
+	path string,
+	res interface{},
+	method string,
+	params url.Values,
+	payload interface{},
+) error {
+	return c.sendRequest(ctx, path, res, method, params, payload, true)
+}
+
+func (c *Client) sendRequest(
+	ctx context.Context,
+	path string,
+	res interface{},
+	method string,
+	params url.Values,
+	payload interface{},
+	allowEmpty bool,
+) error {
 	var body []byte
 	var err error
 
@@ -435,7 +769,12 @@ func (c *Client) doRequest(ctx context.Context, path string, res interface{}, me
 
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/vnd.segment.v1+json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return err
@@ -443,13 +782,62 @@ func (c *Client) doRequest(ctx context.Context, path string, res interface{}, me
 
 	defer resp.Body.Close()
 
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return err
+	if status, ok := ctx.Value(responseStatusKey{}).(*ResponseStatus); ok {
+		status.Code = resp.StatusCode
+	}
+
+	rateLimit, err := helpers.ExtractRateLimitData(resp.StatusCode, &resp.Header)
+	if err == nil && rateLimit != nil && !rateLimit.ResetAt.AsTime().IsZero() {
+		c.mu.Lock()
+		c.rateLimit = rateLimit
+		c.mu.Unlock()
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resetAt := time.Now()
+		if rateLimit != nil {
+			resetAt = rateLimit.ResetAt.AsTime()
+		}
+		return &RateLimitError{ResetAt: resetAt}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errRes struct {
+			Errors []Error `json:"errors,omitempty"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&errRes); err == nil && len(errRes.Errors) > 0 {
+			return fmt.Errorf("request failed with status %d: %s - %s", resp.StatusCode, errRes.Errors[0].Type, errRes.Errors[0].Message)
+		}
+		return fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		if allowEmpty && errors.Is(err, io.EOF) {
+			return nil
+		}
+		return fmt.Errorf("invalid response with status %d: %w", resp.StatusCode, err)
 	}
 
 	return nil
 }
 
+// RateLimit returns the rate limit budget of the token reported by the last response holding it, or nil if no
+// response did.
+func (c *Client) RateLimit() *v2.RateLimitDescription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rateLimit
+}
+
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	if c.oauth != nil {
+		return c.oauth.Token(ctx)
+	}
+
+	return c.token, nil
+}
+
 func (c *Client) setParams(cursor string) url.Values {
 	query := url.Values{}
 	query.Add("pagination[count]", fmt.Sprint(200))
@@ -0,0 +1,187 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// redirectTransport sends requests to the target host instead of the Segment API.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// testClient returns a client whose requests are answered by handler.
+func testClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewClient(&http.Client{Transport: redirectTransport{target: target}}, "token")
+}
+
+func respond(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestResponseHandling(t *testing.T) {
+	listGroups := func(c *Client) error {
+		_, _, err := c.ListGroups(context.Background(), "")
+		return err
+	}
+	createGroup := func(c *Client) error {
+		_, err := c.CreateGroup(context.Background(), "Group")
+		return err
+	}
+	removeGroupMembers := func(c *Client) error {
+		return c.RemoveGroupMembers(context.Background(), "g1", "user@example.com")
+	}
+	deleteUser := func(c *Client) error {
+		return c.DeleteUser(context.Background(), "u1")
+	}
+	deleteInvites := func(c *Client) error {
+		return c.DeleteInvites(context.Background(), "user@example.com")
+	}
+
+	tests := []struct {
+		name    string
+		call    func(c *Client) error
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		{
+			name:    "list with an empty body",
+			call:    listGroups,
+			handler: respond(http.StatusOK, ""),
+			wantErr: "invalid response with status 200",
+		},
+		{
+			name:    "list with an error status and no body",
+			call:    listGroups,
+			handler: respond(http.StatusInternalServerError, ""),
+			wantErr: "request failed with status 500",
+		},
+		{
+			name:    "list with an error status and errors",
+			call:    listGroups,
+			handler: respond(http.StatusForbidden, `{"errors":[{"type":"forbidden","message":"missing scope"}]}`),
+			wantErr: "status 403: forbidden - missing scope",
+		},
+		{
+			name:    "create with an empty body",
+			call:    createGroup,
+			handler: respond(http.StatusOK, ""),
+			wantErr: "invalid response",
+		},
+		{
+			name:    "create with an error status",
+			call:    createGroup,
+			handler: respond(http.StatusBadGateway, `<html>bad gateway</html>`),
+			wantErr: "request failed with status 502",
+		},
+		{
+			name:    "group member removal with an empty body",
+			call:    removeGroupMembers,
+			handler: respond(http.StatusOK, ""),
+		},
+		{
+			name:    "group member removal with an error status",
+			call:    removeGroupMembers,
+			handler: respond(http.StatusInternalServerError, ""),
+			wantErr: "request failed with status 500",
+		},
+		{
+			name:    "group member removal with a failed status",
+			call:    removeGroupMembers,
+			handler: respond(http.StatusOK, `{"data":{"status":"FAILED"}}`),
+			wantErr: "status FAILED",
+		},
+		{
+			name:    "user deletion with an empty body",
+			call:    deleteUser,
+			handler: respond(http.StatusOK, ""),
+		},
+		{
+			name:    "user deletion with an error status",
+			call:    deleteUser,
+			handler: respond(http.StatusNotFound, ""),
+			wantErr: "request failed with status 404",
+		},
+		{
+			name:    "invite deletion with an empty body",
+			call:    deleteInvites,
+			handler: respond(http.StatusOK, ""),
+		},
+		{
+			name:    "invite deletion with an error status",
+			call:    deleteInvites,
+			handler: respond(http.StatusInternalServerError, ""),
+			wantErr: "request failed with status 500",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call(testClient(t, tt.handler))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	client := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	if client.RateLimit() != nil {
+		t.Fatal("rate limit known before any request")
+	}
+
+	_, err := client.GetUser(context.Background(), "u1")
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("GetUser() error = %v, want a rate limit error", err)
+	}
+	if until := time.Until(rateLimitErr.ResetAt); until < 25*time.Second || until > 30*time.Second {
+		t.Errorf("rate limit resets in %v, want about 30s", until)
+	}
+
+	rateLimit := client.RateLimit()
+	if rateLimit == nil || rateLimit.Limit != 100 || rateLimit.Remaining != 0 {
+		t.Errorf("rate limit = %v, want a limit of 100 with none remaining", rateLimit)
+	}
+}
@@ -39,14 +39,20 @@ type Role struct {
 }
 
 type Source struct {
-	ID          string        `json:"id"`
-	Slug        string        `json:"slug"`
-	Name        string        `json:"name"`
-	WorkspaceID string        `json:"workspaceId"`
-	Enabled     bool          `json:"enabled"`
-	WriteKeys   []string      `json:"writeKeys"`
-	Metadata    Metadata      `json:"metadata"`
-	Labels      []interface{} `json:"labels"`
+	ID          string   `json:"id"`
+	Slug        string   `json:"slug"`
+	Name        string   `json:"name"`
+	WorkspaceID string   `json:"workspaceId"`
+	Enabled     bool     `json:"enabled"`
+	WriteKeys   []string `json:"writeKeys"`
+	Metadata    Metadata `json:"metadata"`
+	Labels      []Label  `json:"labels"`
+}
+
+type Label struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Description string `json:"description,omitempty"`
 }
 
 type Metadata struct {
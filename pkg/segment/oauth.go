@@ -0,0 +1,200 @@
+package segment
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OAuthTokenUrl = "https://oauth2.segment.io/token"
+	OAuthScope    = "public_api:read_write"
+
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// assertionLifetime is how long the signed JWT can be exchanged for an access token.
+	assertionLifetime = 5 * time.Minute
+	// tokenExpiryLeeway refreshes access tokens before they expire, so requests in flight don't fail.
+	tokenExpiryLeeway = time.Minute
+)
+
+// OAuthConfig holds the credentials of a Segment OAuth app, used to get short-lived access tokens
+// for the Public API by signing a JWT with the app's private key.
+type OAuthConfig struct {
+	ClientID   string
+	KeyID      string
+	PrivateKey *rsa.PrivateKey
+	// TokenURL is the token endpoint, OAuthTokenUrl when empty.
+	TokenURL string
+	// Scope is the requested scope, OAuthScope when empty.
+	Scope string
+}
+
+// ParsePrivateKey parses a PEM encoded RSA private key in PKCS #1 or PKCS #8 form.
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
+
+// oauthTokenSource fetches access tokens from the token endpoint and caches them until they are about to expire.
+type oauthTokenSource struct {
+	httpClient *http.Client
+	config     OAuthConfig
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func newOAuthTokenSource(httpClient *http.Client, config OAuthConfig) *oauthTokenSource {
+	if config.TokenURL == "" {
+		config.TokenURL = OAuthTokenUrl
+	}
+	if config.Scope == "" {
+		config.Scope = OAuthScope
+	}
+
+	return &oauthTokenSource{
+		httpClient: httpClient,
+		config:     config,
+	}
+}
+
+// Token returns a cached access token, or fetches a new one if there is none or it is about to expire.
+func (o *oauthTokenSource) Token(ctx context.Context) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.accessToken != "" && time.Now().Add(tokenExpiryLeeway).Before(o.expiresAt) {
+		return o.accessToken, nil
+	}
+
+	accessToken, expiresIn, err := o.fetchToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	o.accessToken = accessToken
+	o.expiresAt = time.Now().Add(expiresIn)
+
+	return o.accessToken, nil
+}
+
+func (o *oauthTokenSource) fetchToken(ctx context.Context) (string, time.Duration, error) {
+	assertion, err := o.signAssertion()
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := url.Values{}
+	form.Add("grant_type", "client_credentials")
+	form.Add("client_assertion_type", clientAssertionType)
+	form.Add("client_assertion", assertion)
+	form.Add("scope", o.config.Scope)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer resp.Body.Close()
+
+	var res struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", 0, fmt.Errorf("error decoding OAuth token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || res.AccessToken == "" {
+		return "", 0, fmt.Errorf("error fetching OAuth access token: %s - %s (status %d)", res.Error, res.ErrorDescription, resp.StatusCode)
+	}
+
+	return res.AccessToken, time.Duration(res.ExpiresIn) * time.Second, nil
+}
+
+// signAssertion creates the RS256 signed JWT the app authenticates with at the token endpoint.
+func (o *oauthTokenSource) signAssertion() (string, error) {
+	tokenURL, err := url.Parse(o.config.TokenURL)
+	if err != nil {
+		return "", err
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	header := map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": o.config.KeyID,
+	}
+	claims := map[string]interface{}{
+		"iss": o.config.ClientID,
+		"sub": o.config.ClientID,
+		"aud": fmt.Sprintf("%s://%s", tokenURL.Scheme, tokenURL.Host),
+		"iat": now.Unix(),
+		"exp": now.Add(assertionLifetime).Unix(),
+		"jti": hex.EncodeToString(jti),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, o.config.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
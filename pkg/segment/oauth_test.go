@@ -0,0 +1,223 @@
+package segment
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPrivateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// verifyAssertion checks the RS256 signature of the JWT and returns its header and claims.
+func verifyAssertion(t *testing.T, publicKey *rsa.PublicKey, assertion string) (map[string]interface{}, map[string]interface{}) {
+	t.Helper()
+
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		t.Fatalf("assertion has %d parts, want 3", len(parts))
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("invalid assertion signature: %v", err)
+	}
+
+	decode := func(part string) map[string]interface{} {
+		data, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rv map[string]interface{}
+		if err := json.Unmarshal(data, &rv); err != nil {
+			t.Fatal(err)
+		}
+		return rv
+	}
+
+	return decode(parts[0]), decode(parts[1])
+}
+
+func TestSignAssertion(t *testing.T) {
+	key := testPrivateKey(t)
+	source := newOAuthTokenSource(http.DefaultClient, OAuthConfig{
+		ClientID:   "client",
+		KeyID:      "key",
+		PrivateKey: key,
+		TokenURL:   "https://oauth2.eu1.segmentapis.com/token",
+	})
+
+	assertion, err := source.signAssertion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, claims := verifyAssertion(t, &key.PublicKey, assertion)
+	for name, want := range map[string]string{"alg": "RS256", "typ": "JWT", "kid": "key"} {
+		if header[name] != want {
+			t.Errorf("header %s = %v, want %s", name, header[name], want)
+		}
+	}
+	for name, want := range map[string]string{"iss": "client", "sub": "client", "aud": "https://oauth2.eu1.segmentapis.com"} {
+		if claims[name] != want {
+			t.Errorf("claim %s = %v, want %s", name, claims[name], want)
+		}
+	}
+
+	iat, _ := claims["iat"].(float64)
+	exp, _ := claims["exp"].(float64)
+	if time.Duration(exp-iat)*time.Second != assertionLifetime {
+		t.Errorf("assertion lifetime = %vs, want %v", exp-iat, assertionLifetime)
+	}
+	if claims["jti"] == "" {
+		t.Error("assertion has no jti")
+	}
+
+	other, err := source.signAssertion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, otherClaims := verifyAssertion(t, &key.PublicKey, other); otherClaims["jti"] == claims["jti"] {
+		t.Error("assertions share the same jti")
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn int
+		calls     int
+		fetches   int
+	}{
+		{name: "cached until close to expiry", expiresIn: 3600, calls: 3, fetches: 1},
+		{name: "refreshed within the expiry leeway", expiresIn: int(tokenExpiryLeeway/time.Second) - 1, calls: 3, fetches: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := testPrivateKey(t)
+			var assertions []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Error(err)
+					return
+				}
+				if got := r.PostForm.Get("client_assertion_type"); got != clientAssertionType {
+					t.Errorf("client_assertion_type = %s", got)
+				}
+				if got := r.PostForm.Get("scope"); got != OAuthScope {
+					t.Errorf("scope = %s, want %s", got, OAuthScope)
+				}
+				assertions = append(assertions, r.PostForm.Get("client_assertion"))
+				fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":%d}`, len(assertions), tt.expiresIn)
+			}))
+			defer srv.Close()
+
+			source := newOAuthTokenSource(srv.Client(), OAuthConfig{
+				ClientID:   "client",
+				KeyID:      "key",
+				PrivateKey: key,
+				TokenURL:   srv.URL,
+			})
+
+			var token string
+			for i := 0; i < tt.calls; i++ {
+				var err error
+				token, err = source.Token(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if len(assertions) != tt.fetches {
+				t.Errorf("fetched %d tokens, want %d", len(assertions), tt.fetches)
+			}
+			for _, assertion := range assertions {
+				verifyAssertion(t, &key.PublicKey, assertion)
+			}
+			if want := fmt.Sprintf("token-%d", tt.fetches); token != want {
+				t.Errorf("token = %s, want %s", token, want)
+			}
+		})
+	}
+}
+
+func TestTokenError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_client","error_description":"unknown key"}`)
+	}))
+	defer srv.Close()
+
+	source := newOAuthTokenSource(srv.Client(), OAuthConfig{
+		ClientID:   "client",
+		KeyID:      "key",
+		PrivateKey: testPrivateKey(t),
+		TokenURL:   srv.URL,
+	})
+
+	_, err := source.Token(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("Token() error = %v, want the token endpoint error", err)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key := testPrivateKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "PKCS #1", data: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})},
+		{name: "PKCS #8", data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})},
+		{name: "not PEM", data: []byte("not a key"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParsePrivateKey(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ParsePrivateKey() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !parsed.Equal(key) {
+				t.Error("parsed key differs from the original")
+			}
+		})
+	}
+}